@@ -6,10 +6,17 @@ require (
 	github.com/alecthomas/kong v0.2.18
 	github.com/go-logr/logr v1.2.1
 	github.com/go-logr/zerologr v1.2.1
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/golang-jwt/jwt/v4 v4.0.0
+	github.com/klauspost/compress v1.13.6
 	github.com/optable/match v1.2.1
 	github.com/optable/match-api v1.4.11
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/rs/zerolog v1.25.0
 	github.com/segmentio/ksuid v1.0.3
+	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
+	github.com/ttacon/libphonenumber v1.2.1
+	github.com/xitongsys/parquet-go v1.6.2
 	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v3 v3.0.1
 )
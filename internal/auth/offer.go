@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// offerVersion is the version of the match offer format.
+const offerVersion = 1
+
+// offerSeparator separates the encoded payload of an offer from its
+// encoded signature.
+const offerSeparator = "."
+
+// MatchOffer is an out-of-band invitation to run a match directly between
+// two peers, without a DCN. It carries the ephemereal certificate the peer
+// presents during the TLS handshake, so that both sides can pin each other.
+// An offer can only be used until its certificate expires, an hour after it
+// is created.
+type MatchOffer struct {
+	Version int `json:"version"`
+	// Endpoint is the host:port the peer listens on as the match
+	// receiver, empty for the match sender.
+	Endpoint       string    `json:"endpoint,omitempty"`
+	CertificatePem string    `json:"certificate_pem"`
+	Protocols      []string  `json:"protocols"`
+	CreatedAt      time.Time `json:"created_at"`
+	// PublicKey is the base64 encoded PKIX public key of the peer, which
+	// signs the offer and certifies the ephemereal certificate.
+	PublicKey string `json:"public_key"`
+}
+
+// SignOffer signs the offer with the private key of the ephemereal
+// certificate of the offer and returns the encoded offer: its base64 encoded
+// JSON payload and the base64 encoded signature of that payload, separated
+// by a dot.
+func SignOffer(offer *MatchOffer, privateKey *ecdsa.PrivateKey) (string, error) {
+	marshaledPublicKey, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	offer.Version = offerVersion
+	offer.PublicKey = base64.StdEncoding.EncodeToString(marshaledPublicKey)
+
+	payload, err := json.Marshal(offer)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal offer: %w", err)
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign offer: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(payload) + offerSeparator + base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// ParseOffer decodes an encoded offer and verifies that its payload, as
+// received, is signed by its public key, and that its certificate is a valid
+// certificate of that key.
+func ParseOffer(encoded string, now time.Time) (*MatchOffer, error) {
+	parts := strings.Split(encoded, offerSeparator)
+	if len(parts) != 2 {
+		return nil, errors.New("failed to decode offer: want a payload and a signature")
+	}
+	payload, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode offer: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode offer signature: %w", err)
+	}
+
+	var offer MatchOffer
+	if err := json.Unmarshal(payload, &offer); err != nil {
+		return nil, fmt.Errorf("failed to decode offer: %w", err)
+	}
+	if offer.Version != offerVersion {
+		return nil, fmt.Errorf("unsupported offer version %d", offer.Version)
+	}
+
+	publicKey, err := ParsePublicKey(offer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return nil, errors.New("invalid offer signature")
+	}
+
+	cert, err := ParseCertificatePEM(offer.CertificatePem)
+	if err != nil {
+		return nil, err
+	}
+	certPublicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !certPublicKey.Equal(publicKey) {
+		return nil, errors.New("offer certificate does not match the offer public key")
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("offer certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return &offer, nil
+}
+
+// ParsePublicKey parses a base64 encoded PKIX ECDSA public key.
+func ParsePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 encoded public key: %w", err)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	publicKey, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an ECDSA key")
+	}
+	return publicKey, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a base64 encoded PKIX
+// public key, short enough to be confirmed with a partner out-of-band.
+func Fingerprint(publicKey string) (string, error) {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64 encoded public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
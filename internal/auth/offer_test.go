@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestOffer(t *testing.T, key *ecdsa.PrivateKey) *MatchOffer {
+	t.Helper()
+	cert, err := NewEphemerealCertificate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MatchOffer{
+		Endpoint:       "match.example.com:8443",
+		CertificatePem: string(cert.CertificatePem),
+		Protocols:      []string{"kkrtpsi", "dhpsi"},
+		CreatedAt:      time.Now().UTC(),
+	}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignAndParseOffer(t *testing.T) {
+	key := newTestKey(t)
+	encoded, err := SignOffer(newTestOffer(t, key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := ParseOffer(encoded, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.Endpoint != "match.example.com:8443" || len(offer.Protocols) != 2 || offer.Protocols[0] != "kkrtpsi" {
+		t.Fatalf("unexpected offer %+v", offer)
+	}
+
+	if _, err := ParseOffer(encoded, time.Now().Add(2*time.Hour)); err == nil {
+		t.Fatal("want an error for an expired offer certificate")
+	}
+}
+
+func TestParseTamperedOffer(t *testing.T) {
+	key := newTestKey(t)
+	encoded, err := SignOffer(newTestOffer(t, key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(encoded, ".")
+	payload, _ := base64.StdEncoding.DecodeString(parts[0])
+
+	tamper := func(payload []byte) string {
+		return base64.StdEncoding.EncodeToString(payload) + "." + parts[1]
+	}
+	var offer MatchOffer
+	if err := json.Unmarshal(payload, &offer); err != nil {
+		t.Fatal(err)
+	}
+	offer.Endpoint = "attacker.example.com:8443"
+	tampered, _ := json.Marshal(&offer)
+	if _, err := ParseOffer(tamper(tampered), time.Now()); err == nil {
+		t.Fatal("want an error for a tampered offer")
+	}
+
+	// the signature covers the payload as sent, including the fields this
+	// version ignores
+	extended := append(bytes.TrimSuffix(payload, []byte("}")), []byte(`,"unknown":true}`)...)
+	if _, err := ParseOffer(tamper(extended), time.Now()); err == nil {
+		t.Fatal("want an error for an offer with an unsigned field")
+	}
+
+	if _, err := ParseOffer(parts[0], time.Now()); err == nil {
+		t.Fatal("want an error for an offer without signature")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	encoded, err := SignOffer(newTestOffer(t, newTestKey(t)), newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(strings.Split(encoded, ".")[0])
+	var offer MatchOffer
+	if err := json.Unmarshal(payload, &offer); err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint, err := Fingerprint(offer.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fingerprint, "SHA256:") || len(fingerprint) != len("SHA256:")+43 {
+		t.Fatalf("unexpected fingerprint %q", fingerprint)
+	}
+	if again, _ := Fingerprint(offer.PublicKey); again != fingerprint {
+		t.Fatalf("want a stable fingerprint, got %q and %q", fingerprint, again)
+	}
+	if _, err := Fingerprint("not base64!"); err == nil {
+		t.Fatal("want an error for an invalid public key")
+	}
+}
+
+func TestParseOfferCertificateOfAnotherKey(t *testing.T) {
+	key := newTestKey(t)
+	// the certificate is not certified by the signing key
+	encoded, err := SignOffer(newTestOffer(t, newTestKey(t)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseOffer(encoded, time.Now()); err == nil {
+		t.Fatal("want an error for a certificate of another key")
+	}
+}
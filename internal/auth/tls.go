@@ -21,16 +21,12 @@ type EphemerealCertificate struct {
 func NewEphemerealCertificate(privateKey *ecdsa.PrivateKey) (*EphemerealCertificate, error) {
 	ret := EphemerealCertificate{}
 
-	privateKeyDer, err := x509.MarshalECPrivateKey(privateKey)
+	var err error
+	ret.PrivateKeyPem, err = marshalPrivateKeyPem(privateKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+		return nil, err
 	}
 
-	ret.PrivateKeyPem = pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: privateKeyDer,
-	})
-
 	serialNumber, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate ephemereal certificate serial number: %w", err)
@@ -54,6 +50,28 @@ func NewEphemerealCertificate(privateKey *ecdsa.PrivateKey) (*EphemerealCertific
 	return &ret, nil
 }
 
+// LoadEphemerealCertificate returns the ephemereal certificate of privateKey
+// previously created with NewEphemerealCertificate and shared as certificatePem.
+func LoadEphemerealCertificate(certificatePem []byte, privateKey *ecdsa.PrivateKey) (*EphemerealCertificate, error) {
+	privateKeyPem, err := marshalPrivateKeyPem(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EphemerealCertificate{CertificatePem: certificatePem, PrivateKeyPem: privateKeyPem}, nil
+}
+
+func marshalPrivateKeyPem(privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	privateKeyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: privateKeyDer,
+	}), nil
+}
+
 func (c *EphemerealCertificate) GetTLSCertificate() (tls.Certificate, error) {
 	return tls.X509KeyPair(c.CertificatePem, c.PrivateKeyPem)
 }
@@ -3,13 +3,19 @@ package client
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	v1 "github.com/optable/match-api/match/v1"
 
+	"github.com/segmentio/ksuid"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
@@ -39,6 +45,77 @@ func NewClient(url string, tokenSource TokenSource) *OptableRpcClient {
 	return &OptableRpcClient{Client: client, url: url, tokenSource: tokenSource}
 }
 
+// StatusError is the error of a call answered with another status than
+// 200 OK.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// RequestID is the ID sent in the X-Request-Id header of the call.
+	RequestID string
+	// RetryAfter is the delay asked by the Retry-After header, 0 without
+	// one.
+	RetryAfter time.Duration
+	// Body is the error sent by the server, nil when the response has
+	// none.
+	Body *v1.Error
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("unexpected status code for %s %s: %s", e.Method, e.URL, e.Status)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request %s)", e.RequestID)
+	}
+	if e.Body == nil {
+		return "error without body: " + msg
+	}
+	errString, err := protojson.Marshal(e.Body)
+	if err != nil {
+		return msg
+	}
+	return msg + ": " + string(errString)
+}
+
+// Retryable reports whether err is a transient failure of a call worth
+// retrying: a 429 or 5xx status, or a network error. It also returns the
+// delay asked by the server, 0 when it asked none.
+func Retryable(err error) (bool, time.Duration) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500, statusErr.RetryAfter
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF), 0
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as a date
+// after now.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// idempotentMethods are the calls that can be safely sent again: the reads,
+// and /match/run whose match result UID is chosen by the caller.
+var idempotentMethods = map[string]bool{
+	"/match/run":         true,
+	"/match/get-result":  true,
+	"/match/list":        true,
+	"/match/get-results": true,
+}
+
 // Implementation details
 
 func (c *OptableRpcClient) path(method string) string {
@@ -58,6 +135,9 @@ func (c *OptableRpcClient) Do(ctx context.Context, method string, req, res proto
 		return err
 	}
 
+	if idempotentMethods[method] {
+		ctx = withIdempotent(ctx)
+	}
 	httpReq, err := http.NewRequestWithContext(ctx, httpReqMethod, c.path(method), bytes.NewBuffer(msg))
 	if err != nil {
 		return err
@@ -71,36 +151,33 @@ func (c *OptableRpcClient) Do(ctx context.Context, method string, req, res proto
 		httpReq.Header.Add("Authorization", "Bearer "+token)
 	}
 	httpReq.Header.Add("Content-Type", "application/protobuf")
+	requestID := ksuid.New().String()
+	httpReq.Header.Set(RequestIDHeader, requestID)
 
 	httpResp, err := c.Client.Do(httpReq)
 	if err != nil {
-		return err
+		return fmt.Errorf("request %s failed: %w", requestID, err)
 	}
 	defer httpResp.Body.Close()
 
 	body, err := ioutil.ReadAll(httpResp.Body)
 	if err != nil {
-		return err
+		return fmt.Errorf("request %s failed: %w", requestID, err)
 	}
 
 	if httpResp.StatusCode != http.StatusOK {
-		res := &v1.Error{}
-
-		respErr := fmt.Errorf(
-			"unexpected status code for %s %s: %s",
-			httpReqMethod, c.path(method), httpResp.Status,
-		)
-
-		if err := proto.Unmarshal(body, res); err != nil {
-			return fmt.Errorf("error without body: %w", respErr)
+		statusErr := &StatusError{
+			Method:     httpReqMethod,
+			URL:        c.path(method),
+			StatusCode: httpResp.StatusCode,
+			Status:     httpResp.Status,
+			RequestID:  requestID,
+			RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After"), time.Now()),
 		}
-
-		errString, err := protojson.Marshal(res)
-		if err != nil {
-			return err
+		if res := (&v1.Error{}); proto.Unmarshal(body, res) == nil {
+			statusErr.Body = res
 		}
-
-		return fmt.Errorf(respErr.Error()+": %s", errString)
+		return statusErr
 	}
 
 	return proto.Unmarshal(body, res)
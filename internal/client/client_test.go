@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) *OptableRpcClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	tokenSource := TokenSourceFn(func(_ *http.Request) (string, error) {
+		return "token", nil
+	})
+	// trailing slashes are removed from the url
+	return NewClient(server.URL+"/", tokenSource)
+}
+
+func writeProto(t *testing.T, w http.ResponseWriter, code int, res proto.Message) {
+	t.Helper()
+	payload, err := proto.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteHeader(code)
+	_, _ = w.Write(payload)
+}
+
+func TestDo(t *testing.T) {
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/match/run" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/protobuf" {
+			t.Errorf("unexpected content type %q", contentType)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		req := &v1.RunExternalMatchReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Error(err)
+		}
+		writeProto(t, w, http.StatusOK, &v1.RunExternalMatchRes{MatchResultUid: req.MatchResultUid, Endpoint: "127.0.0.1:8443"})
+	})
+
+	res, err := client.RunMatch(context.Background(), &v1.RunExternalMatchReq{MatchUid: "match", MatchResultUid: "result"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MatchResultUid != "result" || res.Endpoint != "127.0.0.1:8443" {
+		t.Fatalf("unexpected response %v", res)
+	}
+}
+
+func TestDoError(t *testing.T) {
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeProto(t, w, http.StatusNotFound, &v1.Error{Message: "match not found"})
+	})
+
+	_, err := client.GetResult(context.Background(), &v1.GetExternalMatchResultReq{MatchResultUid: "result"})
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	for _, want := range []string{"/match/get-result", "404 Not Found", "match not found"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("want %q in error %q", want, err)
+		}
+	}
+}
+
+func TestDoErrorWithoutBody(t *testing.T) {
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte{0xff})
+	})
+
+	err := client.RegisterPartner(context.Background(), &v1.RegisterPartnerReq{Token: "invite"})
+	if err == nil || !strings.Contains(err.Error(), "error without body") || !strings.Contains(err.Error(), "502 Bad Gateway") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestDoTokenError(t *testing.T) {
+	client := NewClient("http://127.0.0.1:0", TokenSourceFn(func(_ *http.Request) (string, error) {
+		return "", context.DeadlineExceeded
+	}))
+
+	if _, err := client.ListMatches(context.Background(), &v1.ListExternalMatchReq{}); err != context.DeadlineExceeded {
+		t.Fatalf("want the error of the token source, got %v", err)
+	}
+}
+
+func TestDoRetryAfter(t *testing.T) {
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		writeProto(t, w, http.StatusTooManyRequests, &v1.Error{Message: "slow down"})
+	})
+
+	_, err := client.GetResult(context.Background(), &v1.GetExternalMatchResultReq{MatchResultUid: "result"})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests || statusErr.Body.GetMessage() != "slow down" {
+		t.Fatalf("want a status error, got %v", err)
+	}
+	if retryable, retryAfter := Retryable(err); !retryable || retryAfter != 3*time.Second {
+		t.Fatalf("want a retryable error after 3s, got %v after %v", retryable, retryAfter)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1", Err: errors.New("connection refused")}, true},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1", Err: context.DeadlineExceeded}, false},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("invalid"), false},
+	} {
+		if retryable, _ := Retryable(tc.err); retryable != tc.want {
+			t.Fatalf("want retryable %v for %v, got %v", tc.want, tc.err, retryable)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	for header, want := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"Tue, 01 Jun 2021 10:00:30 GMT": 30 * time.Second,
+		"Tue, 01 Jun 2021 09:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if got := parseRetryAfter(header, now); got != want {
+			t.Fatalf("want %v for %q, got %v", want, header, got)
+		}
+	}
+}
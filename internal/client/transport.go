@@ -0,0 +1,257 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/optable/match-cli/internal/poll"
+)
+
+// RequestIDHeader identifies a call, in the logs of both sides.
+const RequestIDHeader = "X-Request-Id"
+
+// idempotentKey is the context key marking a call that can be safely sent
+// again.
+type idempotentKey struct{}
+
+// withIdempotent returns a copy of ctx marking the requests sent with it as
+// idempotent.
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// TransportOptions configures the transport of a client. Zero values
+// disable their layer.
+type TransportOptions struct {
+	// Timeout bounds each attempt of a call, the response body included.
+	Timeout time.Duration
+	// MaxRetries is the number of times an idempotent call is sent again
+	// after a network error or a 429 or 5xx status.
+	MaxRetries int
+	// RetryInterval is the wait before the first retry, doubled after
+	// every retry.
+	RetryInterval time.Duration
+	// RateLimit is the number of attempts per second sent at most, and
+	// RateBurst the number sent at once before being limited.
+	RateLimit float64
+	RateBurst int
+}
+
+const (
+	defaultRetryInterval = 200 * time.Millisecond
+	maxRetryInterval     = 10 * time.Second
+)
+
+// NewTransport returns a transport sending requests with base, or
+// http.DefaultTransport when nil. Idempotent calls are retried with backoff,
+// and every attempt is rate limited then timed out.
+func NewTransport(base http.RoundTripper, opts TransportOptions) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport := base
+	if opts.Timeout > 0 {
+		transport = &timeoutTransport{next: transport, timeout: opts.Timeout}
+	}
+	if opts.RateLimit > 0 {
+		transport = &rateLimitTransport{next: transport, limiter: newRateLimiter(opts.RateLimit, opts.RateBurst)}
+	}
+	if opts.MaxRetries > 0 {
+		interval := opts.RetryInterval
+		if interval <= 0 {
+			interval = defaultRetryInterval
+		}
+		transport = &retryTransport{
+			next:       transport,
+			maxRetries: opts.MaxRetries,
+			backoff:    &poll.Policy{Interval: interval, MaxInterval: maxRetryInterval, Multiplier: 2, Jitter: 0.2},
+		}
+	}
+	return transport
+}
+
+// retryTransport sends idempotent requests again after transient failures.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	backoff    *poll.Policy
+}
+
+// idempotent reports whether req can be sent again: a GET or a call whose
+// context is marked idempotent, whose body can be replayed.
+func idempotent(req *http.Request) bool {
+	marked, _ := req.Context().Value(idempotentKey{}).(bool)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && !marked {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 {
+			attemptReq = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		res, err := t.next.RoundTrip(attemptReq)
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil || attempt >= t.maxRetries {
+				return nil, err
+			}
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			if attempt >= t.maxRetries {
+				return res, nil
+			}
+			retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		default:
+			return res, nil
+		}
+
+		wait := t.backoff.Backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if err := poll.Wait(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rateLimitTransport spaces out requests with a token bucket.
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := poll.Wait(req.Context(), t.limiter.reserve(time.Now())); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// rateLimiter is a token bucket refilled at rate tokens per second, up to
+// burst tokens. Tokens are reserved ahead, so waiting requests are served in
+// order.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// reserve takes a token and returns the wait until it is available.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// timeoutTransport bounds each request, until its response body is closed.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, t.timedOut(req.Context(), ctx, err)
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel, err: func(err error) error {
+		return t.timedOut(req.Context(), ctx, err)
+	}}
+	return res, nil
+}
+
+// timedOut returns an AttemptTimeoutError instead of err when the attempt
+// ran out of time while its call can still go on.
+func (t *timeoutTransport) timedOut(parent, attempt context.Context, err error) error {
+	if parent.Err() == nil && attempt.Err() == context.DeadlineExceeded {
+		return &AttemptTimeoutError{After: t.timeout}
+	}
+	return err
+}
+
+// AttemptTimeoutError is returned when an attempt of a call exceeds the
+// timeout of the transport. Unlike the deadline of the call, it is a
+// transient network error.
+type AttemptTimeoutError struct {
+	After time.Duration
+}
+
+func (e *AttemptTimeoutError) Error() string {
+	return fmt.Sprintf("attempt timed out after %v", e.After)
+}
+
+// Timeout and Temporary implement net.Error.
+func (e *AttemptTimeoutError) Timeout() bool   { return true }
+func (e *AttemptTimeoutError) Temporary() bool { return true }
+
+// cancelBody cancels the context of its request once closed, err mapping
+// the errors of its reads.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	err    func(error) error
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = b.err(err)
+	}
+	return n, err
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
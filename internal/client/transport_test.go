@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTransportRetry(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		requestIDs []string
+		failures   = int32(2)
+	)
+	calls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := len(requestIDs)
+		requestIDs = nil
+		return n
+	}
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestIDs = append(requestIDs, r.Header.Get(RequestIDHeader))
+		mu.Unlock()
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			t.Errorf("want idempotent calls to be marked internally, got Idempotency-Key %q", key)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(body) == 0 {
+			t.Errorf("want the body to be sent on every attempt, got %q: %v", body, err)
+		}
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			writeProto(t, w, http.StatusServiceUnavailable, &v1.Error{Message: "unavailable"})
+			return
+		}
+		writeProto(t, w, http.StatusOK, &v1.GetExternalMatchResultRes{})
+	})
+	client.Transport = NewTransport(nil, TransportOptions{MaxRetries: 2, RetryInterval: time.Millisecond})
+
+	if _, err := client.GetResult(context.Background(), &v1.GetExternalMatchResultReq{MatchResultUid: "result"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	ids := requestIDs
+	mu.Unlock()
+	if len(ids) != 3 || ids[0] == "" || ids[0] != ids[2] {
+		t.Fatalf("want 3 attempts of the same request, got %v", ids)
+	}
+	calls()
+
+	atomic.StoreInt32(&failures, 10)
+	err := client.RegisterPartner(context.Background(), &v1.RegisterPartnerReq{Token: "invite"})
+	var statusErr *StatusError
+	if n := calls(); !errors.As(err, &statusErr) || n != 1 {
+		t.Fatalf("want a call that is not idempotent to be sent once, got %d calls: %v", n, err)
+	}
+	if statusErr.RequestID == "" || !strings.Contains(err.Error(), statusErr.RequestID) {
+		t.Fatalf("want the request ID in error %q", err)
+	}
+
+	_, err = client.GetResult(context.Background(), &v1.GetExternalMatchResultReq{MatchResultUid: "result"})
+	if n := calls(); !errors.As(err, &statusErr) || n != 3 {
+		t.Fatalf("want the error after the retry budget, got %d calls: %v", n, err)
+	}
+}
+
+func TestTransportRetryRunMatch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		uids     []string
+		failures = int32(1)
+	)
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		req := &v1.RunExternalMatchReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		uids = append(uids, req.MatchResultUid)
+		mu.Unlock()
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			writeProto(t, w, http.StatusBadGateway, &v1.Error{Message: "bad gateway"})
+			return
+		}
+		writeProto(t, w, http.StatusOK, &v1.RunExternalMatchRes{MatchResultUid: req.MatchResultUid})
+	})
+	client.Transport = NewTransport(nil, TransportOptions{MaxRetries: 1, RetryInterval: time.Millisecond})
+
+	// resending /match/run is safe as the match result UID chosen by the
+	// caller identifies the same run
+	res, err := client.RunMatch(context.Background(), &v1.RunExternalMatchReq{MatchUid: "match", MatchResultUid: "result"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 2 || uids[0] != "result" || uids[1] != "result" || res.MatchResultUid != "result" {
+		t.Fatalf("want the match result UID to be resent, got %v and %v", uids, res)
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	client.Transport = NewTransport(nil, TransportOptions{Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := client.ListMatches(context.Background(), &v1.ListExternalMatchReq{})
+	var timeoutErr *AttemptTimeoutError
+	if !errors.As(err, &timeoutErr) || !strings.Contains(err.Error(), "request ") {
+		t.Fatalf("want the call to time out with its request ID, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("want the call to stop after its timeout, took %v", elapsed)
+	}
+	// the timeout of an attempt is retried, unlike the deadline of the call
+	if retryable, _ := Retryable(err); !retryable {
+		t.Fatalf("want the timeout of an attempt to be retryable, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.ListMatches(ctx, &v1.ListExternalMatchReq{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the deadline of the call, got %v", err)
+	}
+	if retryable, _ := Retryable(err); retryable {
+		t.Fatalf("want the deadline of the call not to be retried, got %v", err)
+	}
+}
+
+func TestTransportRateLimit(t *testing.T) {
+	client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeProto(t, w, http.StatusOK, &v1.ListExternalMatchRes{})
+	})
+	client.Transport = NewTransport(nil, TransportOptions{RateLimit: 20, RateBurst: 2})
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := client.ListMatches(context.Background(), &v1.ListExternalMatchReq{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("want 4 calls past the burst to take 200ms at 20 calls per second, took %v", elapsed)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	l := newRateLimiter(10, 2)
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if wait := l.reserve(now); wait != want {
+			t.Fatalf("want a wait of %v for call %d, got %v", want, i, wait)
+		}
+	}
+	if wait := l.reserve(now.Add(time.Second)); wait != 0 {
+		t.Fatalf("want the bucket to refill, got a wait of %v", wait)
+	}
+}
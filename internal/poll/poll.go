@@ -0,0 +1,102 @@
+// Package poll polls operations with exponential backoff, retrying their
+// transient errors within a budget.
+package poll
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Policy configures the waits between the polls of an operation and the
+// retries of its transient errors.
+type Policy struct {
+	// Interval is the wait before the second poll.
+	Interval time.Duration
+	// MaxInterval caps the wait between polls.
+	MaxInterval time.Duration
+	// Multiplier is the growth of the wait after every poll, 1 or less
+	// polls at a fixed interval.
+	Multiplier float64
+	// Jitter is the ratio of the wait randomly added or removed, so that
+	// clients polling together spread out.
+	Jitter float64
+	// MaxRetries is the number of consecutive transient errors retried,
+	// the count starting over after every successful poll.
+	MaxRetries int
+	// Retryable reports whether an error is transient, along with the
+	// delay asked by the server. Errors are not retried when nil.
+	Retryable func(err error) (bool, time.Duration)
+	// OnRetry is called, when set, before waiting to retry an error.
+	OnRetry func(err error, wait time.Duration)
+}
+
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Backoff returns the wait after the poll numbered attempt, from 0.
+func (p *Policy) Backoff(attempt int) time.Duration {
+	wait := float64(p.Interval)
+	if p.Multiplier > 1 {
+		wait *= math.Pow(p.Multiplier, float64(attempt))
+	}
+	if p.MaxInterval > 0 && wait > float64(p.MaxInterval) {
+		wait = float64(p.MaxInterval)
+	}
+	if p.Jitter > 0 {
+		randMu.Lock()
+		wait += wait * p.Jitter * (2*random.Float64() - 1)
+		randMu.Unlock()
+	}
+	return time.Duration(wait)
+}
+
+// Poll calls fn until it is done, fails with an error that is not
+// retryable or exceeds the retry budget, or ctx is done.
+func Poll(ctx context.Context, p *Policy, fn func(ctx context.Context) (done bool, err error)) error {
+	retries := 0
+	for attempt := 0; ; attempt++ {
+		done, err := fn(ctx)
+		wait := p.Backoff(attempt)
+		if err != nil {
+			if ctx.Err() != nil || p.Retryable == nil || retries >= p.MaxRetries {
+				return err
+			}
+			retryable, retryAfter := p.Retryable(err)
+			if !retryable {
+				return err
+			}
+			retries++
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+			if p.OnRetry != nil {
+				p.OnRetry(err, wait)
+			}
+		} else if done {
+			return nil
+		} else {
+			retries = 0
+		}
+
+		if err := Wait(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// Wait waits for d or until ctx is done.
+func Wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
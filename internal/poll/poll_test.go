@@ -0,0 +1,110 @@
+package poll
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+func retryable(err error) (bool, time.Duration) {
+	return errors.Is(err, errTransient), 0
+}
+
+func TestBackoff(t *testing.T) {
+	p := &Policy{Interval: time.Second, MaxInterval: 5 * time.Second, Multiplier: 2}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if wait := p.Backoff(attempt); wait != want {
+			t.Fatalf("want a wait of %v after attempt %d, got %v", want, attempt, wait)
+		}
+	}
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if wait := p.Backoff(0); wait < 800*time.Millisecond || wait > 1200*time.Millisecond {
+			t.Fatalf("want a wait within 20%% of 1s, got %v", wait)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	p := &Policy{Interval: time.Millisecond, MaxRetries: 2, Retryable: retryable}
+
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		calls int
+		want  error
+	}{
+		{"pending", []error{nil, nil, nil}, 4, nil},
+		{"retried", []error{errTransient, nil, errTransient}, 4, nil},
+		{"budget", []error{errTransient, errTransient, errTransient}, 3, errTransient},
+		{"reset", []error{errTransient, errTransient, nil, errTransient, errTransient}, 6, nil},
+		{"permanent", []error{nil, errPermanent}, 2, errPermanent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := Poll(context.Background(), p, func(ctx context.Context) (bool, error) {
+				calls++
+				if calls > len(tc.errs) {
+					return true, nil
+				}
+				return false, tc.errs[calls-1]
+			})
+			if err != tc.want || calls != tc.calls {
+				t.Fatalf("want %v after %d calls, got %v after %d", tc.want, tc.calls, err, calls)
+			}
+		})
+	}
+}
+
+func TestPollRetryAfter(t *testing.T) {
+	p := &Policy{
+		Interval:   time.Millisecond,
+		MaxRetries: 1,
+		Retryable: func(err error) (bool, time.Duration) {
+			return true, 100 * time.Millisecond
+		},
+	}
+	var waits []time.Duration
+	p.OnRetry = func(err error, wait time.Duration) {
+		waits = append(waits, wait)
+	}
+
+	start := time.Now()
+	calls := 0
+	err := Poll(context.Background(), p, func(ctx context.Context) (bool, error) {
+		calls++
+		if calls == 1 {
+			return false, errTransient
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0] != 100*time.Millisecond || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("want to wait the 100ms asked by the server, waited %v", waits)
+	}
+}
+
+func TestPollCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Poll(ctx, &Policy{Interval: time.Hour}, func(ctx context.Context) (bool, error) {
+		return false, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want the deadline to stop the wait, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("want the wait to stop with the context, waited %v", elapsed)
+	}
+}
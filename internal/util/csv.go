@@ -0,0 +1,155 @@
+package util
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseColumnMapping parses column mappings of the form column=prefix,
+// such as email_sha256=e, into a map of column to identifier type prefix.
+func ParseColumnMapping(mappings []string) (map[string]string, error) {
+	columns := make(map[string]string, len(mappings))
+	for _, mapping := range mappings {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid column mapping %q, want column=prefix", mapping)
+		}
+
+		prefix, err := parsePrefix(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid column mapping %q: %w", mapping, err)
+		}
+		columns[strings.TrimSpace(parts[0])] = prefix
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("at least one column mapping is required")
+	}
+	return columns, nil
+}
+
+// parsePrefix returns the identifier type prefix for p, which can be given
+// with or without its trailing colon.
+func parsePrefix(p string) (string, error) {
+	prefix := strings.TrimSpace(p)
+	if !strings.HasSuffix(prefix, ":") {
+		prefix += ":"
+	}
+
+	if IdentifierTypes.ByPrefix(prefix) != nil {
+		return prefix, nil
+	}
+	return "", fmt.Errorf("unknown identifier type prefix %q", p)
+}
+
+type columnPrefix struct {
+	index  int
+	prefix string
+}
+
+// csvReader reads identifiers from the mapped columns of delimited records.
+type csvReader struct {
+	reader  *csv.Reader
+	columns map[string]string
+
+	initialized bool
+	mapped      []columnPrefix
+	pending     []string
+}
+
+// NewCSVReader returns an IdentifierReader over delimited records. columns
+// maps each column to the identifier type prefix of its values. A column is
+// either a header name or, for inputs without a header, a 1-based column
+// index. The header is detected automatically when the first record holds
+// any of the mapped column names.
+func NewCSVReader(r io.Reader, comma rune, columns map[string]string) IdentifierReader {
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.ReuseRecord = true
+
+	return &csvReader{reader: reader, columns: columns}
+}
+
+// init reads the first record to detect the header and resolve the
+// mapped columns to their indexes.
+func (c *csvReader) init() error {
+	first, err := c.reader.Read()
+	if err != nil {
+		return err
+	}
+
+	header := make(map[string]int, len(first))
+	for i, field := range first {
+		name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(field, "\ufeff")))
+		if _, found := header[name]; !found {
+			header[name] = i
+		}
+	}
+
+	hasHeader := false
+	for column := range c.columns {
+		if _, found := header[strings.ToLower(column)]; found {
+			hasHeader = true
+			break
+		}
+	}
+
+	for column, prefix := range c.columns {
+		if i, found := header[strings.ToLower(column)]; hasHeader && found {
+			c.mapped = append(c.mapped, columnPrefix{index: i, prefix: prefix})
+			continue
+		}
+
+		i, err := strconv.Atoi(column)
+		if err != nil || i < 1 {
+			return fmt.Errorf("column %s not found in header", column)
+		}
+		c.mapped = append(c.mapped, columnPrefix{index: i - 1, prefix: prefix})
+	}
+	sort.Slice(c.mapped, func(i, j int) bool {
+		return c.mapped[i].index < c.mapped[j].index
+	})
+
+	if !hasHeader {
+		c.pending = append([]string(nil), first...)
+	}
+	c.initialized = true
+	return nil
+}
+
+func (c *csvReader) Read() ([]string, error) {
+	if !c.initialized {
+		if err := c.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	record := c.pending
+	c.pending = nil
+	if record == nil {
+		var err error
+		record, err = c.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	identifiers := make([]string, 0, len(c.mapped))
+	for _, column := range c.mapped {
+		if column.index >= len(record) {
+			continue
+		}
+		value := strings.TrimSpace(record[column.index])
+		if value == "" {
+			continue
+		}
+		identifiers = append(identifiers, column.prefix+value)
+	}
+	return identifiers, nil
+}
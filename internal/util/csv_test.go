@@ -0,0 +1,84 @@
+package util
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAllIdentifiers(t *testing.T, ir IdentifierReader) [][]string {
+	t.Helper()
+
+	var records [][]string
+	for {
+		identifiers, err := ir.Read()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("failed to read identifiers: %s", err)
+		}
+		records = append(records, identifiers)
+	}
+}
+
+func TestParseColumnMapping(t *testing.T) {
+	columns, err := ParseColumnMapping([]string{"email_sha256=e", "phone=p:", "maid = a"})
+	if err != nil {
+		t.Fatalf("failed to parse column mapping: %s", err)
+	}
+
+	want := map[string]string{"email_sha256": "e:", "phone": "p:", "maid": "a:"}
+	if !reflect.DeepEqual(columns, want) {
+		t.Fatalf("want %v, got %v", want, columns)
+	}
+
+	for _, invalid := range []string{"email", "=e", "email=x", "email=e:extra"} {
+		if _, err := ParseColumnMapping([]string{invalid}); err == nil {
+			t.Fatalf("want error parsing %q", invalid)
+		}
+	}
+}
+
+func TestCSVReaderWithHeader(t *testing.T) {
+	input := "id,Email_SHA256,phone,maid\n" +
+		"1,aaa,18055554321,\n" +
+		"2,,,214as2d4asasdasd\n" +
+		"3, bbb ,12125551122,5a4d35a4d35as4d3a\n"
+
+	columns := map[string]string{"email_sha256": "e:", "phone": "p:", "maid": "a:"}
+	records := readAllIdentifiers(t, NewCSVReader(strings.NewReader(input), ',', columns))
+
+	want := [][]string{
+		{"e:aaa", "p:18055554321"},
+		{"a:214as2d4asasdasd"},
+		{"e:bbb", "p:12125551122", "a:5a4d35a4d35as4d3a"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("want %v, got %v", want, records)
+	}
+}
+
+func TestCSVReaderWithoutHeader(t *testing.T) {
+	input := "aaa\t18055554321\nbbb\t12125551122\n"
+
+	columns := map[string]string{"1": "e:", "2": "p:"}
+	records := readAllIdentifiers(t, NewCSVReader(strings.NewReader(input), '\t', columns))
+
+	want := [][]string{
+		{"e:aaa", "p:18055554321"},
+		{"e:bbb", "p:12125551122"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("want %v, got %v", want, records)
+	}
+}
+
+func TestCSVReaderMissingColumn(t *testing.T) {
+	columns := map[string]string{"email_sha256": "e:", "phone": "p:"}
+	reader := NewCSVReader(strings.NewReader("email_sha256,mobile\naaa,1\n"), ',', columns)
+	if _, err := reader.Read(); err == nil {
+		t.Fatal("want error for column missing from header")
+	}
+}
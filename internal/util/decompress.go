@@ -0,0 +1,49 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+)
+
+// NewDecompressReader detects gzip, zstd and bzip2 compressed streams by
+// their magic bytes and returns a reader that decompresses them on the fly.
+// Uncompressed streams are returned as is.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip stream: %w", err)
+		}
+		return gr, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd stream: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, bzip2Magic) && len(magic) > len(bzip2Magic) && magic[3] >= '1' && magic[3] <= '9':
+		// the magic is followed by the block size, from 1 to 9
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
@@ -0,0 +1,405 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	v1 "github.com/optable/match-api/match/v1"
+)
+
+const (
+	// mergeFanIn is the maximum number of spill files merged at once,
+	// which bounds the number of open file descriptors while merging.
+	mergeFanIn = 64
+	// identifierOverhead approximates the memory used by the slice header
+	// holding each buffered identifier.
+	identifierOverhead = 24
+)
+
+// UniqueIdentifiers deduplicates identifiers read from one or more inputs
+// while keeping memory usage under a configurable ceiling. Identifiers are
+// buffered in memory and, once the ceiling is reached, sorted and spilled
+// to disk. The spilled runs are merged back when the identifiers are
+// streamed out, so the full set never needs to fit in memory.
+type UniqueIdentifiers struct {
+	memoryLimit int64
+	dir         string
+
+	buffer     [][]byte
+	bufferSize int64
+	runs       []string
+
+	finalized   bool
+	count       int64
+	insights    *v1.Insights
+	fingerprint string
+}
+
+// NewUniqueIdentifiers creates an empty set of unique identifiers that
+// spills to a temporary directory created in tempDir when more than
+// memoryLimit bytes of identifiers are buffered. An empty tempDir uses
+// the default directory for temporary files.
+func NewUniqueIdentifiers(memoryLimit int64, tempDir string) (*UniqueIdentifiers, error) {
+	if memoryLimit <= 0 {
+		return nil, fmt.Errorf("invalid memory limit %d", memoryLimit)
+	}
+
+	dir, err := os.MkdirTemp(tempDir, "match-cli-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+
+	return &UniqueIdentifiers{memoryLimit: memoryLimit, dir: dir, insights: &v1.Insights{}}, nil
+}
+
+// Add reads line-separated identifiers from r, which may be compressed,
+// and returns the number of valid identifiers read, duplicates included.
+func (u *UniqueIdentifiers) Add(r io.Reader) (int64, error) {
+	dr, err := NewDecompressReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+
+	return u.AddFrom(NewTextReader(dr))
+}
+
+// AddFrom reads all the records of ir and returns the number of valid
+// identifiers read, duplicates included.
+func (u *UniqueIdentifiers) AddFrom(ir IdentifierReader) (int64, error) {
+	if u.finalized {
+		return 0, fmt.Errorf("cannot add identifiers to a finalized set")
+	}
+
+	var n int64
+	for {
+		identifiers, err := ir.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		for _, identifier := range identifiers {
+			if !hasValidPrefix(identifier) {
+				continue
+			}
+			if err := u.add([]byte(identifier)); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+func (u *UniqueIdentifiers) add(identifier []byte) error {
+	u.buffer = append(u.buffer, identifier)
+	u.bufferSize += int64(len(identifier)) + identifierOverhead
+	if u.bufferSize >= u.memoryLimit {
+		return u.spill()
+	}
+	return nil
+}
+
+// sortBuffer sorts the buffered identifiers and removes duplicates in place.
+func (u *UniqueIdentifiers) sortBuffer() {
+	sort.Slice(u.buffer, func(i, j int) bool {
+		return bytes.Compare(u.buffer[i], u.buffer[j]) < 0
+	})
+
+	unique := u.buffer[:0]
+	for i, identifier := range u.buffer {
+		if i > 0 && bytes.Equal(identifier, unique[len(unique)-1]) {
+			continue
+		}
+		unique = append(unique, identifier)
+	}
+	u.buffer = unique
+}
+
+// spill writes the sorted and deduplicated buffer to a new run file.
+func (u *UniqueIdentifiers) spill() error {
+	u.sortBuffer()
+
+	file, err := os.CreateTemp(u.dir, "run-")
+	if err != nil {
+		return fmt.Errorf("failed to create spill file: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, identifier := range u.buffer {
+		if _, err := w.Write(identifier); err != nil {
+			return fmt.Errorf("failed to write spill file %s: %w", file.Name(), err)
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return fmt.Errorf("failed to write spill file %s: %w", file.Name(), err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write spill file %s: %w", file.Name(), err)
+	}
+
+	u.runs = append(u.runs, file.Name())
+	u.buffer = nil
+	u.bufferSize = 0
+	return file.Close()
+}
+
+// Finalize ends the loading phase and computes the exact number of unique
+// identifiers, their insights and their fingerprint. Spilled runs are compacted so that
+// streaming them back never opens more than mergeFanIn files at once.
+func (u *UniqueIdentifiers) Finalize() error {
+	if u.finalized {
+		return nil
+	}
+
+	if len(u.runs) > 0 && len(u.buffer) > 0 {
+		if err := u.spill(); err != nil {
+			return err
+		}
+	} else {
+		u.sortBuffer()
+	}
+
+	for len(u.runs) > mergeFanIn {
+		var compacted []string
+		for i := 0; i < len(u.runs); i += mergeFanIn {
+			end := i + mergeFanIn
+			if end > len(u.runs) {
+				end = len(u.runs)
+			}
+			run, err := u.compact(u.runs[i:end])
+			if err != nil {
+				return err
+			}
+			compacted = append(compacted, run)
+		}
+		u.runs = compacted
+	}
+
+	hash := sha256.New()
+	err := u.each(context.Background(), func(identifier []byte) error {
+		u.count++
+		addInsight(u.insights, string(identifier))
+		hash.Write(identifier)
+		hash.Write([]byte{'\n'})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.fingerprint = hex.EncodeToString(hash.Sum(nil))
+
+	u.finalized = true
+	return nil
+}
+
+// compact merges runs into a single new run file and removes them.
+func (u *UniqueIdentifiers) compact(runs []string) (string, error) {
+	file, err := os.CreateTemp(u.dir, "run-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create spill file: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	err = merge(context.Background(), runs, func(identifier []byte) error {
+		if _, err := w.Write(identifier); err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to merge spill files: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write spill file %s: %w", file.Name(), err)
+	}
+
+	for _, run := range runs {
+		if err := os.Remove(run); err != nil {
+			return "", fmt.Errorf("failed to remove spill file %s: %w", run, err)
+		}
+	}
+	return file.Name(), file.Close()
+}
+
+// each calls fn on every unique identifier in sorted order.
+func (u *UniqueIdentifiers) each(ctx context.Context, fn func([]byte) error) error {
+	if len(u.runs) == 0 {
+		for _, identifier := range u.buffer {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(identifier); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return merge(ctx, u.runs, fn)
+}
+
+// Len returns the number of unique identifiers. It is only valid once
+// the set is finalized.
+func (u *UniqueIdentifiers) Len() int64 {
+	return u.count
+}
+
+// Insights returns the per identifier type breakdown of the unique
+// identifiers. It is only valid once the set is finalized.
+func (u *UniqueIdentifiers) Insights() *v1.Insights {
+	return u.insights
+}
+
+// Fingerprint returns the hex SHA-256 of the sorted unique identifiers,
+// each followed by a newline, which identifies them regardless of their
+// order, duplicates and files. It is only valid once the set is finalized.
+func (u *UniqueIdentifiers) Fingerprint() string {
+	return u.fingerprint
+}
+
+// Stream calls fn with a channel streaming the unique identifiers, closed
+// once they are all sent. When reading the spill files fails, the channel
+// is closed early and the context of fn is cancelled, so that fn never
+// acts on a partial stream, and the error is returned instead of the one
+// of fn. The identifiers are no longer read once Stream returns, even when fn
+// returns before reading them all, so that the set can then be closed.
+func (u *UniqueIdentifiers) Stream(ctx context.Context, fn func(ctx context.Context, identifiers <-chan []byte) error) error {
+	if !u.finalized {
+		return fmt.Errorf("unique identifiers must be finalized before being streamed")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	identifiers := make(chan []byte)
+	streamErr := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(identifiers)
+		err := u.each(ctx, func(identifier []byte) error {
+			select {
+			case identifiers <- append([]byte(nil), identifier...):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			streamErr <- err
+			cancel()
+		}
+	}()
+
+	err := fn(ctx, identifiers)
+	cancel()
+	<-done
+	select {
+	case err := <-streamErr:
+		return fmt.Errorf("failed to stream identifiers: %w", err)
+	default:
+		return err
+	}
+}
+
+// Close removes any spill file written to disk.
+func (u *UniqueIdentifiers) Close() error {
+	u.buffer = nil
+	return os.RemoveAll(u.dir)
+}
+
+// hasValidPrefix reports whether identifier has the prefix of a known
+// identifier type.
+func hasValidPrefix(identifier string) bool {
+	t, _ := IdentifierTypes.Lookup(identifier)
+	return t != nil
+}
+
+// runReader reads the sorted identifiers of a single spill file.
+type runReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	current []byte
+}
+
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return bytes.Compare(h[i].current, h[j].current) < 0 }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// merge does a k-way merge of sorted run files and calls fn once on
+// each distinct identifier in sorted order.
+func merge(ctx context.Context, runs []string, fn func([]byte) error) error {
+	h := make(runHeap, 0, len(runs))
+	defer func() {
+		for _, r := range h {
+			r.file.Close()
+		}
+	}()
+
+	for _, run := range runs {
+		file, err := os.Open(filepath.Clean(run))
+		if err != nil {
+			return fmt.Errorf("failed to open spill file %s: %w", run, err)
+		}
+		r := &runReader{file: file, scanner: bufio.NewScanner(file)}
+		if !r.scanner.Scan() {
+			file.Close()
+			if err := r.scanner.Err(); err != nil {
+				return fmt.Errorf("failed to read spill file %s: %w", run, err)
+			}
+			continue
+		}
+		r.current = r.scanner.Bytes()
+		h = append(h, r)
+	}
+	heap.Init(&h)
+
+	var last []byte
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r := h[0]
+		if last == nil || !bytes.Equal(last, r.current) {
+			last = append(last[:0], r.current...)
+			if err := fn(last); err != nil {
+				return err
+			}
+		}
+
+		if r.scanner.Scan() {
+			r.current = r.scanner.Bytes()
+			heap.Fix(&h, 0)
+			continue
+		}
+		if err := r.scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read spill file %s: %w", r.file.Name(), err)
+		}
+		r.file.Close()
+		heap.Pop(&h)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUniqueIdentifiersInMemory(t *testing.T) {
+	uniqueIdentifiers, err := NewUniqueIdentifiers(1<<20, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create unique identifiers: %s", err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	n, err := uniqueIdentifiers.Add(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to add identifiers: %s", err)
+	}
+	if n != 20 {
+		t.Fatalf("want 20 valid identifiers read, got %d", n)
+	}
+
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatalf("failed to finalize unique identifiers: %s", err)
+	}
+	if len(uniqueIdentifiers.runs) != 0 {
+		t.Fatalf("want no spill files, got %d", len(uniqueIdentifiers.runs))
+	}
+
+	assertUniqueIdentifiers(t, uniqueIdentifiers, inputMap)
+
+	streamed := make(map[string]bool)
+	err = uniqueIdentifiers.Stream(context.Background(), func(ctx context.Context, records <-chan []byte) error {
+		for identifier := range records {
+			if _, found := inputMap[string(identifier)]; !found {
+				return fmt.Errorf("unexpected identifier %s", identifier)
+			}
+			streamed[string(identifier)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream identifiers: %s", err)
+	}
+	if _, found := streamed["invalidIdentifier"]; found {
+		t.Fatal("want invalid identifiers to be dropped")
+	}
+	if len(streamed) != 18 {
+		t.Fatalf("want 18 unique identifiers streamed, got %d", len(streamed))
+	}
+}
+
+func TestUniqueIdentifiersSpill(t *testing.T) {
+	// a tiny memory limit spills every few identifiers, producing more
+	// runs than can be merged at once.
+	uniqueIdentifiers, err := NewUniqueIdentifiers(256, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create unique identifiers: %s", err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	want := make(map[string]bool)
+	var sb strings.Builder
+	for i := 0; i < 5000; i++ {
+		identifier := fmt.Sprintf("e:%064d", i%1234)
+		want[identifier] = true
+		sb.WriteString(identifier + "\n")
+	}
+	sb.WriteString("invalidIdentifier\n")
+
+	if _, err := uniqueIdentifiers.Add(strings.NewReader(sb.String())); err != nil {
+		t.Fatalf("failed to add identifiers: %s", err)
+	}
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatalf("failed to finalize unique identifiers: %s", err)
+	}
+	if len(uniqueIdentifiers.runs) == 0 || len(uniqueIdentifiers.runs) > mergeFanIn {
+		t.Fatalf("want between 1 and %d spill files, got %d", mergeFanIn, len(uniqueIdentifiers.runs))
+	}
+
+	assertUniqueIdentifiers(t, uniqueIdentifiers, want)
+}
+
+func assertUniqueIdentifiers(t *testing.T, uniqueIdentifiers *UniqueIdentifiers, want map[string]bool) {
+	t.Helper()
+
+	if uniqueIdentifiers.Len() != int64(len(want)) {
+		t.Fatalf("want %d unique identifiers, got %d", len(want), uniqueIdentifiers.Len())
+	}
+
+	sorted := make([]string, 0, len(want))
+	for identifier := range want {
+		sorted = append(sorted, identifier+"\n")
+	}
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "")))
+	if fingerprint := hex.EncodeToString(sum[:]); uniqueIdentifiers.Fingerprint() != fingerprint {
+		t.Fatalf("want fingerprint %s, got %s", fingerprint, uniqueIdentifiers.Fingerprint())
+	}
+
+	if insights := uniqueIdentifiers.Insights(); insights.Emails != insightsOf(want).Emails {
+		t.Fatalf("want %d emails in insights, got %d", insightsOf(want).Emails, insights.Emails)
+	}
+
+	seen := make(map[string]bool)
+	err := uniqueIdentifiers.Stream(context.Background(), func(ctx context.Context, records <-chan []byte) error {
+		for identifier := range records {
+			if !want[string(identifier)] {
+				return fmt.Errorf("unexpected identifier %s", identifier)
+			}
+			if seen[string(identifier)] {
+				return fmt.Errorf("duplicate identifier %s", identifier)
+			}
+			seen[string(identifier)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream identifiers: %s", err)
+	}
+
+	if len(seen) != len(want) {
+		t.Fatalf("want %d identifiers streamed, got %d", len(want), len(seen))
+	}
+}
+
+func TestUniqueIdentifiersStreamError(t *testing.T) {
+	uniqueIdentifiers, err := NewUniqueIdentifiers(256, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create unique identifiers: %s", err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	var sb strings.Builder
+	for i := 0; i < 100; i++ {
+		sb.WriteString(fmt.Sprintf("e:%064d\n", i))
+	}
+	if _, err := uniqueIdentifiers.Add(strings.NewReader(sb.String())); err != nil {
+		t.Fatalf("failed to add identifiers: %s", err)
+	}
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatalf("failed to finalize unique identifiers: %s", err)
+	}
+	if err := os.Remove(uniqueIdentifiers.runs[len(uniqueIdentifiers.runs)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	var streamed int64
+	cancelled := false
+	err = uniqueIdentifiers.Stream(context.Background(), func(ctx context.Context, records <-chan []byte) error {
+		for range records {
+			streamed++
+		}
+		cancelled = ctx.Err() != nil
+		return nil
+	})
+	if err == nil || !cancelled {
+		t.Fatalf("want a failed stream to cancel its consumer and return an error, got %v after %d identifiers", err, streamed)
+	}
+}
+
+func TestUniqueIdentifiersStreamStopped(t *testing.T) {
+	uniqueIdentifiers, err := NewUniqueIdentifiers(256, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create unique identifiers: %s", err)
+	}
+
+	var sb strings.Builder
+	for i := 0; i < 100; i++ {
+		sb.WriteString(fmt.Sprintf("e:%064d\n", i))
+	}
+	if _, err := uniqueIdentifiers.Add(strings.NewReader(sb.String())); err != nil {
+		t.Fatalf("failed to add identifiers: %s", err)
+	}
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatalf("failed to finalize unique identifiers: %s", err)
+	}
+
+	// a consumer stopping early leaves no identifier being read
+	var records <-chan []byte
+	err = uniqueIdentifiers.Stream(context.Background(), func(ctx context.Context, identifiers <-chan []byte) error {
+		records = identifiers
+		<-identifiers
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream identifiers: %s", err)
+	}
+	select {
+	case identifier, ok := <-records:
+		if ok {
+			t.Fatalf("want the stream to be stopped once Stream returns, got %s", identifier)
+		}
+	default:
+		t.Fatal("want the stream to be closed once Stream returns")
+	}
+	if err := uniqueIdentifiers.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	minHyperLogLogPrecision = 4
+	maxHyperLogLogPrecision = 18
+
+	// DefaultHyperLogLogPrecision uses 16KiB of registers for a standard
+	// error of about 0.8%.
+	DefaultHyperLogLogPrecision = 14
+)
+
+// HyperLogLog estimates the number of distinct values added to it using a
+// fixed amount of memory, regardless of the number of values.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog creates a HyperLogLog sketch with 2^precision registers.
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < minHyperLogLogPrecision || precision > maxHyperLogLogPrecision {
+		return nil, fmt.Errorf("HyperLogLog precision must be between %d and %d", minHyperLogLogPrecision, maxHyperLogLogPrecision)
+	}
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Add adds value to the sketch.
+func (h *HyperLogLog) Add(value []byte) {
+	x := hash64(value)
+	index := x >> (64 - h.precision)
+	// the guard bit bounds the rank when the remaining bits are all zeros
+	w := x<<h.precision | 1<<(h.precision-1)
+	rank := uint8(bits.LeadingZeros64(w)) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Estimate returns the estimated number of distinct values added.
+func (h *HyperLogLog) Estimate() int64 {
+	m := float64(len(h.registers))
+
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// hash64 hashes value with FNV-1a followed by the murmur3 finalizer, which
+// spreads FNV's weak high bits used to select registers.
+func hash64(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		h, err := NewHyperLogLog(DefaultHyperLogLogPrecision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every value is added twice, duplicates must not count
+		for i := 0; i < 2*n; i++ {
+			h.Add([]byte("e:" + strconv.Itoa(i%n+1)))
+		}
+
+		estimate := h.Estimate()
+		if n == 0 {
+			if estimate != 0 {
+				t.Fatalf("want an estimate of 0, got %d", estimate)
+			}
+			continue
+		}
+		if relative := math.Abs(float64(estimate-int64(n))) / float64(n); relative > 0.03 {
+			t.Fatalf("estimate %d for %d values is off by %.2f%%", estimate, n, relative*100)
+		}
+	}
+}
+
+func TestNewHyperLogLogPrecision(t *testing.T) {
+	for _, precision := range []uint8{0, 3, 19} {
+		if _, err := NewHyperLogLog(precision); err == nil {
+			t.Fatalf("want an error for precision %d", precision)
+		}
+	}
+}
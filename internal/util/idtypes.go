@@ -0,0 +1,221 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "github.com/optable/match-api/match/v1"
+)
+
+// IdentifierType is a type of matchable identifier.
+type IdentifierType struct {
+	// Name is the JSON name of the Insights field counting the type.
+	Name string
+	// Prefix is the prefix of identifiers of the type, such as e: for emails.
+	Prefix string
+	// Kind is the kind of the type in the match API.
+	Kind v1.IdKind
+
+	counter  func(*v1.Insights) *int64
+	validate identifierValidator
+}
+
+// Counter returns the Insights field counting identifiers of the type.
+func (t *IdentifierType) Counter(insights *v1.Insights) *int64 {
+	return t.counter(insights)
+}
+
+// Validate returns the reason why value, an identifier of the type without
+// its prefix, is invalid, or nil when it is valid.
+func (t *IdentifierType) Validate(value string) error {
+	return t.validate(value)
+}
+
+// Registry maps identifier types by prefix, kind and name.
+type Registry struct {
+	types    []*IdentifierType
+	prefixes []*IdentifierType
+	kinds    map[v1.IdKind]*IdentifierType
+	names    map[string]*IdentifierType
+}
+
+// NewRegistry creates a registry of the identifier types, which must have
+// distinct names, prefixes and kinds.
+func NewRegistry(types ...*IdentifierType) (*Registry, error) {
+	r := &Registry{
+		kinds: make(map[v1.IdKind]*IdentifierType, len(types)),
+		names: make(map[string]*IdentifierType, len(types)),
+	}
+
+	prefixes := make(map[string]bool, len(types))
+	for _, t := range types {
+		switch {
+		case t.Name == "" || t.Prefix == "" || t.counter == nil || t.validate == nil:
+			return nil, fmt.Errorf("incomplete identifier type %q", t.Name)
+		case t.Kind == v1.IdKind_ID_KIND_UNKNOWN:
+			return nil, fmt.Errorf("identifier type %s has no kind", t.Name)
+		case r.names[t.Name] != nil:
+			return nil, fmt.Errorf("duplicate identifier type name %s", t.Name)
+		case prefixes[t.Prefix]:
+			return nil, fmt.Errorf("duplicate identifier type prefix %s", t.Prefix)
+		case r.kinds[t.Kind] != nil:
+			return nil, fmt.Errorf("duplicate identifier type kind %s", t.Kind)
+		}
+		r.types = append(r.types, t)
+		r.kinds[t.Kind] = t
+		r.names[t.Name] = t
+		prefixes[t.Prefix] = true
+	}
+
+	// longest prefixes first, so that the first match is the longest one
+	r.prefixes = append([]*IdentifierType(nil), r.types...)
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].Prefix) > len(r.prefixes[j].Prefix)
+	})
+	return r, nil
+}
+
+// MustRegistry is like NewRegistry but panics on invalid identifier types.
+func MustRegistry(types ...*IdentifierType) *Registry {
+	r, err := NewRegistry(types...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Types returns the identifier types of the registry, in registration order.
+func (r *Registry) Types() []*IdentifierType {
+	return r.types
+}
+
+// Lookup returns the identifier type with the longest prefix of identifier
+// and the identifier value without that prefix, or nil when no type matches.
+func (r *Registry) Lookup(identifier string) (*IdentifierType, string) {
+	for _, t := range r.prefixes {
+		if strings.HasPrefix(identifier, t.Prefix) {
+			return t, identifier[len(t.Prefix):]
+		}
+	}
+	return nil, identifier
+}
+
+// ByPrefix returns the identifier type of prefix, or nil.
+func (r *Registry) ByPrefix(prefix string) *IdentifierType {
+	for _, t := range r.types {
+		if t.Prefix == prefix {
+			return t
+		}
+	}
+	return nil
+}
+
+// ByKind returns the identifier type of kind, or nil.
+func (r *Registry) ByKind(kind v1.IdKind) *IdentifierType {
+	return r.kinds[kind]
+}
+
+// ByName returns the identifier type with the given JSON name, or nil.
+func (r *Registry) ByName(name string) *IdentifierType {
+	return r.names[name]
+}
+
+// Resolve returns the identifier type designated by s, either its prefix,
+// with or without the trailing colon, or its JSON name.
+func (r *Registry) Resolve(s string) (*IdentifierType, error) {
+	s = strings.TrimSpace(s)
+	if t := r.names[s]; t != nil {
+		return t, nil
+	}
+	prefix := s
+	if !strings.HasSuffix(prefix, ":") {
+		prefix += ":"
+	}
+	if t := r.ByPrefix(prefix); t != nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown identifier type %q", s)
+}
+
+// Select returns the identifier types in include, or all the types when
+// include is empty, minus the types in exclude, in registration order.
+func (r *Registry) Select(include, exclude []string) ([]*IdentifierType, error) {
+	included := make(map[*IdentifierType]bool)
+	for _, s := range include {
+		t, err := r.Resolve(s)
+		if err != nil {
+			return nil, err
+		}
+		included[t] = true
+	}
+	excluded := make(map[*IdentifierType]bool)
+	for _, s := range exclude {
+		t, err := r.Resolve(s)
+		if err != nil {
+			return nil, err
+		}
+		excluded[t] = true
+	}
+
+	var selected []*IdentifierType
+	for _, t := range r.types {
+		if (len(include) == 0 || included[t]) && !excluded[t] {
+			selected = append(selected, t)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no identifier type selected")
+	}
+	return selected, nil
+}
+
+// IdentifierTypes is the registry of the identifier types supported by the
+// match API. Adding a type only requires adding its entry below.
+var IdentifierTypes = MustRegistry(
+	&IdentifierType{Name: "emails", Prefix: "e:", Kind: v1.IdKind_ID_KIND_EMAIL_HASH, counter: func(i *v1.Insights) *int64 { return &i.Emails }, validate: validateSHA256},
+	&IdentifierType{Name: "phoneNumbers", Prefix: "p:", Kind: v1.IdKind_ID_KIND_PHONE_NUMBER, counter: func(i *v1.Insights) *int64 { return &i.PhoneNumbers }, validate: validatePhoneNumber},
+	&IdentifierType{Name: "ipv4S", Prefix: "i4:", Kind: v1.IdKind_ID_KIND_IPV4, counter: func(i *v1.Insights) *int64 { return &i.Ipv4S }, validate: validateIPv4},
+	&IdentifierType{Name: "ipv6S", Prefix: "i6:", Kind: v1.IdKind_ID_KIND_IPV6, counter: func(i *v1.Insights) *int64 { return &i.Ipv6S }, validate: validateIPv6},
+	&IdentifierType{Name: "appleIdfas", Prefix: "a:", Kind: v1.IdKind_ID_KIND_APPLE_IDFA, counter: func(i *v1.Insights) *int64 { return &i.AppleIdfas }, validate: validateUUID},
+	&IdentifierType{Name: "googleGaids", Prefix: "g:", Kind: v1.IdKind_ID_KIND_GOOGLE_GAID, counter: func(i *v1.Insights) *int64 { return &i.GoogleGaids }, validate: validateUUID},
+	&IdentifierType{Name: "rokuRidas", Prefix: "r:", Kind: v1.IdKind_ID_KIND_ROKU_RIDA, counter: func(i *v1.Insights) *int64 { return &i.RokuRidas }, validate: validateUUID},
+	&IdentifierType{Name: "samsungTifas", Prefix: "s:", Kind: v1.IdKind_ID_KIND_SAMSUNG_TIFA, counter: func(i *v1.Insights) *int64 { return &i.SamsungTifas }, validate: validateUUID},
+	&IdentifierType{Name: "amazonAfais", Prefix: "f:", Kind: v1.IdKind_ID_KIND_AMAZON_AFAI, counter: func(i *v1.Insights) *int64 { return &i.AmazonAfais }, validate: validateUUID},
+	&IdentifierType{Name: "netids", Prefix: "n:", Kind: v1.IdKind_ID_KIND_NETID, counter: func(i *v1.Insights) *int64 { return &i.Netids }, validate: validateToken},
+	&IdentifierType{Name: "postalCodes", Prefix: "z:", Kind: v1.IdKind_ID_KIND_POSTAL_CODE, counter: func(i *v1.Insights) *int64 { return &i.PostalCodes }, validate: validatePostalCode},
+	&IdentifierType{Name: "id5s", Prefix: "id5:", Kind: v1.IdKind_ID_KIND_ID5, counter: func(i *v1.Insights) *int64 { return &i.Id5S }, validate: validateToken},
+	&IdentifierType{Name: "utiqs", Prefix: "utiq:", Kind: v1.IdKind_ID_KIND_UTIQ, counter: func(i *v1.Insights) *int64 { return &i.Utiqs }, validate: validateToken},
+)
+
+// typeFilterReader drops the identifiers of an IdentifierReader whose type
+// is not selected.
+type typeFilterReader struct {
+	IdentifierReader
+	types map[*IdentifierType]bool
+}
+
+// NewTypeFilterReader returns an IdentifierReader that only returns the
+// identifiers of ir of the given types.
+func NewTypeFilterReader(ir IdentifierReader, types []*IdentifierType) IdentifierReader {
+	selected := make(map[*IdentifierType]bool, len(types))
+	for _, t := range types {
+		selected[t] = true
+	}
+	return &typeFilterReader{IdentifierReader: ir, types: selected}
+}
+
+func (f *typeFilterReader) Read() ([]string, error) {
+	identifiers, err := f.IdentifierReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := identifiers[:0]
+	for _, identifier := range identifiers {
+		if t, _ := IdentifierTypes.Lookup(identifier); f.types[t] {
+			kept = append(kept, identifier)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	v1 "github.com/optable/match-api/match/v1"
+)
+
+func TestRegistryLookup(t *testing.T) {
+	for _, tc := range []struct {
+		identifier string
+		name       string
+		value      string
+	}{
+		{"e:hash", "emails", "hash"},
+		{"p:+18055554321", "phoneNumbers", "+18055554321"},
+		{"i4:8.8.8.8", "ipv4S", "8.8.8.8"},
+		{"i6:::1", "ipv6S", "::1"},
+		{"a:idfa", "appleIdfas", "idfa"},
+		{"g:gaid", "googleGaids", "gaid"},
+		{"r:rida", "rokuRidas", "rida"},
+		{"s:tifa", "samsungTifas", "tifa"},
+		{"f:afai", "amazonAfais", "afai"},
+		{"n:netid", "netids", "netid"},
+		{"z:H0H0H0", "postalCodes", "H0H0H0"},
+		{"id5:ID5-abc", "id5s", "ID5-abc"},
+		{"utiq:abc", "utiqs", "abc"},
+		{"invalidIdentifier", "", "invalidIdentifier"},
+		{"E:hash", "", "E:hash"},
+	} {
+		typ, value := IdentifierTypes.Lookup(tc.identifier)
+		name := ""
+		if typ != nil {
+			name = typ.Name
+		}
+		if name != tc.name || value != tc.value {
+			t.Errorf("%s: want type %q and value %q, got %q and %q", tc.identifier, tc.name, tc.value, name, value)
+		}
+	}
+}
+
+func TestRegistryLongestPrefix(t *testing.T) {
+	registry := MustRegistry(
+		&IdentifierType{Name: "ids", Prefix: "id:", Kind: v1.IdKind_ID_KIND_NETID, counter: func(i *v1.Insights) *int64 { return &i.Netids }, validate: validateToken},
+		&IdentifierType{Name: "is", Prefix: "i", Kind: v1.IdKind_ID_KIND_IPV4, counter: func(i *v1.Insights) *int64 { return &i.Ipv4S }, validate: validateToken},
+		&IdentifierType{Name: "id5s", Prefix: "id5:", Kind: v1.IdKind_ID_KIND_ID5, counter: func(i *v1.Insights) *int64 { return &i.Id5S }, validate: validateToken},
+	)
+
+	for identifier, name := range map[string]string{
+		"id5:abc": "id5s",
+		"id:abc":  "ids",
+		"ix":      "is",
+	} {
+		if typ, _ := registry.Lookup(identifier); typ == nil || typ.Name != name {
+			t.Errorf("%s: want type %s, got %+v", identifier, name, typ)
+		}
+	}
+}
+
+func TestRegistryMappings(t *testing.T) {
+	var insights v1.Insights
+	for _, typ := range IdentifierTypes.Types() {
+		if IdentifierTypes.ByKind(typ.Kind) != typ || IdentifierTypes.ByName(typ.Name) != typ || IdentifierTypes.ByPrefix(typ.Prefix) != typ {
+			t.Errorf("%s: inconsistent registry mappings", typ.Name)
+		}
+
+		addInsight(&insights, typ.Prefix+"value")
+		if *typ.Counter(&insights) != 1 {
+			t.Errorf("%s: want insight counter of 1, got %d", typ.Name, *typ.Counter(&insights))
+		}
+	}
+
+	// every matchable kind of the match API has a registered type
+	for kind := range v1.IdKind_name {
+		if v1.IdKind(kind) != v1.IdKind_ID_KIND_UNKNOWN && IdentifierTypes.ByKind(v1.IdKind(kind)) == nil {
+			t.Errorf("identifier kind %s is not registered", v1.IdKind(kind))
+		}
+	}
+}
+
+func TestNewRegistryDuplicates(t *testing.T) {
+	emails := IdentifierTypes.ByName("emails")
+	for _, tc := range []struct {
+		name  string
+		types []*IdentifierType
+	}{
+		{"name", []*IdentifierType{emails, {Name: "emails", Prefix: "x:", Kind: v1.IdKind_ID_KIND_NETID, counter: emails.counter, validate: emails.validate}}},
+		{"prefix", []*IdentifierType{emails, {Name: "x", Prefix: "e:", Kind: v1.IdKind_ID_KIND_NETID, counter: emails.counter, validate: emails.validate}}},
+		{"kind", []*IdentifierType{emails, {Name: "x", Prefix: "x:", Kind: emails.Kind, counter: emails.counter, validate: emails.validate}}},
+		{"incomplete", []*IdentifierType{{Name: "x", Prefix: "x:", Kind: v1.IdKind_ID_KIND_NETID}}},
+	} {
+		if _, err := NewRegistry(tc.types...); err == nil {
+			t.Errorf("%s: want an error", tc.name)
+		}
+	}
+}
+
+func TestRegistrySelect(t *testing.T) {
+	for _, tc := range []struct {
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{nil, nil, []string{"emails", "phoneNumbers", "ipv4S", "ipv6S", "appleIdfas", "googleGaids", "rokuRidas", "samsungTifas", "amazonAfais", "netids", "postalCodes", "id5s", "utiqs"}},
+		{[]string{"g", "e:", "appleIdfas"}, nil, []string{"emails", "appleIdfas", "googleGaids"}},
+		{[]string{"e", "a", "g"}, []string{"g"}, []string{"emails", "appleIdfas"}},
+		{nil, []string{"i4", "i6", "z", "n", "id5", "utiq", "p", "r", "s", "f"}, []string{"emails", "appleIdfas", "googleGaids"}},
+	} {
+		types, err := IdentifierTypes.Select(tc.include, tc.exclude)
+		if err != nil {
+			t.Fatalf("%v - %v: %s", tc.include, tc.exclude, err)
+		}
+		var names []string
+		for _, typ := range types {
+			names = append(names, typ.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%v - %v: want %v, got %v", tc.include, tc.exclude, tc.want, names)
+		}
+	}
+
+	if _, err := IdentifierTypes.Select([]string{"x"}, nil); err == nil {
+		t.Error("want an error for an unknown identifier type")
+	}
+	if _, err := IdentifierTypes.Select([]string{"e"}, []string{"emails"}); err == nil {
+		t.Error("want an error when no identifier type is selected")
+	}
+}
+
+func TestTypeFilterReader(t *testing.T) {
+	types, err := IdentifierTypes.Select([]string{"e", "g"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uniqueIdentifiers, err := NewUniqueIdentifiers(1<<20, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	if _, err := uniqueIdentifiers.AddFrom(NewTypeFilterReader(NewTextReader(strings.NewReader(input)), types)); err != nil {
+		t.Fatal(err)
+	}
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	insights := uniqueIdentifiers.Insights()
+	if uniqueIdentifiers.Len() != 5 || insights.Emails != 3 || insights.GoogleGaids != 2 || insights.PhoneNumbers != 0 {
+		t.Fatalf("want 3 emails and 2 GAIDs only, got %d identifiers and insights %v", uniqueIdentifiers.Len(), insights)
+	}
+}
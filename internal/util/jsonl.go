@@ -0,0 +1,96 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type fieldPrefix struct {
+	path   []string
+	prefix string
+}
+
+// jsonLinesReader reads identifiers from the mapped fields of newline
+// delimited JSON records.
+type jsonLinesReader struct {
+	decoder *json.Decoder
+	fields  []fieldPrefix
+	record  int
+}
+
+// NewJSONLinesReader returns an IdentifierReader over newline delimited JSON
+// objects. fields maps dotted field paths, such as user.email, to the
+// identifier type prefix of their values. A field holding an array yields
+// one identifier per element.
+func NewJSONLinesReader(r io.Reader, fields map[string]string) IdentifierReader {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	mapped := make([]fieldPrefix, 0, len(fields))
+	for field, prefix := range fields {
+		mapped = append(mapped, fieldPrefix{path: strings.Split(field, "."), prefix: prefix})
+	}
+	sort.Slice(mapped, func(i, j int) bool {
+		return strings.Join(mapped[i].path, ".") < strings.Join(mapped[j].path, ".")
+	})
+
+	return &jsonLinesReader{decoder: decoder, fields: mapped}
+}
+
+func (j *jsonLinesReader) Read() ([]string, error) {
+	var record map[string]interface{}
+	if err := j.decoder.Decode(&record); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to decode JSON record %d: %w", j.record+1, err)
+	}
+	j.record++
+
+	var identifiers []string
+	for _, field := range j.fields {
+		for _, value := range jsonValues(lookupField(record, field.path)) {
+			identifiers = append(identifiers, field.prefix+value)
+		}
+	}
+	return identifiers, nil
+}
+
+// lookupField returns the value at the given path of nested objects, or
+// nil when any part of the path is missing.
+func lookupField(record map[string]interface{}, path []string) interface{} {
+	var value interface{} = record
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// jsonValues returns the non-empty scalar values of a JSON value as strings.
+func jsonValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if s := strings.TrimSpace(v); s != "" {
+			return []string{s}
+		}
+	case json.Number:
+		return []string{v.String()}
+	case []interface{}:
+		var values []string
+		for _, element := range v {
+			if _, nested := element.([]interface{}); nested {
+				continue
+			}
+			values = append(values, jsonValues(element)...)
+		}
+		return values
+	}
+	return nil
+}
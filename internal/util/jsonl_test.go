@@ -0,0 +1,37 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONLinesReader(t *testing.T) {
+	input := `{"user": {"email": "aaa", "phones": ["18055554321", 12125551122]}, "maid": "214as2d4asasdasd"}
+{"user": {"email": ""}, "maid": null}
+
+{"user": "not an object", "maid": "5a4d35a4d35as4d3a"}
+`
+
+	fields := map[string]string{"user.email": "e:", "user.phones": "p:", "maid": "a:"}
+	records := readAllIdentifiers(t, NewJSONLinesReader(strings.NewReader(input), fields))
+
+	want := [][]string{
+		{"a:214as2d4asasdasd", "e:aaa", "p:18055554321", "p:12125551122"},
+		nil,
+		{"a:5a4d35a4d35as4d3a"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("want %v, got %v", want, records)
+	}
+}
+
+func TestJSONLinesReaderInvalidRecord(t *testing.T) {
+	reader := NewJSONLinesReader(strings.NewReader("{\"maid\": \"a\"}\n[1, 2]\n"), map[string]string{"maid": "a:"})
+	if _, err := reader.Read(); err != nil {
+		t.Fatalf("failed to read first record: %s", err)
+	}
+	if _, err := reader.Read(); err == nil {
+		t.Fatal("want error decoding a record that is not an object")
+	}
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "github.com/optable/match-api/match/v1"
+
+	"github.com/ttacon/libphonenumber"
+)
+
+// ValidRegion reports whether region is supported as the default region of
+// phone numbers.
+func ValidRegion(region string) bool {
+	_, found := libphonenumber.GetSupportedRegions()[strings.ToUpper(region)]
+	return found
+}
+
+// NormalizeIdentifier applies the canonical normalization of the identifier
+// type: emails are trimmed, lower-cased and SHA-256 hashed unless already
+// hashed, phone numbers are formatted as E.164 digits without the leading +,
+// using region as the default region of national numbers, and SHA-256
+// hashed unless already hashed, and IP addresses are put in canonical form.
+// Other identifier types are trimmed.
+func NormalizeIdentifier(identifier, region string) (string, error) {
+	t, value := IdentifierTypes.Lookup(identifier)
+	if t == nil {
+		return "", fmt.Errorf("unknown identifier type")
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("empty identifier")
+	}
+
+	var err error
+	switch t.Kind {
+	case v1.IdKind_ID_KIND_EMAIL_HASH:
+		value, err = normalizeEmail(value)
+	case v1.IdKind_ID_KIND_PHONE_NUMBER:
+		value, err = normalizePhoneNumber(value, region)
+	case v1.IdKind_ID_KIND_IPV4:
+		value, err = normalizeIP(value, false)
+	case v1.IdKind_ID_KIND_IPV6:
+		value, err = normalizeIP(value, true)
+	}
+	if err != nil {
+		return "", err
+	}
+	return t.Prefix + value, nil
+}
+
+func isSHA256Hex(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(email)
+	if isSHA256Hex(email) {
+		return email, nil
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 || strings.ContainsAny(email, " \t") {
+		return "", fmt.Errorf("invalid email address")
+	}
+
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// normalizePhoneNumber parses a phone number with libphonenumber, which
+// knows the calling code, trunk prefix and international call prefix of
+// every region, and hashes its E.164 form without the +, which is the form
+// of the phone numbers of match files, such as 18055554321.
+func normalizePhoneNumber(phone, region string) (string, error) {
+	if isSHA256Hex(strings.ToLower(phone)) {
+		return strings.ToLower(phone), nil
+	}
+
+	number, err := libphonenumber.Parse(phone, strings.ToUpper(region))
+	if err != nil || !libphonenumber.IsValidNumber(number) {
+		return "", fmt.Errorf("invalid phone number")
+	}
+	e164 := strings.TrimPrefix(libphonenumber.Format(number, libphonenumber.E164), "+")
+
+	sum := sha256.Sum256([]byte(e164))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func normalizeIP(value string, v6 bool) (string, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address")
+	}
+
+	if v4 := ip.To4(); v4 != nil && !strings.Contains(value, ":") {
+		if v6 {
+			return "", fmt.Errorf("invalid IPv6 address")
+		}
+		return v4.String(), nil
+	}
+	if !v6 {
+		return "", fmt.Errorf("invalid IPv4 address")
+	}
+	return ip.String(), nil
+}
+
+// normalizingReader normalizes the identifiers of an IdentifierReader and
+// drops the ones that cannot be normalized.
+type normalizingReader struct {
+	IdentifierReader
+	region string
+	report *ValidationReport
+	file   string
+	record int64
+}
+
+// NewNormalizingReader returns an IdentifierReader that normalizes raw
+// identifiers read from ir with NormalizeIdentifier. Identifiers that
+// cannot be normalized are dropped, and rejected in report when not nil,
+// located like NewValidatingReader does.
+func NewNormalizingReader(ir IdentifierReader, region string, report *ValidationReport, file string) IdentifierReader {
+	return &normalizingReader{IdentifierReader: ir, region: region, report: report, file: file}
+}
+
+func (n *normalizingReader) Read() ([]string, error) {
+	identifiers, err := n.IdentifierReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	n.record++
+
+	normalized := identifiers[:0]
+	for _, identifier := range identifiers {
+		if strings.TrimSpace(identifier) == "" {
+			continue
+		}
+		value, err := NormalizeIdentifier(identifier, n.region)
+		if err != nil {
+			if n.report != nil {
+				name := unknownType
+				if t, _ := IdentifierTypes.Lookup(identifier); t != nil {
+					name = t.Name
+				}
+				n.report.reject(name, fmt.Errorf("cannot be normalized: %w", err), n.file, n.record)
+			}
+			continue
+		}
+		normalized = append(normalized, value)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeIdentifier(t *testing.T) {
+	for _, tc := range []struct {
+		identifier string
+		region     string
+		want       string
+	}{
+		// sha256("test@example.com")
+		{"e: Test@Example.COM ", "US", "e:973dfe463ec85785f5f95af5ba3906eedb2d931c24e69824a89ea65dba4e813b"},
+		{"e:920D0B248F5EEA3B9C4838867D8DC8392E8522F2F89F7DC67A3F0E3D52BA2C14", "US", "e:920d0b248f5eea3b9c4838867d8dc8392e8522f2f89f7dc67a3f0e3d52ba2c14"},
+		// sha256("18055554321")
+		{"p:(805) 555-4321", "US", "p:0cf500fc8a2664a6b0aa627bddd35f3b55756c68abbdd833e87d21226187efd3"},
+		{"p:1-805-555-4321", "CA", "p:0cf500fc8a2664a6b0aa627bddd35f3b55756c68abbdd833e87d21226187efd3"},
+		{"p:18055554321", "US", "p:0cf500fc8a2664a6b0aa627bddd35f3b55756c68abbdd833e87d21226187efd3"},
+		// sha256("442079460018")
+		{"p:020 7946 0018", "GB", "p:99a4599795d24445a5be21117f375c1bbe9e795daf7f62666686ce081e1f32dc"},
+		{"p:+44 20 7946 0018", "US", "p:99a4599795d24445a5be21117f375c1bbe9e795daf7f62666686ce081e1f32dc"},
+		// sha256("33123456789"), with the international call prefix of GB
+		{"p:0033 1 23 45 67 89", "GB", "p:c473fbda80d42b39ba327f6a8b30fc64390255128a1b9d411179454bb58e5ec7"},
+		// sha256("6561234567")
+		{"p:6123 4567", "SG", "p:6c3a4a3431489f35d49ab2c983f80d8fc25c00e06da2d83c3c5973a50f00055b"},
+		{"p:0cf500fc8a2664a6b0aa627bddd35f3b55756c68abbdd833e87d21226187efd3", "US", "p:0cf500fc8a2664a6b0aa627bddd35f3b55756c68abbdd833e87d21226187efd3"},
+		{"i4: 8.8.8.8", "US", "i4:8.8.8.8"},
+		{"i6:2001:0DB8:0000:0000:0000:0000:0000:0001", "US", "i6:2001:db8::1"},
+		{"id5:ID5-Sjw-6xJQtdazsH23 ", "US", "id5:ID5-Sjw-6xJQtdazsH23"},
+	} {
+		got, err := NormalizeIdentifier(tc.identifier, tc.region)
+		if err != nil {
+			t.Fatalf("failed to normalize %q: %s", tc.identifier, err)
+		}
+		if got != tc.want {
+			t.Fatalf("normalize %q: want %q, got %q", tc.identifier, tc.want, got)
+		}
+	}
+}
+
+func TestNormalizeInvalidIdentifier(t *testing.T) {
+	for _, identifier := range []string{
+		"invalidIdentifier",
+		"e:",
+		"e:not an email",
+		"p:call me",
+		"p:555",
+		"p:+1 555 0100",
+		"i4:2001:db8::1",
+		"i4:256.1.1.1",
+		"i6:8.8.8.8",
+	} {
+		if got, err := NormalizeIdentifier(identifier, "US"); err == nil {
+			t.Fatalf("want error normalizing %q, got %q", identifier, got)
+		}
+	}
+}
+
+func TestValidRegion(t *testing.T) {
+	for region, want := range map[string]bool{"US": true, "sg": true, "ZZ": false, "": false} {
+		if got := ValidRegion(region); got != want {
+			t.Fatalf("want %v for region %q, got %v", want, region, got)
+		}
+	}
+}
+
+func TestNormalizingReaderRejections(t *testing.T) {
+	report := NewValidationReport()
+	ir := NewNormalizingReader(NewTextReader(strings.NewReader("p:(805) 555-4321\np:call me\n\ne:not an email\n")), "US", report, "raw.txt")
+
+	var normalized []string
+	for {
+		identifiers, err := ir.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		normalized = append(normalized, identifiers...)
+	}
+	if len(normalized) != 1 || report.Rejected != 2 {
+		t.Fatalf("want 1 normalized and 2 rejected identifiers, got %v and %d", normalized, report.Rejected)
+	}
+	rejection := report.Types["phoneNumbers"].Reasons["cannot be normalized: invalid phone number"]
+	if rejection == nil || rejection.Count != 1 || rejection.Samples[0] != (Sample{File: "raw.txt", Line: 2}) {
+		t.Fatalf("want the phone number of line 2 to be rejected, got %+v", report.Types["phoneNumbers"])
+	}
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// parquetBatchRows is the number of rows read from each mapped column at a
+// time. Pages are decoded as the batches need them.
+const parquetBatchRows = 1024
+
+// parquetColumn is a mapped leaf column of a parquet file.
+type parquetColumn struct {
+	index  int
+	path   string
+	prefix string
+	rows   [][]string
+}
+
+// parquetReader reads identifiers from the mapped columns of a parquet file,
+// one batch of rows at a time.
+type parquetReader struct {
+	reader  *reader.ParquetReader
+	mapped  []*parquetColumn
+	numRows int64
+	read    int64
+	row     int
+	batch   int
+}
+
+// NewParquetReader returns an IdentifierReader over the rows of the parquet
+// file of the given size. columns maps dotted column paths to the
+// identifier type prefix of their values. Repeated columns produce one
+// identifier per element.
+func NewParquetReader(r io.ReaderAt, size int64, columns map[string]string) (_ IdentifierReader, err error) {
+	defer recoverParquet(&err)
+
+	pr, err := reader.NewParquetColumnReader(&parquetFile{r: r, size: size, SectionReader: io.NewSectionReader(r, 0, size)}, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parquet footer: %w", err)
+	}
+
+	schema := pr.SchemaHandler
+	paths := make(map[string]int)
+	for i, inPath := range schema.ValueColumns {
+		exPath := common.StrToPath(schema.InPathToExPath[inPath])
+		paths[strings.ToLower(strings.Join(exPath[1:], "."))] = i
+	}
+
+	p := &parquetReader{reader: pr, numRows: pr.GetNumRows()}
+	for column, prefix := range columns {
+		i, found := paths[strings.ToLower(column)]
+		if !found {
+			return nil, fmt.Errorf("column %s not found in parquet schema", column)
+		}
+		path := schema.ValueColumns[i]
+		switch typ := schema.SchemaElements[schema.MapIndex[path]].GetType(); typ {
+		case parquet.Type_BYTE_ARRAY, parquet.Type_FIXED_LEN_BYTE_ARRAY, parquet.Type_INT32, parquet.Type_INT64:
+		default:
+			return nil, fmt.Errorf("column %s has unsupported parquet type %s", column, typ)
+		}
+		p.mapped = append(p.mapped, &parquetColumn{index: i, path: path, prefix: prefix})
+	}
+	sort.Slice(p.mapped, func(i, j int) bool {
+		return p.mapped[i].index < p.mapped[j].index
+	})
+	return p, nil
+}
+
+// recoverParquet turns the panics of the parquet library on malformed files
+// into errors.
+func recoverParquet(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("malformed parquet file: %v", r)
+	}
+}
+
+// readBatch loads the next batch of rows of the mapped columns.
+func (p *parquetReader) readBatch() (err error) {
+	defer recoverParquet(&err)
+
+	if p.read >= p.numRows {
+		return io.EOF
+	}
+
+	num := p.numRows - p.read
+	if num > parquetBatchRows {
+		num = parquetBatchRows
+	}
+	for _, column := range p.mapped {
+		values, rls, _, err := p.reader.ReadColumnByPath(column.path, num)
+		if err != nil {
+			return fmt.Errorf("failed to read parquet column %s: %w", column.path, err)
+		}
+		if column.rows, err = parquetRows(values, rls); err != nil {
+			return fmt.Errorf("failed to read parquet column %s: %w", column.path, err)
+		}
+		// the parquet library stops at the first page it fails to read.
+		if int64(len(column.rows)) != num {
+			return fmt.Errorf("failed to read parquet column %s: read %d of %d rows", column.path, p.read+int64(len(column.rows)), p.numRows)
+		}
+	}
+	p.read += num
+	p.batch = int(num)
+	p.row = 0
+	return nil
+}
+
+// parquetRows splits the values of a column into rows, a repetition level
+// of 0 starting a new row. Null values are skipped.
+func parquetRows(values []interface{}, rls []int32) ([][]string, error) {
+	var rows [][]string
+	for i, value := range values {
+		if rls[i] == 0 {
+			rows = append(rows, nil)
+		}
+		if len(rows) == 0 {
+			return nil, errors.New("first value does not start a row")
+		}
+		if value == nil {
+			continue
+		}
+
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case int32:
+			s = strconv.FormatInt(int64(v), 10)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			return nil, fmt.Errorf("unsupported value type %T", value)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], s)
+	}
+	return rows, nil
+}
+
+func (p *parquetReader) Read() ([]string, error) {
+	for p.row >= p.batch {
+		if err := p.readBatch(); err != nil {
+			return nil, err
+		}
+	}
+
+	identifiers := make([]string, 0, len(p.mapped))
+	for _, column := range p.mapped {
+		for _, value := range column.rows[p.row] {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			identifiers = append(identifiers, column.prefix+value)
+		}
+	}
+	p.row++
+	return identifiers, nil
+}
+
+// parquetFile is a read-only source.ParquetFile over an io.ReaderAt. Every
+// column opens its own, to read its pages independently.
+type parquetFile struct {
+	*io.SectionReader
+	r    io.ReaderAt
+	size int64
+}
+
+func (f *parquetFile) Open(name string) (source.ParquetFile, error) {
+	if name != "" {
+		return nil, fmt.Errorf("column chunks in external file %s are not supported", name)
+	}
+	return &parquetFile{r: f.r, size: f.size, SectionReader: io.NewSectionReader(f.r, 0, f.size)}, nil
+}
+
+func (f *parquetFile) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("parquet file is read-only")
+}
+
+func (f *parquetFile) Write([]byte) (int, error) {
+	return 0, errors.New("parquet file is read-only")
+}
+
+func (f *parquetFile) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParquetReader(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "input.parquet"))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %s", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat fixture: %s", err)
+	}
+
+	// the fixture has two row groups and mixes snappy, gzip and uncompressed
+	// columns, v1 and v2 data pages, and dictionary encoding.
+	columns := map[string]string{"email_sha256": "e:", "phone": "p:", "device.maid": "a:"}
+	reader, err := NewParquetReader(f, stat.Size(), columns)
+	if err != nil {
+		t.Fatalf("failed to open parquet reader: %s", err)
+	}
+
+	records := readAllIdentifiers(t, reader)
+	want := [][]string{
+		{"e:920d0b248f5eea3b9c4838867d8dc8392e8522f2f89f7dc67a3f0e3d52ba2c14", "p:18055554321", "a:214as2d4asasdasd"},
+		{"p:12125551122"},
+		{"e:920d1212465e48d839b47102826b8c574959e5fcc6bf0fe4f888811a6d14c8de", "p:12125551122"},
+		{"e:920d43ae6aebac63291f0476a63f9dc3d3cd7d3b071673c7f145f58e893740f4", "p:18055554321", "a:5a4d35a4d35as4d3a"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("want %v, got %v", want, records)
+	}
+}
+
+func TestParquetReaderMissingColumn(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "input.parquet"))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %s", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat fixture: %s", err)
+	}
+
+	if _, err := NewParquetReader(f, stat.Size(), map[string]string{"maid": "a:"}); err == nil {
+		t.Fatal("want error for column missing from schema")
+	}
+}
+
+func TestParquetReaderRepeated(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "repeated.parquet"))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %s", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat fixture: %s", err)
+	}
+
+	// the fixture has a repeated emails column, whose second row is empty.
+	reader, err := NewParquetReader(f, stat.Size(), map[string]string{"emails": "e:"})
+	if err != nil {
+		t.Fatalf("failed to open parquet reader: %s", err)
+	}
+
+	records := readAllIdentifiers(t, reader)
+	want := [][]string{
+		{"e:a@example.com", "e:b@example.com"},
+		{},
+		{"e:c@example.com"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("want %v, got %v", want, records)
+	}
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"io"
+
+	v1 "github.com/optable/match-api/match/v1"
+)
+
+// TypeProfile is the profile of the identifiers of a single type.
+type TypeProfile struct {
+	Identifiers   int64   `json:"identifiers"`
+	Unique        int64   `json:"unique"`
+	Duplicates    int64   `json:"duplicates"`
+	DuplicateRate float64 `json:"duplicate_rate"`
+	Malformed     int64   `json:"malformed"`
+	MalformedRate float64 `json:"malformed_rate"`
+}
+
+func (p *TypeProfile) add(o *TypeProfile) {
+	p.Identifiers += o.Identifiers
+	p.Unique += o.Unique
+	p.Duplicates += o.Duplicates
+	p.Malformed += o.Malformed
+}
+
+func (p *TypeProfile) computeRates() {
+	if p.Identifiers == 0 {
+		return
+	}
+	p.MalformedRate = float64(p.Malformed) / float64(p.Identifiers)
+	if wellFormed := p.Identifiers - p.Malformed; wellFormed > 0 {
+		p.DuplicateRate = float64(p.Duplicates) / float64(wellFormed)
+	}
+}
+
+// AudienceProfile describes the identifiers of an audience per type. Unique
+// counts are estimated when Approximate is set.
+type AudienceProfile struct {
+	Approximate bool `json:"approximate"`
+	TypeProfile
+	Types map[string]*TypeProfile `json:"types"`
+}
+
+// NewAudienceProfile combines the validation report of an audience with the
+// insights of its unique, well-formed identifiers. Identifiers of unknown
+// type are reported as malformed under the unknown type.
+func NewAudienceProfile(report *ValidationReport, unique *v1.Insights, approximate bool) *AudienceProfile {
+	profile := &AudienceProfile{Approximate: approximate, Types: make(map[string]*TypeProfile)}
+	for name, r := range report.Types {
+		p := &TypeProfile{Identifiers: r.Accepted + r.Rejected, Malformed: r.Rejected}
+		if t := IdentifierTypes.ByName(name); t != nil {
+			p.Unique = *t.Counter(unique)
+			// estimates can exceed the exact number of identifiers
+			if p.Unique > r.Accepted {
+				p.Unique = r.Accepted
+			}
+			p.Duplicates = r.Accepted - p.Unique
+		}
+		p.computeRates()
+		profile.Types[name] = p
+		profile.add(p)
+	}
+	profile.computeRates()
+	return profile
+}
+
+// CardinalitySketch estimates the number of unique identifiers of each type
+// with HyperLogLog sketches, as an alternative to exact deduplication for
+// very large inputs.
+type CardinalitySketch struct {
+	sketches map[*IdentifierType]*HyperLogLog
+}
+
+// NewCardinalitySketch creates an empty cardinality sketch.
+func NewCardinalitySketch() *CardinalitySketch {
+	return &CardinalitySketch{sketches: make(map[*IdentifierType]*HyperLogLog)}
+}
+
+// Add adds an identifier to the sketch of its type.
+func (s *CardinalitySketch) Add(identifier string) {
+	t, _ := IdentifierTypes.Lookup(identifier)
+	if t == nil {
+		return
+	}
+	sketch, found := s.sketches[t]
+	if !found {
+		// the default precision is always valid
+		sketch, _ = NewHyperLogLog(DefaultHyperLogLogPrecision)
+		s.sketches[t] = sketch
+	}
+	sketch.Add([]byte(identifier))
+}
+
+// AddFrom adds all the identifiers read from ir and returns the number of
+// identifiers read.
+func (s *CardinalitySketch) AddFrom(ir IdentifierReader) (int64, error) {
+	var n int64
+	for {
+		identifiers, err := ir.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		for _, identifier := range identifiers {
+			if !hasValidPrefix(identifier) {
+				continue
+			}
+			s.Add(identifier)
+			n++
+		}
+	}
+}
+
+// Insights returns the estimated number of unique identifiers per type.
+func (s *CardinalitySketch) Insights() *v1.Insights {
+	insights := &v1.Insights{}
+	for t, sketch := range s.sketches {
+		*t.Counter(insights) = sketch.Estimate()
+	}
+	return insights
+}
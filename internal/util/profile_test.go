@@ -0,0 +1,53 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAudienceProfile(t *testing.T) {
+	report := NewValidationReport()
+	uniqueIdentifiers, err := NewUniqueIdentifiers(1<<20, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	if _, err := uniqueIdentifiers.AddFrom(NewValidatingReader(NewTextReader(strings.NewReader(input)), report, "input.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := NewAudienceProfile(report, uniqueIdentifiers.Insights(), false)
+	if profile.Identifiers != 21 || profile.Unique != 11 || profile.Duplicates != 2 || profile.Malformed != 8 {
+		t.Fatalf("unexpected profile totals %+v", profile.TypeProfile)
+	}
+
+	emails := profile.Types["emails"]
+	if emails.Identifiers != 4 || emails.Unique != 3 || emails.Duplicates != 1 || emails.DuplicateRate != 0.25 || emails.Malformed != 0 {
+		t.Fatalf("unexpected emails profile %+v", emails)
+	}
+
+	gaids := profile.Types["googleGaids"]
+	if gaids.Identifiers != 2 || gaids.Malformed != 2 || gaids.MalformedRate != 1 || gaids.Unique != 0 {
+		t.Fatalf("unexpected GAIDs profile %+v", gaids)
+	}
+}
+
+func TestApproximateAudienceProfile(t *testing.T) {
+	report := NewValidationReport()
+	sketch := NewCardinalitySketch()
+	if _, err := sketch.AddFrom(NewValidatingReader(NewTextReader(strings.NewReader(input)), report, "input.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := NewAudienceProfile(report, sketch.Insights(), true)
+	if !profile.Approximate || profile.Unique != 11 || profile.Duplicates != 2 {
+		t.Fatalf("unexpected approximate profile totals %+v", profile.TypeProfile)
+	}
+	if phones := profile.Types["phoneNumbers"]; phones.Unique != 2 || phones.Duplicates != 1 {
+		t.Fatalf("unexpected phone numbers profile %+v", phones)
+	}
+}
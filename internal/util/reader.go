@@ -0,0 +1,35 @@
+package util
+
+import (
+	"bufio"
+	"io"
+)
+
+// IdentifierReader reads prefixed identifiers from an input, one record at
+// a time. A single record can hold identifiers of several types.
+type IdentifierReader interface {
+	// Read returns the identifiers of the next record. It returns io.EOF
+	// when there are no more records.
+	Read() ([]string, error)
+}
+
+// textReader reads line-separated, type-prefixed identifiers.
+type textReader struct {
+	scanner *bufio.Scanner
+}
+
+// NewTextReader returns an IdentifierReader over line-separated and
+// type-prefixed identifiers.
+func NewTextReader(r io.Reader) IdentifierReader {
+	return &textReader{scanner: bufio.NewScanner(r)}
+}
+
+func (t *textReader) Read() ([]string, error) {
+	if !t.scanner.Scan() {
+		if err := t.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return []string{t.scanner.Text()}, nil
+}
@@ -1,8 +1,8 @@
 package util
 
 import (
-	"context"
-	"strings"
+	"os"
+	"path/filepath"
 	"testing"
 
 	v1 "github.com/optable/match-api/match/v1"
@@ -70,7 +70,7 @@ func TestClamp(t *testing.T) {
 }
 
 func TestClampMatchResult(t *testing.T) {
-	srcInsight := GetInsights(inputMap)
+	srcInsight := insightsOf(inputMap)
 	received := v1.ExternalMatchResult{Insights: &v1.Insights{}}
 
 	received.Insights.Emails = 5
@@ -87,7 +87,7 @@ func TestClampMatchResult(t *testing.T) {
 }
 
 func TestClampAndThresholdMatchResult(t *testing.T) {
-	srcInsight := GetInsights(inputMap)
+	srcInsight := insightsOf(inputMap)
 
 	received := v1.ExternalMatchResult{Insights: &v1.Insights{}}
 
@@ -122,52 +122,28 @@ func TestClampAndThresholdMatchResult(t *testing.T) {
 		received.Insights.GoogleGaids != 0 {
 		t.Fatal("clamp result failed")
 	}
-}
-
-func TestGetInputChannel(t *testing.T) {
-	records, err := GetInputChannel(context.Background(), inputMap)
-	if err != nil {
-		t.Fatalf("failed creating input channel from temporary input Data for testing: %s", err)
-	}
 
-	chanLength := int64(0)
-
-	for identifier := range records {
-		if _, found := inputMap[string(identifier)]; !found {
-			t.Fatal("unexpected output")
-		}
-		chanLength++
-	}
-
-	if chanLength != 18 {
-		t.Fatal("get input channel failed")
+	// without source insights, only negative values are clamped
+	received.Insights.Emails = 2000
+	received.Insights.GoogleGaids = -2
+	received.Insights.DifferentialPrivacyThreshold = 0
+	ThresholdAndClampMatchResult(&received, nil)
+	if received.Insights.Emails != 2000 || received.Insights.GoogleGaids != 0 {
+		t.Fatal("clamp result without source insights failed")
 	}
 }
 
-func TestGetUniqueIdentifiersInFile(t *testing.T) {
-	inputData := strings.NewReader(input)
-	uniqueIdentifiersInFile, err := GetUniqueIdentifiersInFile(inputData)
-	if err != nil {
-		t.Fatalf("failed creating input channel from temporary input Data for testing: %s", err)
-	}
-
-	for identifier := range uniqueIdentifiersInFile {
-		if _, found := inputMap[string(identifier)]; !found {
-			t.Fatal("unexpected output")
-		}
-	}
-
-	if _, found := uniqueIdentifiersInFile["invalidIdentifier"]; found {
-		t.Fatal("Invalid identifier found")
-	}
-
-	if len(uniqueIdentifiersInFile) != 18 {
-		t.Fatal("get unique elements failed")
+// insightsOf returns the insights of a set of identifiers.
+func insightsOf(identifiers map[string]bool) *v1.Insights {
+	list := make([][]byte, 0, len(identifiers))
+	for identifier := range identifiers {
+		list = append(list, []byte(identifier))
 	}
+	return GetIdentifiersInsights(list)
 }
 
-func TestGetInsights(t *testing.T) {
-	insight := GetInsights(inputMap)
+func TestGetIdentifiersInsights(t *testing.T) {
+	insight := insightsOf(inputMap)
 
 	if insight.Emails != 3 || insight.Ipv4S != 2 || insight.Ipv6S != 1 ||
 		insight.PhoneNumbers != 2 || insight.AppleIdfas != 1 || insight.SamsungTifas != 1 ||
@@ -176,3 +152,29 @@ func TestGetInsights(t *testing.T) {
 		t.Fatalf("get insights and identifiers failed")
 	}
 }
+
+func TestUniqueIdentifiersCompressedFile(t *testing.T) {
+	for _, fixture := range []string{"input.txt", "input.txt.gz", "input.txt.zst", "input.txt.bz2"} {
+		t.Run(fixture, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", fixture))
+			if err != nil {
+				t.Fatalf("failed to open fixture: %s", err)
+			}
+			defer f.Close()
+
+			uniqueIdentifiers, err := NewUniqueIdentifiers(1<<20, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer uniqueIdentifiers.Close()
+
+			if _, err := uniqueIdentifiers.Add(f); err != nil {
+				t.Fatalf("failed to read unique identifiers: %s", err)
+			}
+			if err := uniqueIdentifiers.Finalize(); err != nil {
+				t.Fatal(err)
+			}
+			assertUniqueIdentifiers(t, uniqueIdentifiers, inputMap)
+		})
+	}
+}
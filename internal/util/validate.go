@@ -0,0 +1,236 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	v1 "github.com/optable/match-api/match/v1"
+)
+
+// maxSamples is the number of samples kept per rejection reason.
+const maxSamples = 10
+
+// unknownType is the report entry of identifiers without a valid type prefix.
+const unknownType = "unknown"
+
+var (
+	uuidPattern       = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	sha256HexPattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	e164Pattern       = regexp.MustCompile(`^\+?[1-9][0-9]{6,14}$`)
+	postalCodePattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z -]{1,9}$`)
+)
+
+// identifierValidator returns the reason why the value of an identifier,
+// without its type prefix, is invalid, or nil when it is valid.
+type identifierValidator func(value string) error
+
+func validateSHA256(value string) error {
+	if !sha256HexPattern.MatchString(value) {
+		return fmt.Errorf("not a lower-cased hex SHA-256 hash")
+	}
+	return nil
+}
+
+// validatePhoneNumber accepts E.164 phone numbers and their SHA-256 hash,
+// which is the form normalized phone numbers take.
+func validatePhoneNumber(value string) error {
+	if !e164Pattern.MatchString(value) && !sha256HexPattern.MatchString(value) {
+		return fmt.Errorf("not an E.164 phone number or its SHA-256 hash")
+	}
+	return nil
+}
+
+func validateIPv4(value string) error {
+	if ip := net.ParseIP(value); ip == nil || ip.To4() == nil || strings.Contains(value, ":") {
+		return fmt.Errorf("not an IPv4 address")
+	}
+	return nil
+}
+
+func validateIPv6(value string) error {
+	if ip := net.ParseIP(value); ip == nil || !strings.Contains(value, ":") {
+		return fmt.Errorf("not an IPv6 address")
+	}
+	return nil
+}
+
+func validateUUID(value string) error {
+	if !uuidPattern.MatchString(value) {
+		return fmt.Errorf("not a UUID")
+	}
+	return nil
+}
+
+func validatePostalCode(value string) error {
+	if !postalCodePattern.MatchString(value) {
+		return fmt.Errorf("not a postal code")
+	}
+	return nil
+}
+
+func validateToken(value string) error {
+	if strings.ContainsAny(value, " \t\r") {
+		return fmt.Errorf("contains whitespace")
+	}
+	return nil
+}
+
+// ValidateIdentifier checks that identifier has a known type prefix and a
+// well-formed value for its type, and returns the name of its type.
+func ValidateIdentifier(identifier string) (string, error) {
+	t, value := IdentifierTypes.Lookup(identifier)
+	if t == nil {
+		return unknownType, fmt.Errorf("unknown identifier type prefix")
+	}
+	if value == "" {
+		return t.Name, fmt.Errorf("empty value")
+	}
+	if err := t.Validate(value); err != nil {
+		return t.Name, err
+	}
+	return t.Name, nil
+}
+
+// Rejection counts the identifiers rejected for a reason.
+type Rejection struct {
+	Count   int64    `json:"count"`
+	Samples []Sample `json:"samples"`
+}
+
+// Sample locates a rejected identifier by its file and record number,
+// which is the line number for line-separated inputs.
+type Sample struct {
+	File string `json:"file"`
+	Line int64  `json:"line"`
+}
+
+// TypeReport is the validation report of a single identifier type.
+type TypeReport struct {
+	Accepted   int64                 `json:"accepted"`
+	Rejected   int64                 `json:"rejected"`
+	Duplicates int64                 `json:"duplicates"`
+	Reasons    map[string]*Rejection `json:"reasons,omitempty"`
+}
+
+// ValidationReport summarizes the validation of the identifiers of one or
+// more inputs, per identifier type.
+type ValidationReport struct {
+	Accepted   int64                  `json:"accepted"`
+	Rejected   int64                  `json:"rejected"`
+	Duplicates int64                  `json:"duplicates"`
+	Types      map[string]*TypeReport `json:"types"`
+}
+
+// NewValidationReport creates an empty validation report.
+func NewValidationReport() *ValidationReport {
+	return &ValidationReport{Types: make(map[string]*TypeReport)}
+}
+
+func (r *ValidationReport) typeReport(name string) *TypeReport {
+	report, found := r.Types[name]
+	if !found {
+		report = &TypeReport{}
+		r.Types[name] = report
+	}
+	return report
+}
+
+func (r *ValidationReport) accept(name string) {
+	r.Accepted++
+	r.typeReport(name).Accepted++
+}
+
+func (r *ValidationReport) reject(name string, reason error, file string, line int64) {
+	r.Rejected++
+	report := r.typeReport(name)
+	report.Rejected++
+
+	if report.Reasons == nil {
+		report.Reasons = make(map[string]*Rejection)
+	}
+	rejection, found := report.Reasons[reason.Error()]
+	if !found {
+		rejection = &Rejection{}
+		report.Reasons[reason.Error()] = rejection
+	}
+	rejection.Count++
+	if len(rejection.Samples) < maxSamples {
+		rejection.Samples = append(rejection.Samples, Sample{File: file, Line: line})
+	}
+}
+
+// SetUniqueInsights derives the duplicate counts from the insights of the
+// unique accepted identifiers.
+func (r *ValidationReport) SetUniqueInsights(unique *v1.Insights) {
+	r.Duplicates = 0
+	for name, report := range r.Types {
+		t := IdentifierTypes.ByName(name)
+		if t == nil {
+			continue
+		}
+		report.Duplicates = report.Accepted - *t.Counter(unique)
+		r.Duplicates += report.Duplicates
+	}
+}
+
+// RejectedRatio returns the ratio of rejected identifiers over all the
+// identifiers validated.
+func (r *ValidationReport) RejectedRatio() float64 {
+	total := r.Accepted + r.Rejected
+	if total == 0 {
+		return 0
+	}
+	return float64(r.Rejected) / float64(total)
+}
+
+// validatingReader validates the identifiers of an IdentifierReader into a
+// report and only returns the valid ones, unless keep is set.
+type validatingReader struct {
+	IdentifierReader
+	report *ValidationReport
+	file   string
+	record int64
+	keep   bool
+}
+
+// NewValidatingReader returns an IdentifierReader that records the
+// validation of every identifier read from ir in report and drops the
+// invalid ones. Rejections are located by file and record number, which is
+// the line number for line-separated inputs.
+func NewValidatingReader(ir IdentifierReader, report *ValidationReport, file string) IdentifierReader {
+	return &validatingReader{IdentifierReader: ir, report: report, file: file}
+}
+
+// NewReportingReader is NewValidatingReader keeping the invalid
+// identifiers, which are only recorded in report.
+func NewReportingReader(ir IdentifierReader, report *ValidationReport, file string) IdentifierReader {
+	return &validatingReader{IdentifierReader: ir, report: report, file: file, keep: true}
+}
+
+func (v *validatingReader) Read() ([]string, error) {
+	identifiers, err := v.IdentifierReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	v.record++
+
+	valid := identifiers[:0]
+	for _, identifier := range identifiers {
+		if strings.TrimSpace(identifier) == "" {
+			continue
+		}
+		name, err := ValidateIdentifier(identifier)
+		if err != nil {
+			v.report.reject(name, err, v.file, v.record)
+			if v.keep {
+				valid = append(valid, identifier)
+			}
+			continue
+		}
+		v.report.accept(name)
+		valid = append(valid, identifier)
+	}
+	return valid, nil
+}
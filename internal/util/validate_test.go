@@ -0,0 +1,123 @@
+package util
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateIdentifier(t *testing.T) {
+	for _, tc := range []struct {
+		identifier string
+		name       string
+		valid      bool
+	}{
+		{"e:920d0b248f5eea3b9c4838867d8dc8392e8522f2f89f7dc67a3f0e3d52ba2c14", "emails", true},
+		{"e:920D0B248F5EEA3B9C4838867D8DC8392E8522F2F89F7DC67A3F0E3D52BA2C14", "emails", false},
+		{"e:user@example.com", "emails", false},
+		{"p:+18055554321", "phoneNumbers", true},
+		{"p:18055554321", "phoneNumbers", true},
+		{"p:(805) 555-4321", "phoneNumbers", false},
+		{"i4:8.8.8.8", "ipv4S", true},
+		{"i4:::ffff:8.8.8.8", "ipv4S", false},
+		{"i4:256.1.1.1", "ipv4S", false},
+		{"i6:2001:db8::1", "ipv6S", true},
+		{"i6:1.1.1.1", "ipv6S", false},
+		{"a:6d92078a-8246-4ba4-ae5b-76104861e7dc", "appleIdfas", true},
+		{"g:not-a-uuid", "googleGaids", false},
+		{"z:H0H 0H0", "postalCodes", true},
+		{"z:H", "postalCodes", false},
+		{"id5:ID5-Sjw-6xJQtdazsH23", "id5s", true},
+		{"utiq:with space", "utiqs", false},
+		{"i4:", "ipv4S", false},
+		{"x:value", unknownType, false},
+	} {
+		name, err := ValidateIdentifier(tc.identifier)
+		if name != tc.name {
+			t.Errorf("%s: want type %s, got %s", tc.identifier, tc.name, name)
+		}
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%s: want valid %v, got error %v", tc.identifier, tc.valid, err)
+		}
+	}
+}
+
+func TestValidationReport(t *testing.T) {
+	report := NewValidationReport()
+	uniqueIdentifiers, err := NewUniqueIdentifiers(1<<20, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	n, err := uniqueIdentifiers.AddFrom(NewValidatingReader(NewTextReader(strings.NewReader(input)), report, "input.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 13 {
+		t.Fatalf("want 13 valid identifiers, got %d", n)
+	}
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	report.SetUniqueInsights(uniqueIdentifiers.Insights())
+
+	if report.Accepted != 13 || report.Rejected != 8 || report.Duplicates != 2 {
+		t.Fatalf("want 13 accepted, 8 rejected and 2 duplicates, got %d, %d and %d", report.Accepted, report.Rejected, report.Duplicates)
+	}
+
+	phones := report.Types["phoneNumbers"]
+	if phones.Accepted != 3 || phones.Duplicates != 1 || phones.Rejected != 0 {
+		t.Fatalf("unexpected phone numbers report %+v", phones)
+	}
+
+	ipv6 := report.Types["ipv6S"].Reasons["not an IPv6 address"]
+	if ipv6 == nil || ipv6.Count != 1 || len(ipv6.Samples) != 1 || ipv6.Samples[0] != (Sample{File: "input.txt", Line: 4}) {
+		t.Fatalf("unexpected IPv6 rejection %+v", ipv6)
+	}
+
+	unknown := report.Types[unknownType].Reasons["unknown identifier type prefix"]
+	if unknown == nil || unknown.Count != 1 || unknown.Samples[0].Line != 21 {
+		t.Fatalf("unexpected unknown type rejection %+v", unknown)
+	}
+
+	if ratio := report.RejectedRatio(); ratio < 0.38 || ratio > 0.39 {
+		t.Fatalf("want a rejected ratio of 8/21, got %f", ratio)
+	}
+}
+
+func TestValidationReportSamples(t *testing.T) {
+	report := NewValidationReport()
+	for _, file := range []string{"a.txt", "b.txt"} {
+		ir := NewValidatingReader(NewTextReader(strings.NewReader(strings.Repeat("i4:invalid\n", maxSamples-1))), report, file)
+		for {
+			if _, err := ir.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rejection := report.Types["ipv4S"].Reasons["not an IPv4 address"]
+	if rejection.Count != 2*(maxSamples-1) || len(rejection.Samples) != maxSamples {
+		t.Fatalf("want %d rejections with %d samples, got %+v", 2*(maxSamples-1), maxSamples, rejection)
+	}
+	if last := rejection.Samples[maxSamples-1]; last != (Sample{File: "b.txt", Line: 1}) {
+		t.Fatalf("want the last sample to be located in the second file, got %+v", last)
+	}
+}
+
+func TestReportingReader(t *testing.T) {
+	report := NewValidationReport()
+	records := readAllIdentifiers(t, NewReportingReader(NewTextReader(strings.NewReader("e:not-a-hash\ni4:1.2.3.4\n")), report, "input.txt"))
+
+	want := [][]string{{"e:not-a-hash"}, {"i4:1.2.3.4"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("want invalid identifiers to be kept %v, got %v", want, records)
+	}
+	if report.Accepted != 1 || report.Rejected != 1 {
+		t.Fatalf("want 1 accepted and 1 rejected, got %d and %d", report.Accepted, report.Rejected)
+	}
+}
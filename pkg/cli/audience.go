@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/optable/match-cli/internal/util"
+)
+
+type (
+	AudienceProfileCmd struct {
+		Files       []string `arg:"" required:"" help:"Files or glob patterns to profile, use - to read from stdin"`
+		Output      string   `default:"json" enum:"json,table" help:"Output format of the profile: json or table"`
+		Approximate bool     `help:"Estimate unique counts with HyperLogLog sketches instead of deduplicating identifiers, for very large inputs"`
+		InputFlags
+	}
+
+	AudienceCmd struct {
+		Profile AudienceProfileCmd `cmd:"" help:"Profile the identifiers of an audience before matching it"`
+	}
+)
+
+// Run profiles the identifiers of the audience files locally, without
+// contacting any partner.
+func (a *AudienceProfileCmd) Run(cli *CliContext) error {
+	report := util.NewValidationReport()
+
+	var profile *util.AudienceProfile
+	if a.Approximate {
+		sketch, err := sketchAudience(a.Files, &a.InputFlags, report)
+		if err != nil {
+			return err
+		}
+		profile = util.NewAudienceProfile(report, sketch.Insights(), true)
+	} else {
+		uniqueIdentifiers, _, err := loadUniqueIdentifiers(cli.ctx, a.Files, &a.InputFlags, report, true)
+		if err != nil {
+			return err
+		}
+		defer uniqueIdentifiers.Close()
+		profile = util.NewAudienceProfile(report, uniqueIdentifiers.Insights(), false)
+	}
+
+	if a.Output == "table" {
+		return printProfileTable(profile)
+	}
+	return printJson(profile)
+}
+
+// sketchAudience estimates the unique identifiers of the inputs matched by
+// paths in bounded memory.
+func sketchAudience(paths []string, flags *InputFlags, report *util.ValidationReport) (*util.CardinalitySketch, error) {
+	inputs, err := expandInputPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := flags.selected(); err != nil {
+		return nil, err
+	}
+
+	sketch := util.NewCardinalitySketch()
+	for _, path := range inputs {
+		err := readInput(path, flags, report, true, func(ir util.IdentifierReader) error {
+			_, err := sketch.AddFrom(ir)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to profile identifiers in file %s : %w", inputName(path), err)
+		}
+	}
+	return sketch, nil
+}
+
+func printProfileTable(profile *util.AudienceProfile) error {
+	names := make([]string, 0, len(profile.Types))
+	for name := range profile.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unique := "UNIQUE"
+	if profile.Approximate {
+		unique = "UNIQUE (EST.)"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "TYPE\tIDENTIFIERS\t%s\tDUPLICATES\tDUPLICATE %%\tMALFORMED\tMALFORMED %%\t\n", unique)
+	for _, name := range names {
+		printProfileRow(w, name, profile.Types[name])
+	}
+	printProfileRow(w, "total", &profile.TypeProfile)
+	return w.Flush()
+}
+
+func printProfileRow(w *tabwriter.Writer, name string, p *util.TypeProfile) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2f\t%d\t%.2f\t\n",
+		name, p.Identifiers, p.Unique, p.Duplicates, p.DuplicateRate*100, p.Malformed, p.MalformedRate*100)
+}
@@ -0,0 +1,289 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/optable/match-cli/internal/util"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+type MatchRunBatchCmd struct {
+	Manifest    string        `arg:"" required:"" type:"existingfile" help:"Manifest of the runs, in YAML or JSON"`
+	Concurrency int           `default:"4" help:"Maximum number of runs at the same time"`
+	InitTimeout time.Duration `default:"10m" help:"Timeout for the initialization of each match"`
+	RunTimeout  time.Duration `default:"30m" help:"Timeout for each match operation"`
+	Protocols   []string      `default:"dhpsi" help:"PSI protocols in order of preference (dhpsi, npsi, bpsi, kkrtpsi), unless set in the manifest"`
+	InputFlags
+	PollFlags
+}
+
+// batchManifest lists the runs of a batch. Relative file paths are
+// relative to the directory of the manifest.
+//
+//	runs:
+//	  - partner: acme
+//	    match_id: 2B8nxKGN0DyhkMAsRvIGvJpQ6lS
+//	    files: [audience/*.csv]
+//	    protocols: [kkrtpsi, dhpsi]
+type batchManifest struct {
+	Runs []*batchEntry `yaml:"runs"`
+}
+
+type batchEntry struct {
+	Partner   string   `yaml:"partner"`
+	MatchID   string   `yaml:"match_id"`
+	Files     []string `yaml:"files"`
+	Protocols []string `yaml:"protocols"`
+}
+
+// batchResult is the consolidated report of a batch.
+type batchResult struct {
+	Time      time.Time   `json:"time"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Runs      []*batchRun `json:"runs"`
+}
+
+// batchRun is the outcome of a run of the batch.
+type batchRun struct {
+	Partner string       `json:"partner"`
+	MatchID string       `json:"match_id"`
+	Files   []string     `json:"files"`
+	Status  string       `json:"status"`
+	Error   string       `json:"error,omitempty"`
+	Result  *matchResult `json:"result,omitempty"`
+}
+
+// inputSet is the unique identifiers of a set of files, shared by the runs
+// matching the same files. They are loaded by the first run needing them,
+// and closed once the last of their runs is done.
+type inputSet struct {
+	files []string
+	once  sync.Once
+
+	uniqueIdentifiers *util.UniqueIdentifiers
+	err               error
+
+	mu   sync.Mutex
+	runs int
+}
+
+// load loads the unique identifiers of the files of the set, once for all
+// its runs.
+func (s *inputSet) load(ctx context.Context, flags *InputFlags) (*util.UniqueIdentifiers, error) {
+	s.once.Do(func() {
+		if s.err != nil {
+			return
+		}
+		var counts []inputCount
+		s.uniqueIdentifiers, counts, s.err = loadUniqueIdentifiers(ctx, s.files, flags, nil, false)
+		if s.err == nil {
+			info(ctx).Msgf("loaded %d unique records from %v, with the following breakdown: %v", s.uniqueIdentifiers.Len(), counts, s.uniqueIdentifiers.Insights())
+		}
+	})
+	return s.uniqueIdentifiers, s.err
+}
+
+// release marks a run of the set as done, and closes the unique identifiers
+// after the last run.
+func (s *inputSet) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs--
+	if s.runs == 0 && s.uniqueIdentifiers != nil {
+		s.uniqueIdentifiers.Close()
+	}
+}
+
+// readBatchManifest reads and validates the manifest at path. YAML being a
+// superset of JSON, both are read as YAML.
+func readBatchManifest(path string) (*batchManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer file.Close()
+
+	manifest := &batchManifest{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", path, err)
+	}
+	if len(manifest.Runs) == 0 {
+		return nil, fmt.Errorf("no run in manifest %s", path)
+	}
+
+	dir := filepath.Dir(path)
+	for i, entry := range manifest.Runs {
+		if entry.Partner == "" || entry.MatchID == "" || len(entry.Files) == 0 {
+			return nil, fmt.Errorf("run %d of manifest %s requires a partner, a match_id and files", i+1, path)
+		}
+		for j, file := range entry.Files {
+			if file == stdinPath {
+				return nil, fmt.Errorf("run %d of manifest %s cannot read identifiers from stdin", i+1, path)
+			}
+			if !filepath.IsAbs(file) {
+				entry.Files[j] = filepath.Join(dir, file)
+			}
+		}
+		if len(entry.Protocols) > 0 {
+			if _, err := parsePSIProtocols(entry.Protocols); err != nil {
+				return nil, fmt.Errorf("run %d of manifest %s: %w", i+1, path, err)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// inputKey identifies the files matched by the patterns, regardless of
+// their order.
+func inputKey(patterns []string) (string, error) {
+	files, err := expandInputPaths(patterns)
+	if err != nil {
+		return "", err
+	}
+	for i, file := range files {
+		if files[i], err = filepath.Abs(file); err != nil {
+			return "", err
+		}
+	}
+	sort.Strings(files)
+	return strings.Join(files, "\x00"), nil
+}
+
+// inputSets returns the input set of each run, one for identical files.
+// Runs whose files cannot be listed share the error.
+func inputSets(runs []*batchEntry) map[*batchEntry]*inputSet {
+	sets := make(map[string]*inputSet)
+	byRun := make(map[*batchEntry]*inputSet, len(runs))
+	for _, entry := range runs {
+		key, err := inputKey(entry.Files)
+		if err != nil {
+			byRun[entry] = &inputSet{err: err, runs: 1}
+			continue
+		}
+
+		set, found := sets[key]
+		if !found {
+			set = &inputSet{files: entry.Files}
+			sets[key] = set
+		}
+		set.runs++
+		byRun[entry] = set
+	}
+	return byRun
+}
+
+// runEntry runs the match of an entry of the manifest on the unique
+// identifiers of its input set.
+func (b *MatchRunBatchCmd) runEntry(ctx context.Context, cli *CliContext, entry *batchEntry, set *inputSet) (*matchResult, error) {
+	uniqueIdentifiers, err := set.load(ctx, &b.InputFlags)
+	if err != nil {
+		return nil, err
+	}
+	protocolNames := b.Protocols
+	if len(entry.Protocols) > 0 {
+		protocolNames = entry.Protocols
+	}
+	protocols, err := parsePSIProtocols(protocolNames)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.RunTimeout)
+	defer cancel()
+	info(ctx).Msgf("running match %s with a timeout of %v", entry.MatchID, b.RunTimeout)
+
+	m := &MatchRunCmd{
+		Partner:     entry.Partner,
+		InitTimeout: b.InitTimeout,
+		RunTimeout:  b.RunTimeout,
+		MatchID:     entry.MatchID,
+		Files:       entry.Files,
+		Protocols:   protocolNames,
+		InputFlags:  b.InputFlags,
+		PollFlags:   b.PollFlags,
+	}
+	return m.match(ctx, cli, uniqueIdentifiers, protocols)
+}
+
+// Run runs the matches of the manifest, at most --concurrency at a time,
+// and prints a consolidated report. The identifiers of identical files are
+// loaded once, by the first of their runs, and shared by their runs.
+func (b *MatchRunBatchCmd) Run(cli *CliContext) error {
+	res, err := b.runBatch(cli)
+	if err != nil {
+		return err
+	}
+	if err := printJson(res); err != nil {
+		return err
+	}
+	if res.Failed > 0 {
+		return fmt.Errorf("%d of %d runs failed", res.Failed, len(res.Runs))
+	}
+	return nil
+}
+
+// runBatch runs the matches of the manifest and returns the report of all
+// the runs, failed ones included.
+func (b *MatchRunBatchCmd) runBatch(cli *CliContext) (*batchResult, error) {
+	ctx := withInfoLogger(cli.ctx)
+
+	if b.Concurrency <= 0 {
+		return nil, fmt.Errorf("--concurrency must be positive")
+	}
+	if _, err := parsePSIProtocols(b.Protocols); err != nil {
+		return nil, err
+	}
+	manifest, err := readBatchManifest(b.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := inputSets(manifest.Runs)
+
+	res := &batchResult{Runs: make([]*batchRun, len(manifest.Runs))}
+	slots := make(chan struct{}, b.Concurrency)
+	var wg sync.WaitGroup
+	for i, entry := range manifest.Runs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, entry *batchEntry) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer sets[entry].release()
+
+			logger := zerolog.Ctx(ctx).With().Str("partner", entry.Partner).Str("match", entry.MatchID).Logger()
+			result, err := b.runEntry(logger.WithContext(ctx), cli, entry, sets[entry])
+
+			run := &batchRun{Partner: entry.Partner, MatchID: entry.MatchID, Files: entry.Files, Status: "completed", Result: result}
+			if err != nil {
+				run.Status = "failed"
+				run.Error = err.Error()
+				logger.Info().Msgf("match failed: %v", err)
+			}
+			res.Runs[i] = run
+		}(i, entry)
+	}
+	wg.Wait()
+
+	for _, run := range res.Runs {
+		if run.Error != "" {
+			res.Failed++
+		} else {
+			res.Succeeded++
+		}
+	}
+	res.Time = time.Now().UTC()
+	return res, nil
+}
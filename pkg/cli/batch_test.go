@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/dcntest"
+)
+
+// writeTestFile writes the identifiers to a file of dir.
+func writeTestFile(t *testing.T, dir, name string, identifiers [][]byte) {
+	t.Helper()
+	var lines []string
+	for _, identifier := range identifiers {
+		lines = append(lines, string(identifier))
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBatchManifest(t *testing.T) {
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		manifest string
+		err      string
+	}{
+		"manifest.yaml": {manifest: "runs:\n  - partner: acme\n    match_id: m1\n    files: [a.txt, /data/b.txt]\n"},
+		"manifest.json": {manifest: `{"runs": [{"partner": "acme", "match_id": "m1", "files": ["a.txt", "/data/b.txt"]}]}`},
+		"unknown.yaml":  {manifest: "runs:\n  - partner: acme\n    match: m1\n    files: [a.txt]\n", err: "field match not found"},
+		"missing.yaml":  {manifest: "runs:\n  - partner: acme\n    files: [a.txt]\n", err: "requires a partner, a match_id and files"},
+		"empty.yaml":    {manifest: "runs: []\n", err: "no run"},
+		"stdin.yaml":    {manifest: "runs:\n  - {partner: acme, match_id: m1, files: [\"-\"]}\n", err: "stdin"},
+		"protocol.yaml": {manifest: "runs:\n  - {partner: acme, match_id: m1, files: [a.txt], protocols: [rsa]}\n", err: "unsupported PSI protocol rsa"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(tc.manifest), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			manifest, err := readBatchManifest(path)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("want %q in error, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// relative paths are relative to the manifest
+			if files := manifest.Runs[0].Files; files[0] != filepath.Join(dir, "a.txt") || files[1] != "/data/b.txt" {
+				t.Fatalf("unexpected files %v", files)
+			}
+		})
+	}
+}
+
+func TestInputSets(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.txt", testIdentifiers(0, 10))
+	writeTestFile(t, dir, "b.txt", testIdentifiers(5, 20))
+
+	runs := []*batchEntry{
+		{Files: []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}},
+		{Files: []string{filepath.Join(dir, "b.txt"), filepath.Join(dir, "a.txt")}},
+		{Files: []string{filepath.Join(dir, "*.txt")}},
+		{Files: []string{filepath.Join(dir, "a.txt")}},
+		{Files: []string{filepath.Join(dir, "missing.txt")}},
+	}
+	sets := inputSets(runs)
+	if sets[runs[0]] != sets[runs[1]] || sets[runs[0]] != sets[runs[2]] {
+		t.Fatal("want the runs of the same files to share their identifiers")
+	}
+	if sets[runs[0]] == sets[runs[3]] {
+		t.Fatal("want the runs of different files to have their own identifiers")
+	}
+	if sets[runs[0]].uniqueIdentifiers != nil {
+		t.Fatal("want the identifiers to be loaded by the first run needing them")
+	}
+
+	// the runs of a set load its identifiers once, concurrently
+	flags := &InputFlags{Format: "text", MaxMemory: 512, TempDir: t.TempDir()}
+	loaded := make(chan *util.UniqueIdentifiers, 3)
+	for _, run := range runs[:3] {
+		go func(set *inputSet) {
+			uniqueIdentifiers, err := set.load(context.Background(), flags)
+			if err != nil {
+				t.Error(err)
+			}
+			loaded <- uniqueIdentifiers
+		}(sets[run])
+	}
+	first := <-loaded
+	if second, third := <-loaded, <-loaded; first != second || first != third {
+		t.Fatal("want the identifiers to be loaded once")
+	}
+	if n := first.Len(); n != 20 {
+		t.Fatalf("want 20 unique identifiers, got %d", n)
+	}
+
+	// the identifiers are closed after the last run
+	for _, run := range runs[:2] {
+		sets[run].release()
+	}
+	if sets[runs[2]].runs != 1 {
+		t.Fatalf("want one run left, got %d", sets[runs[2]].runs)
+	}
+	if spilled, _ := os.ReadDir(flags.TempDir); len(spilled) != 1 {
+		t.Fatalf("want the identifiers to be kept until the last run, got %d spill directories", len(spilled))
+	}
+	sets[runs[2]].release()
+	if spilled, _ := os.ReadDir(flags.TempDir); len(spilled) != 0 {
+		t.Fatal("want the identifiers to be closed after the last run")
+	}
+
+	if _, err := sets[runs[4]].load(context.Background(), flags); err == nil {
+		t.Fatal("want the run of a missing file to fail")
+	}
+}
+
+func TestMatchRunBatch(t *testing.T) {
+	dcn1 := dcntest.NewServer(testIdentifiers(40, 200))
+	defer dcn1.Close()
+	dcn2 := dcntest.NewServer(testIdentifiers(90, 200))
+	defer dcn2.Close()
+	cli := newTestCli(t)
+
+	var matchIDs []string
+	for _, dcn := range []*dcntest.Server{dcn1, dcn2} {
+		partner, err := (&PartnerConnectCmd{Name: dcn.URL, Token: dcn.InviteToken()}).connect(cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created, err := (&MatchCreateCmd{Partner: partner.Name, Name: "batch"}).create(cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matchIDs = append(matchIDs, created.MatchUid)
+	}
+
+	dir := t.TempDir()
+	writeTestFile(t, dir, "audience.txt", testIdentifiers(0, 100))
+	manifest := "runs:\n" +
+		"  - {partner: '" + dcn1.URL + "', match_id: " + matchIDs[0] + ", files: [audience.txt]}\n" +
+		"  - {partner: '" + dcn2.URL + "', match_id: " + matchIDs[1] + ", files: [audience.txt], protocols: [npsi]}\n" +
+		"  - {partner: unknown, match_id: " + matchIDs[0] + ", files: [audience.txt]}\n"
+	if err := os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte(manifest), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &MatchRunBatchCmd{
+		Manifest:    filepath.Join(dir, "manifest.yaml"),
+		Concurrency: 2,
+		InitTimeout: time.Minute,
+		RunTimeout:  time.Minute,
+		Protocols:   []string{"dhpsi"},
+		InputFlags:  InputFlags{Format: "text", MaxMemory: 512},
+	}
+	res, err := b.runBatch(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Succeeded != 2 || res.Failed != 1 {
+		t.Fatalf("want 2 succeeded and 1 failed runs, got %d and %d", res.Succeeded, res.Failed)
+	}
+
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), res.Runs[0].Result.Results)
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(90, 100)), res.Runs[1].Result.Results)
+	if run := res.Runs[2]; run.Status != "failed" || !strings.Contains(run.Error, "partner unknown does not exist") {
+		t.Fatalf("want the run of an unknown partner to fail, got %+v", run)
+	}
+}
@@ -0,0 +1,269 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/optable/match-cli/internal/auth"
+	"github.com/optable/match-cli/pkg/header"
+	"github.com/optable/match-cli/pkg/match"
+	"github.com/optable/match-cli/pkg/network"
+	"github.com/optable/match/pkg/psi"
+)
+
+type BenchCmd struct {
+	Size       int64         `default:"100000" help:"Number of synthetic identifiers of the sender and of the receiver"`
+	Overlap    float64       `default:"0.5" help:"Ratio of the identifiers held by both the sender and the receiver, between 0 and 1"`
+	Protocols  []string      `default:"dhpsi,npsi,bpsi,kkrtpsi" help:"PSI protocols to benchmark (dhpsi, npsi, bpsi, kkrtpsi)"`
+	RunTimeout time.Duration `default:"30m" help:"Timeout for the match of each protocol"`
+}
+
+// benchResult is the outcome of a benchmark of the PSI protocols.
+type benchResult struct {
+	Time    time.Time        `json:"time"`
+	Size    int64            `json:"size"`
+	Overlap float64          `json:"overlap"`
+	Results []*protocolBench `json:"results"`
+}
+
+// protocolBench measures a match between an in-process sender and receiver
+// with a single protocol. CPU time and peak heap cover both sides.
+type protocolBench struct {
+	Protocol      string  `json:"protocol"`
+	Matched       int     `json:"matched"`
+	WallSeconds   float64 `json:"wall_seconds"`
+	CPUSeconds    float64 `json:"cpu_seconds"`
+	PeakHeapBytes uint64  `json:"peak_heap_bytes"`
+	// BytesSent and BytesReceived are the bytes on the wire from the point
+	// of view of the sender, TLS included.
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	Error         string `json:"error,omitempty"`
+}
+
+// countingListener counts the bytes read and written by the connections it
+// accepts.
+type countingListener struct {
+	net.Listener
+	read    int64
+	written int64
+}
+
+type countingConn struct {
+	net.Conn
+	l *countingListener
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, l: l}, nil
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.l.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.l.written, int64(n))
+	return n, err
+}
+
+// syntheticIdentifiers streams the email identifiers numbered from first
+// to last excluded.
+func syntheticIdentifiers(ctx context.Context, first, last int64) <-chan []byte {
+	identifiers := make(chan []byte)
+	go func() {
+		defer close(identifiers)
+		var number [8]byte
+		for i := first; i < last; i++ {
+			binary.BigEndian.PutUint64(number[:], uint64(i))
+			sum := sha256.Sum256(number[:])
+			select {
+			case identifiers <- []byte("e:" + hex.EncodeToString(sum[:])):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return identifiers
+}
+
+// sampleHeap records the peak of the heap until the returned function is
+// called, which returns it.
+func sampleHeap() func() uint64 {
+	var peak uint64
+	sample := func() {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > peak {
+			peak = stats.HeapAlloc
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(done)
+		<-stopped
+		sample()
+		return peak
+	}
+}
+
+func newBenchCertificate() (*auth.EphemerealCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return auth.NewEphemerealCertificate(key)
+}
+
+// benchProtocol runs a match with protocol between a sender and a receiver
+// of size identifiers each, common of which are held by both.
+func (b *BenchCmd) benchProtocol(ctx context.Context, protocol psi.Protocol, common int64) (*protocolBench, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.RunTimeout)
+	defer cancel()
+
+	senderCertificate, err := newBenchCertificate()
+	if err != nil {
+		return nil, err
+	}
+	receiverCertificate, err := newBenchCertificate()
+	if err != nil {
+		return nil, err
+	}
+	receiverTLSCertificate, err := receiverCertificate.GetTLSCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TLS certificate from ephemereal certificate: %w", err)
+	}
+	senderCert, err := auth.ParseCertificatePEM(string(senderCertificate.CertificatePem))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sender certificate: %w", err)
+	}
+
+	l, err := network.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	counted := &countingListener{Listener: l}
+	defer counted.Close()
+
+	endpoint := l.Addr().String()
+	tlsConfig, err := getTLSConfig(senderCertificate, string(receiverCertificate.CertificatePem), endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS config for PSI: %w", err)
+	}
+	h := &header.Header{Version: header.Version, Protocols: []psi.Protocol{protocol}, ClientVersion: version}
+
+	runtime.GC()
+	peakHeap := sampleHeap()
+	cpuStart := cpuTime()
+	start := time.Now()
+
+	// the first side to fail cancels the other one waiting for it, and its
+	// error is the one reported.
+	var (
+		failOnce sync.Once
+		failure  error
+	)
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	received := make(chan [][]byte, 1)
+	go func() {
+		records := syntheticIdentifiers(ctx, b.Size-common, 2*b.Size-common)
+		intersection, err := match.ReceiveWithHeader(ctx, counted, pinnedServerTLSConfig(receiverTLSCertificate, senderCert), h, b.Size, records)
+		if err != nil {
+			fail(err)
+		}
+		received <- intersection
+	}()
+
+	if _, err := match.SendWithHeader(ctx, endpoint, tlsConfig, h, b.Size, syntheticIdentifiers(ctx, 0, b.Size)); err != nil {
+		fail(err)
+	}
+	intersection := <-received
+
+	result := &protocolBench{
+		Protocol:      protocol.String(),
+		Matched:       len(intersection),
+		WallSeconds:   time.Since(start).Seconds(),
+		CPUSeconds:    (cpuTime() - cpuStart).Seconds(),
+		PeakHeapBytes: peakHeap(),
+		BytesSent:     atomic.LoadInt64(&counted.read),
+		BytesReceived: atomic.LoadInt64(&counted.written),
+	}
+	if failure != nil {
+		result.Error = failure.Error()
+	}
+	return result, nil
+}
+
+// Run benchmarks the PSI protocols with an in-process sender and receiver
+// connected over loopback TLS.
+func (b *BenchCmd) Run(cli *CliContext) error {
+	ctx := withInfoLogger(cli.ctx)
+
+	if b.Size <= 0 {
+		return fmt.Errorf("--size must be positive")
+	}
+	if b.Overlap < 0 || b.Overlap > 1 {
+		return fmt.Errorf("--overlap must be between 0 and 1")
+	}
+	protocols, err := parsePSIProtocols(b.Protocols)
+	if err != nil {
+		return err
+	}
+	common := int64(float64(b.Size)*b.Overlap + 0.5)
+
+	res := &benchResult{Size: b.Size, Overlap: b.Overlap}
+	for _, protocol := range protocols {
+		info(ctx).Msgf("benchmarking %s with %d identifiers, %d in common", protocol, b.Size, common)
+		result, err := b.benchProtocol(cli.ctx, protocol, common)
+		if err != nil {
+			return fmt.Errorf("failed to benchmark %s: %w", protocol, err)
+		}
+		if result.Error != "" {
+			info(ctx).Msgf("%s failed: %s", protocol, result.Error)
+		}
+		res.Results = append(res.Results, result)
+	}
+	res.Time = time.Now().UTC()
+
+	return printJson(res)
+}
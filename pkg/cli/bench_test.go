@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/optable/match/pkg/psi"
+)
+
+func TestCountingListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingListener{Listener: l}
+	defer counted.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := counted.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, 5)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			served <- err
+			return
+		}
+		_, err = conn.Write([]byte("abc"))
+		served <- err
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	if read, written := atomic.LoadInt64(&counted.read), atomic.LoadInt64(&counted.written); read != 5 || written != 3 {
+		t.Fatalf("want 5 bytes read and 3 written by the accepted connection, got %d and %d", read, written)
+	}
+}
+
+func TestBenchProtocol(t *testing.T) {
+	b := &BenchCmd{Size: 100, RunTimeout: time.Minute}
+	// the sender holds 0 to 100 and the receiver 100-common to 200-common
+	for _, common := range []int64{0, 30, 100} {
+		result, err := b.benchProtocol(context.Background(), psi.ProtocolDHPSI, common)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Error != "" || result.Matched != int(common) {
+			t.Fatalf("want %d identifiers matched, got %d: %s", common, result.Matched, result.Error)
+		}
+		if result.Protocol != "dhpsi" || result.BytesSent == 0 || result.BytesReceived == 0 || result.WallSeconds <= 0 {
+			t.Fatalf("unexpected measures %+v", result)
+		}
+	}
+}
+
+func TestBenchRunFlags(t *testing.T) {
+	cli := newTestCli(t)
+	for _, b := range []*BenchCmd{
+		{Size: 0, Overlap: 0.5, Protocols: []string{"dhpsi"}},
+		{Size: 10, Overlap: -0.1, Protocols: []string{"dhpsi"}},
+		{Size: 10, Overlap: 1.5, Protocols: []string{"dhpsi"}},
+		{Size: 10, Overlap: 0.5, Protocols: []string{"unknown"}},
+	} {
+		if err := b.Run(cli); err == nil {
+			t.Fatalf("want invalid flags %+v to fail", b)
+		}
+	}
+
+	b := &BenchCmd{Size: 10, Overlap: 0.5, Protocols: []string{"dhpsi"}, RunTimeout: time.Minute}
+	if err := b.Run(cli); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCPUTime(t *testing.T) {
+	start := cpuTime()
+	for deadline := time.Now().Add(20 * time.Millisecond); time.Now().Before(deadline); {
+	}
+	if elapsed := cpuTime() - start; elapsed <= 0 {
+		t.Fatalf("want CPU time to be consumed by a busy loop, got %v", elapsed)
+	}
+}
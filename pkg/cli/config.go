@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/optable/match-cli/internal/client"
@@ -52,12 +53,80 @@ func (c *Config) findPartner(name string) *PartnerConfig {
 	return nil
 }
 
+// updatePartner replaces the configuration of the partner with the same name.
+func (c *Config) updatePartner(partner *PartnerConfig) {
+	for i := range c.Partners {
+		if c.Partners[i].Name == partner.Name {
+			c.Partners[i] = *partner
+			return
+		}
+	}
+}
+
 type PartnerConfig struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	URL         string `json:"url"`
 	PublicKey   string `json:"public_key"`
 	PrivateKey  string `json:"private_key"`
+	// PeerPublicKey is the public key of a peer partner, given when adding
+	// it or else pinned when importing its first match offer.
+	PeerPublicKey string `json:"peer_public_key,omitempty"`
+	// Transport configures the calls to the partner, with the defaults of
+	// partner configure when nil.
+	Transport *TransportConfig `json:"transport,omitempty"`
+}
+
+// TransportConfig configures the calls to a partner. Zero values disable
+// the timeout, the retries and the rate limit.
+type TransportConfig struct {
+	// TimeoutSeconds bounds each attempt of a call.
+	TimeoutSeconds float64 `json:"timeout_seconds,omitempty"`
+	// MaxRetries is the number of times an idempotent call is retried
+	// after a network error or a 429 or 5xx status.
+	MaxRetries int `json:"max_retries,omitempty"`
+	// RateLimit is the number of calls per second sent at most, with
+	// bursts of RateBurst calls.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	RateBurst int     `json:"rate_burst,omitempty"`
+}
+
+// defaultTransportConfig configures the calls to the partners that were
+// not configured with partner configure, with its default flags. Calls are
+// not retried, the polls of the match API retrying their own errors.
+var defaultTransportConfig = TransportConfig{TimeoutSeconds: 60, RateBurst: 1}
+
+func (t *TransportConfig) options() client.TransportOptions {
+	return client.TransportOptions{
+		Timeout:    time.Duration(t.TimeoutSeconds * float64(time.Second)),
+		MaxRetries: t.MaxRetries,
+		RateLimit:  t.RateLimit,
+		RateBurst:  t.RateBurst,
+	}
+}
+
+type transportKey struct {
+	partner string
+	config  TransportConfig
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[transportKey]http.RoundTripper)
+)
+
+// partnerTransport returns the transport of the partner, shared by all its
+// clients so that they share its connections and its rate limit.
+func partnerTransport(partner string, config TransportConfig) http.RoundTripper {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	key := transportKey{partner: partner, config: config}
+	transport, ok := transports[key]
+	if !ok {
+		transport = client.NewTransport(nil, config.options())
+		transports[key] = transport
+	}
+	return transport
 }
 
 func (partner *PartnerConfig) ParsedPrivateKey() (*ecdsa.PrivateKey, error) {
@@ -96,5 +165,11 @@ func (partner *PartnerConfig) NewClient() (*client.OptableRpcClient, error) {
 	tokenSourceFn := func(_ *http.Request) (string, error) {
 		return partner.NewToken(time.Minute * 10)
 	}
-	return client.NewClient(partner.URL, client.TokenSourceFn(tokenSourceFn)), nil
+	c := client.NewClient(partner.URL, client.TokenSourceFn(tokenSourceFn))
+	config := defaultTransportConfig
+	if partner.Transport != nil {
+		config = *partner.Transport
+	}
+	c.Transport = partnerTransport(partner.Name, config)
+	return c, nil
 }
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns the user and system CPU time consumed by the process.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
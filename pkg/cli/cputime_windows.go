@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns the user and kernel CPU time consumed by the process.
+func cpuTime() time.Duration {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(process, &creation, &exit, &kernel, &user); err != nil {
+		return 0
+	}
+	// filetimes are in units of 100 nanoseconds
+	ticks := func(t syscall.Filetime) int64 {
+		return int64(t.HighDateTime)<<32 | int64(t.LowDateTime)
+	}
+	return time.Duration((ticks(kernel) + ticks(user)) * 100)
+}
@@ -0,0 +1,378 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+type DaemonCmd struct {
+	Schedule    string        `arg:"" required:"" type:"existingfile" help:"Schedule of the recurring matches, in YAML or JSON"`
+	State       string        `help:"File persisting the last run of each schedule, defaults to the schedule file with a .state.json extension"`
+	Concurrency int           `default:"4" help:"Maximum number of runs at the same time"`
+	InitTimeout time.Duration `default:"10m" help:"Timeout for the initialization of each match"`
+	RunTimeout  time.Duration `default:"30m" help:"Timeout for each match operation"`
+	Protocols   []string      `default:"dhpsi" help:"PSI protocols in order of preference (dhpsi, npsi, bpsi, kkrtpsi), unless set in the schedule"`
+	InputFlags
+	PollFlags
+}
+
+// daemonSchedule lists the recurring matches run by the daemon. The cron
+// expressions are the standard ones, with descriptors such as @daily and an
+// optional CRON_TZ= prefix. Files are expanded and read at run time, and
+// relative file paths are relative to the directory of the schedule.
+//
+//	schedules:
+//	  - name: acme-weekly
+//	    cron: "0 3 * * MON"
+//	    partner: acme
+//	    match_id: 2B8nxKGN0DyhkMAsRvIGvJpQ6lS
+//	    files: [audience/*.csv]
+type daemonSchedule struct {
+	Schedules []*scheduleEntry `yaml:"schedules"`
+}
+
+type scheduleEntry struct {
+	Name       string `yaml:"name"`
+	Cron       string `yaml:"cron"`
+	batchEntry `yaml:",inline"`
+
+	schedule cron.Schedule
+}
+
+// daemonState is the last run of each schedule, by name.
+type daemonState struct {
+	Schedules map[string]*scheduleState `json:"schedules"`
+}
+
+// scheduleState is the last run of a schedule. A run interrupted by a stop
+// or a crash of the daemon stays interrupted or running, and is resumed
+// from its journal, RunID, when the daemon starts again.
+type scheduleState struct {
+	ScheduledAt   time.Time `json:"scheduled_at"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	RunID         string    `json:"run_id,omitempty"`
+	MatchResultID string    `json:"match_result_id,omitempty"`
+}
+
+// daemonRun is the outcome of a scheduled run, printed once it is done.
+type daemonRun struct {
+	Schedule    string       `json:"schedule"`
+	ScheduledAt time.Time    `json:"scheduled_at"`
+	Status      string       `json:"status"`
+	Error       string       `json:"error,omitempty"`
+	Result      *matchResult `json:"result,omitempty"`
+}
+
+// readDaemonSchedule reads and validates the schedule at path.
+func readDaemonSchedule(path string) (*daemonSchedule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open schedule: %w", err)
+	}
+	defer file.Close()
+
+	schedule := &daemonSchedule{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(schedule); err != nil {
+		return nil, fmt.Errorf("failed to decode schedule %s: %w", path, err)
+	}
+	if len(schedule.Schedules) == 0 {
+		return nil, fmt.Errorf("no schedule in %s", path)
+	}
+
+	dir := filepath.Dir(path)
+	names := make(map[string]bool, len(schedule.Schedules))
+	for i, entry := range schedule.Schedules {
+		if entry.Name == "" || entry.Partner == "" || entry.MatchID == "" || len(entry.Files) == 0 {
+			return nil, fmt.Errorf("schedule %d of %s requires a name, a partner, a match_id and files", i+1, path)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("duplicate schedule name %s in %s", entry.Name, path)
+		}
+		names[entry.Name] = true
+
+		if entry.schedule, err = cron.ParseStandard(entry.Cron); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q of schedule %s: %w", entry.Cron, entry.Name, err)
+		}
+		for j, file := range entry.Files {
+			if file == stdinPath {
+				return nil, fmt.Errorf("schedule %s cannot read identifiers from stdin", entry.Name)
+			}
+			if !filepath.IsAbs(file) {
+				entry.Files[j] = filepath.Join(dir, file)
+			}
+		}
+		if len(entry.Protocols) > 0 {
+			if _, err := parsePSIProtocols(entry.Protocols); err != nil {
+				return nil, fmt.Errorf("schedule %s: %w", entry.Name, err)
+			}
+		}
+	}
+	return schedule, nil
+}
+
+// missedRun returns the last time the schedule was due after last and up
+// to now, or the zero time when it was not due.
+func missedRun(schedule cron.Schedule, last, now time.Time) time.Time {
+	var missed time.Time
+	for next := schedule.Next(last); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		missed = next
+	}
+	return missed
+}
+
+// stateStore persists the daemon state to a file, replaced atomically on
+// every change.
+type stateStore struct {
+	path string
+
+	mu    sync.Mutex
+	state daemonState
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	s := &stateStore{path: path, state: daemonState{Schedules: make(map[string]*scheduleState)}}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(content, &s.state); err != nil {
+		return nil, fmt.Errorf("failed to decode state file %s: %w", path, err)
+	}
+	if s.state.Schedules == nil {
+		s.state.Schedules = make(map[string]*scheduleState)
+	}
+	return s, nil
+}
+
+// get returns a copy of the state of the schedule, or nil.
+func (s *stateStore) get(name string) *scheduleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state := s.state.Schedules[name]; state != nil {
+		copied := *state
+		return &copied
+	}
+	return nil
+}
+
+// set saves the state of the schedule.
+func (s *stateStore) set(name string, state *scheduleState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *state
+	s.state.Schedules[name] = &copied
+
+	content, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	return replaceFile(s.path, content)
+}
+
+// runScheduled runs the match of the schedule due at scheduledAt, unless it
+// already started, recording it as running beforehand so that a restart
+// doesn't run it again.
+func (d *DaemonCmd) runScheduled(ctx context.Context, cli *CliContext, store *stateStore, entry *scheduleEntry, scheduledAt time.Time) (*daemonRun, error) {
+	if last := store.get(entry.Name); last != nil && !last.ScheduledAt.Before(scheduledAt) {
+		info(ctx).Msgf("run due at %v already %s, skipping", scheduledAt, last.Status)
+		return nil, nil
+	}
+	return d.start(ctx, cli, store, entry, &scheduleState{ScheduledAt: scheduledAt, StartedAt: time.Now().UTC()})
+}
+
+// resumeInterrupted resumes the last run of the schedule when the daemon
+// stopped or crashed before it was done. A run interrupted before it was
+// journaled had not contacted the partner yet, and is run again.
+func (d *DaemonCmd) resumeInterrupted(ctx context.Context, cli *CliContext, store *stateStore, entry *scheduleEntry) (*daemonRun, error) {
+	last := store.get(entry.Name)
+	if last == nil || (last.Status != "interrupted" && last.Status != "running") {
+		return nil, nil
+	}
+	info(ctx).Msgf("resuming the run due at %v, %s when the daemon stopped", last.ScheduledAt, last.Status)
+	last.Error = ""
+	return d.start(ctx, cli, store, entry, last)
+}
+
+// start runs the match of the schedule, or resumes it from the journal of
+// state.RunID, and saves its outcome in state. A run cut short because ctx
+// is done is saved as interrupted, to be resumed on restart.
+func (d *DaemonCmd) start(ctx context.Context, cli *CliContext, store *stateStore, entry *scheduleEntry, state *scheduleState) (*daemonRun, error) {
+	state.Status = "running"
+	if err := store.set(entry.Name, state); err != nil {
+		return nil, err
+	}
+
+	runCli := &CliContext{ctx: ctx, config: cli.config, configPath: cli.configPath}
+	var (
+		result *matchResult
+		err    error
+	)
+	if state.RunID != "" {
+		result, err = (&MatchResumeCmd{RunID: state.RunID}).resume(runCli)
+	} else {
+		protocols := d.Protocols
+		if len(entry.Protocols) > 0 {
+			protocols = entry.Protocols
+		}
+		m := &MatchRunCmd{
+			Partner:     entry.Partner,
+			InitTimeout: d.InitTimeout,
+			RunTimeout:  d.RunTimeout,
+			MatchID:     entry.MatchID,
+			Files:       entry.Files,
+			Protocols:   protocols,
+			InputFlags:  d.InputFlags,
+			PollFlags:   d.PollFlags,
+			journaled: func(journal *runJournal) {
+				state.RunID = journal.ID
+				if err := store.set(entry.Name, state); err != nil {
+					zerolog.Ctx(ctx).Error().Err(err).Msg("failed to save the daemon state")
+				}
+			},
+		}
+		result, err = m.run(runCli)
+	}
+
+	run := &daemonRun{Schedule: entry.Name, ScheduledAt: state.ScheduledAt, Status: "completed", Result: result}
+	state.Status = "completed"
+	switch {
+	case err != nil && ctx.Err() != nil:
+		run.Status, run.Error = "interrupted", err.Error()
+		state.Status, state.Error = "interrupted", err.Error()
+	case err != nil:
+		run.Status, run.Error = "failed", err.Error()
+		state.Status, state.Error = "failed", err.Error()
+	default:
+		state.MatchResultID = result.Id
+	}
+	state.FinishedAt = time.Now().UTC()
+	return run, store.set(entry.Name, state)
+}
+
+// runSchedule runs the schedule until ctx is done, taking one of the slots
+// for each run. A run interrupted by the last stop of the daemon is resumed
+// first, then the last missed run is caught up when the schedule ran
+// before, and runs never overlap: a run that outlasts the interval skips
+// the runs due meanwhile.
+func (d *DaemonCmd) runSchedule(ctx context.Context, cli *CliContext, store *stateStore, entry *scheduleEntry, slots chan struct{}) {
+	runOnce := func(due string, fn func() (*daemonRun, error)) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		run, err := fn()
+		<-slots
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to save the daemon state")
+		}
+		if run == nil {
+			return
+		}
+		if run.Error != "" {
+			info(ctx).Msgf("run due at %s %s: %s", due, run.Status, run.Error)
+		}
+		if err := printJson(run); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to print run")
+		}
+	}
+	runScheduled := func(scheduledAt time.Time) {
+		runOnce(scheduledAt.String(), func() (*daemonRun, error) {
+			return d.runScheduled(ctx, cli, store, entry, scheduledAt)
+		})
+	}
+
+	if last := store.get(entry.Name); last != nil {
+		runOnce(last.ScheduledAt.String(), func() (*daemonRun, error) {
+			return d.resumeInterrupted(ctx, cli, store, entry)
+		})
+	}
+	if last := store.get(entry.Name); last != nil && ctx.Err() == nil {
+		if missed := missedRun(entry.schedule, last.ScheduledAt, time.Now()); !missed.IsZero() {
+			info(ctx).Msgf("catching up the run due at %v", missed)
+			runScheduled(missed)
+		}
+	}
+
+	for {
+		next := entry.schedule.Next(time.Now())
+		if next.IsZero() {
+			info(ctx).Msg("no next run")
+			return
+		}
+		debug(ctx).Msgf("next run at %v", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			runScheduled(next)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Run runs the matches of the schedule on their cron expressions until
+// interrupted, at most --concurrency at a time, printing the outcome of
+// every run.
+func (d *DaemonCmd) Run(cli *CliContext) error {
+	ctx, stop := signal.NotifyContext(withInfoLogger(cli.ctx), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if d.Concurrency <= 0 {
+		return fmt.Errorf("--concurrency must be positive")
+	}
+	if _, err := parsePSIProtocols(d.Protocols); err != nil {
+		return err
+	}
+	schedule, err := readDaemonSchedule(d.Schedule)
+	if err != nil {
+		return err
+	}
+
+	statePath := d.State
+	if statePath == "" {
+		statePath = strings.TrimSuffix(d.Schedule, filepath.Ext(d.Schedule)) + ".state.json"
+	}
+	store, err := openStateStore(statePath)
+	if err != nil {
+		return err
+	}
+	info(ctx).Msgf("running %d schedules, with the state in %s", len(schedule.Schedules), statePath)
+
+	slots := make(chan struct{}, d.Concurrency)
+	var wg sync.WaitGroup
+	for _, entry := range schedule.Schedules {
+		wg.Add(1)
+		go func(entry *scheduleEntry) {
+			defer wg.Done()
+			logger := zerolog.Ctx(ctx).With().Str("schedule", entry.Name).Logger()
+			d.runSchedule(logger.WithContext(ctx), cli, store, entry, slots)
+		}(entry)
+	}
+	wg.Wait()
+
+	info(ctx).Msg("daemon stopped")
+	return nil
+}
@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/dcntest"
+
+	"github.com/robfig/cron/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestReadDaemonSchedule(t *testing.T) {
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		schedule string
+		err      string
+	}{
+		"schedule.yaml":  {schedule: "schedules:\n  - {name: weekly, cron: '0 3 * * MON', partner: acme, match_id: m1, files: [a.txt]}\n"},
+		"cron.yaml":      {schedule: "schedules:\n  - {name: weekly, cron: 'every monday', partner: acme, match_id: m1, files: [a.txt]}\n", err: "invalid cron expression"},
+		"duplicate.yaml": {schedule: "schedules:\n  - {name: weekly, cron: '@weekly', partner: acme, match_id: m1, files: [a.txt]}\n  - {name: weekly, cron: '@daily', partner: acme, match_id: m2, files: [a.txt]}\n", err: "duplicate schedule name weekly"},
+		"name.yaml":      {schedule: "schedules:\n  - {cron: '@weekly', partner: acme, match_id: m1, files: [a.txt]}\n", err: "requires a name"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(tc.schedule), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			schedule, err := readDaemonSchedule(path)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("want %q in error, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := schedule.Schedules[0]
+			if entry.Partner != "acme" || entry.MatchID != "m1" || entry.Files[0] != filepath.Join(dir, "a.txt") || entry.schedule == nil {
+				t.Fatalf("unexpected schedule %+v", entry)
+			}
+		})
+	}
+}
+
+func TestMissedRun(t *testing.T) {
+	hourly, err := cron.ParseStandard("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{last.Add(30 * time.Minute), time.Time{}},
+		{last.Add(time.Hour), last.Add(time.Hour)},
+		{last.Add(150 * time.Minute), last.Add(2 * time.Hour)},
+	} {
+		if missed := missedRun(hourly, last, tc.now); !missed.Equal(tc.want) {
+			t.Fatalf("want %v missed at %v, got %v", tc.want, tc.now, missed)
+		}
+	}
+}
+
+func TestRunScheduled(t *testing.T) {
+	dcn := dcntest.NewServer(testIdentifiers(40, 200))
+	defer dcn.Close()
+	cli := newTestCli(t)
+	run := newTestMatch(t, cli, dcn)
+
+	d := &DaemonCmd{InitTimeout: time.Minute, RunTimeout: time.Minute, Protocols: []string{"dhpsi"}, InputFlags: run.InputFlags}
+	entry := &scheduleEntry{Name: "hourly", batchEntry: batchEntry{Partner: run.Partner, MatchID: run.MatchID, Files: run.Files}}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	store, err := openStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduledAt := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	res, err := d.runScheduled(context.Background(), cli, store, entry, scheduledAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "completed" {
+		t.Fatalf("want a completed run, got %+v", res)
+	}
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), res.Result.Results)
+
+	// a restarted daemon doesn't run it again
+	store, err = openStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := store.get("hourly")
+	if state == nil || state.Status != "completed" || !state.ScheduledAt.Equal(scheduledAt) || state.MatchResultID != res.Result.Id {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if res, err := d.runScheduled(context.Background(), cli, store, entry, scheduledAt); res != nil || err != nil {
+		t.Fatalf("want the run to be skipped, got %+v, %v", res, err)
+	}
+
+	// nor a run interrupted while running
+	if err := store.set("hourly", &scheduleState{ScheduledAt: scheduledAt.Add(time.Hour), Status: "running"}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := d.runScheduled(context.Background(), cli, store, entry, scheduledAt.Add(time.Hour)); res != nil || err != nil {
+		t.Fatalf("want the interrupted run to be skipped, got %+v, %v", res, err)
+	}
+
+	entry.Files = []string{filepath.Join(t.TempDir(), "missing.txt")}
+	res, err = d.runScheduled(context.Background(), cli, store, entry, scheduledAt.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "failed" || store.get("hourly").Status != "failed" {
+		t.Fatalf("want a failed run, got %+v", res)
+	}
+}
+
+func TestResumeInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+	dcn.Intercept = func(path string, req proto.Message) (proto.Message, error) {
+		// the daemon stops once PSI completed
+		if path == dcntest.PathGetResult && ctx.Err() == nil {
+			cancel()
+			return nil, dcntest.Error(http.StatusServiceUnavailable, "temporarily unavailable")
+		}
+		return nil, nil
+	}
+	dcn.Start()
+	defer dcn.Close()
+	cli := newTestCli(t)
+	run := newTestMatch(t, cli, dcn)
+
+	d := &DaemonCmd{InitTimeout: time.Minute, RunTimeout: time.Minute, Protocols: []string{"dhpsi"}, InputFlags: run.InputFlags}
+	entry := &scheduleEntry{Name: "hourly", batchEntry: batchEntry{Partner: run.Partner, MatchID: run.MatchID, Files: run.Files}}
+	store, err := openStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduledAt := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	res, err := d.runScheduled(ctx, cli, store, entry, scheduledAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := store.get("hourly")
+	if res.Status != "interrupted" || state.Status != "interrupted" || state.RunID == "" {
+		t.Fatalf("want an interrupted run with its journal, got %+v and state %+v", res, state)
+	}
+
+	// the restarted daemon resumes the run after PSI
+	runCalls := dcn.Calls(dcntest.PathRunMatch)
+	res, err = d.resumeInterrupted(context.Background(), cli, store, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res == nil || res.Status != "completed" || !res.ScheduledAt.Equal(scheduledAt) {
+		t.Fatalf("want the interrupted run to be completed, got %+v", res)
+	}
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), res.Result.Results)
+	if calls := dcn.Calls(dcntest.PathRunMatch); calls != runCalls {
+		t.Fatal("want the run to be resumed after PSI, not run again")
+	}
+	if resumed := store.get("hourly"); resumed.Status != "completed" || resumed.RunID != state.RunID {
+		t.Fatalf("unexpected state %+v", resumed)
+	}
+
+	// a completed run is not resumed
+	if res, err := d.resumeInterrupted(context.Background(), cli, store, entry); res != nil || err != nil {
+		t.Fatalf("want nothing to resume, got %+v, %v", res, err)
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	dcn := dcntest.NewServer(testIdentifiers(40, 200))
+	defer dcn.Close()
+	cli := newTestCli(t)
+	run := newTestMatch(t, cli, dcn)
+
+	d := &DaemonCmd{InitTimeout: time.Minute, RunTimeout: time.Minute, Protocols: []string{"dhpsi"}, InputFlags: run.InputFlags}
+	every, err := cron.ParseStandard("@every 1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &scheduleEntry{Name: "often", batchEntry: batchEntry{Partner: run.Partner, MatchID: run.MatchID, Files: run.Files}, schedule: every}
+	store, err := openStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		d.runSchedule(ctx, cli, store, entry, make(chan struct{}, 1))
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for state := store.get("often"); state == nil || state.Status != "completed"; state = store.get("often") {
+		if time.Now().After(deadline) {
+			t.Fatalf("want a completed run, got %+v", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+}
@@ -0,0 +1,165 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/util"
+)
+
+type MatchHistoryCmd struct {
+	Partner string `arg:"" optional:"" help:"Name of the partner, defaults to all partners"`
+	Since   string `help:"Only list the runs started since a date (2006-01-02), a time (RFC 3339) or a duration ago (24h)"`
+	Output  string `default:"json" enum:"json,table" help:"Output format of the history: json or table"`
+}
+
+// historyEntry is a run of the local history, read from its journal.
+type historyEntry struct {
+	Time          time.Time          `json:"time"`
+	ID            string             `json:"id"`
+	Version       string             `json:"version"`
+	Partner       string             `json:"partner"`
+	MatchID       string             `json:"match_id"`
+	MatchResultID string             `json:"match_result_id,omitempty"`
+	Files         []string           `json:"files"`
+	Fingerprint   string             `json:"fingerprint"`
+	Protocol      string             `json:"protocol,omitempty"`
+	Phase         string             `json:"phase"`
+	Error         string             `json:"error,omitempty"`
+	Durations     map[string]float64 `json:"durations_seconds"`
+	Source        *v1.Insights       `json:"source"`
+	Results       *v1.Insights       `json:"results,omitempty"`
+}
+
+// parseSince parses a date, a time or a duration before now.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, want a date, a RFC 3339 time or a duration", since)
+}
+
+// readHistory reads the journals of the runs started at or after since,
+// with the partner unless empty, oldest first. Journals that cannot be read,
+// such as ones truncated by a crash, are logged and skipped.
+func readHistory(cli *CliContext, partner string, since time.Time) ([]*historyEntry, error) {
+	files, err := os.ReadDir(runsDir(cli))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run journals: %w", err)
+	}
+
+	var history []*historyEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		journal, err := readRunJournal(cli, strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			warn(cli.ctx).Err(err).Msgf("skipping invalid run journal %s", file.Name())
+			continue
+		}
+		if (partner != "" && journal.Run.Partner != partner) || journal.CreatedAt.Before(since) {
+			continue
+		}
+
+		entry := &historyEntry{
+			Time:          journal.CreatedAt,
+			ID:            journal.ID,
+			Version:       journal.Version,
+			Partner:       journal.Run.Partner,
+			MatchID:       journal.Run.MatchID,
+			MatchResultID: journal.MatchResultID,
+			Files:         journal.Run.Files,
+			Fingerprint:   journal.Fingerprint,
+			Protocol:      journal.Protocol,
+			Phase:         journal.Phase,
+			Error:         journal.Error,
+			Durations:     journal.Durations,
+			Source:        journal.Source,
+		}
+		if journal.Result != nil {
+			entry.Results = journal.Result.Results
+		}
+		history = append(history, entry)
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Time.Before(history[j].Time)
+	})
+	return history, nil
+}
+
+// Run prints the local history of the match runs, oldest first.
+func (m *MatchHistoryCmd) Run(cli *CliContext) error {
+	var since time.Time
+	if m.Since != "" {
+		var err error
+		if since, err = parseSince(m.Since, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	history, err := readHistory(cli, m.Partner, since)
+	if err != nil {
+		return err
+	}
+
+	if m.Output == "table" {
+		return printHistoryTable(history)
+	}
+	for _, entry := range history {
+		if err := printJson(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insightsTotal returns the number of identifiers of all types of the
+// insights, 0 when there are none.
+func insightsTotal(insights *v1.Insights) int64 {
+	var total int64
+	if insights == nil {
+		return total
+	}
+	for _, idType := range util.IdentifierTypes.Types() {
+		total += *idType.Counter(insights)
+	}
+	return total
+}
+
+func printHistoryTable(history []*historyEntry) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TIME\tRUN\tPARTNER\tMATCH\tPHASE\tPROTOCOL\tSENT\tMATCHED\tDURATION\t\n")
+	for _, entry := range history {
+		sent, matched := "-", "-"
+		if entry.Source != nil {
+			sent = fmt.Sprint(insightsTotal(entry.Source))
+		}
+		if entry.Results != nil {
+			matched = fmt.Sprint(insightsTotal(entry.Results))
+		}
+		var seconds float64
+		for _, d := range entry.Durations {
+			seconds += d
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%v\t\n",
+			entry.Time.Format(time.RFC3339), entry.ID, entry.Partner, entry.MatchID, entry.Phase, entry.Protocol,
+			sent, matched, time.Duration(seconds*float64(time.Second)).Round(time.Millisecond))
+	}
+	return w.Flush()
+}
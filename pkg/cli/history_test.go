@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/dcntest"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	for since, want := range map[string]time.Time{
+		"24h":                  now.Add(-24 * time.Hour),
+		"2021-05-01T08:00:00Z": time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC),
+		"2021-05-01":           time.Date(2021, 5, 1, 0, 0, 0, 0, time.Local),
+	} {
+		got, err := parseSince(since, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("want %v since %q, got %v", want, since, got)
+		}
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Fatal("want an invalid since to fail")
+	}
+}
+
+func TestReadHistory(t *testing.T) {
+	dcn := dcntest.NewServer(testIdentifiers(40, 200))
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	run := newTestMatch(t, cli, dcn)
+	for i := 0; i < 2; i++ {
+		if _, err := run.run(cli); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a journal truncated by a crash is skipped
+	if err := os.WriteFile(filepath.Join(runsDir(cli), "truncated.json"), []byte(`{"id": "trunc`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := readHistory(cli, run.Partner, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Time.After(history[1].Time) {
+		t.Fatalf("want 2 runs, oldest first, got %+v", history)
+	}
+
+	entry := history[1]
+	uniqueIdentifiers, _, err := loadUniqueIdentifiers(cli.ctx, run.Files, &run.InputFlags, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uniqueIdentifiers.Close()
+	if entry.Phase != phaseCompleted || entry.Protocol != "dhpsi" || entry.Version != version || entry.Fingerprint != uniqueIdentifiers.Fingerprint() {
+		t.Fatalf("unexpected history entry %+v", entry)
+	}
+	for _, phase := range []string{phaseEndpoint, phaseSent, phaseCompleted} {
+		if _, found := entry.Durations[phase]; !found {
+			t.Fatalf("want the duration of phase %s, got %v", phase, entry.Durations)
+		}
+	}
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(0, 100)), entry.Source)
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), entry.Results)
+
+	if history, err := readHistory(cli, "unknown", time.Time{}); err != nil || len(history) != 0 {
+		t.Fatalf("want no run of an unknown partner, got %+v, %v", history, err)
+	}
+	if history, err := readHistory(cli, "", time.Now().Add(time.Hour)); err != nil || len(history) != 0 {
+		t.Fatalf("want no run since a later time, got %+v, %v", history, err)
+	}
+}
+
+func TestPrintHistoryTableWithoutInsights(t *testing.T) {
+	if total := insightsTotal(nil); total != 0 {
+		t.Fatalf("want 0 identifiers without insights, got %d", total)
+	}
+	// a journal written before the identifiers were loaded has no source
+	history := []*historyEntry{{ID: "run", Partner: "partner", Phase: phaseStarted}}
+	if err := printHistoryTable(history); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,290 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/optable/match-cli/internal/util"
+)
+
+// stdinPath is the input path that reads identifiers from stdin.
+const stdinPath = "-"
+
+// InputFlags are the flags controlling how identifiers are read from the
+// input files and deduplicated.
+type InputFlags struct {
+	Format    string   `default:"text" enum:"text,csv,tsv,jsonl,parquet" help:"Format of the input files: prefixed identifiers per line (text), delimited records (csv, tsv), JSON Lines (jsonl) or Parquet (parquet)"`
+	Columns   []string `name:"column" placeholder:"COLUMN=PREFIX" help:"Map a csv or tsv column (by header name or 1-based index), a jsonl field path or a parquet column path to an identifier type prefix, e.g. email_sha256=e. Repeatable"`
+	Normalize bool     `help:"Normalize raw identifiers before matching: hash emails, format phone numbers as E.164 and hash them, and canonicalize IP addresses"`
+	Region    string   `default:"US" help:"Default region of phone numbers without an international calling code, used with --normalize"`
+	MaxMemory int64    `default:"512" help:"Maximum memory in MiB used to deduplicate identifiers before spilling to disk"`
+	TempDir   string   `type:"existingdir" help:"Directory used to spill identifiers to disk, defaults to the system temporary directory"`
+	IdTypeFlags
+}
+
+// IdTypeFlags are the flags selecting the identifier types to match.
+type IdTypeFlags struct {
+	IdTypes        []string `placeholder:"TYPE" help:"Identifier types to match, by prefix or name, e.g. e,a,g. Defaults to all types"`
+	ExcludeIdTypes []string `placeholder:"TYPE" help:"Identifier types to exclude from the match, by prefix or name"`
+}
+
+// selected returns the identifier types selected by the flags.
+func (f *IdTypeFlags) selected() ([]*util.IdentifierType, error) {
+	return util.IdentifierTypes.Select(f.IdTypes, f.ExcludeIdTypes)
+}
+
+// filter wraps ir to drop the identifiers of the types not selected, when
+// only some are.
+func (f *IdTypeFlags) filter(ir util.IdentifierReader) (util.IdentifierReader, error) {
+	if len(f.IdTypes) == 0 && len(f.ExcludeIdTypes) == 0 {
+		return ir, nil
+	}
+	types, err := f.selected()
+	if err != nil {
+		return nil, err
+	}
+	return util.NewTypeFilterReader(ir, types), nil
+}
+
+// normalize wraps ir to normalize raw identifiers when requested, rejecting
+// the ones that cannot be normalized in report when not nil.
+func (f *InputFlags) normalize(ir util.IdentifierReader, report *util.ValidationReport, file string) (util.IdentifierReader, error) {
+	if !f.Normalize {
+		return ir, nil
+	}
+	if !util.ValidRegion(f.Region) {
+		return nil, fmt.Errorf("unsupported phone number region %s", f.Region)
+	}
+	return util.NewNormalizingReader(ir, f.Region, report, file), nil
+}
+
+// newIdentifierReader returns the reader decoding r according to the
+// input format. Parquet inputs are read from files with newParquetReader.
+func (f *InputFlags) newIdentifierReader(r io.Reader) (util.IdentifierReader, error) {
+	switch f.Format {
+	case "csv", "tsv":
+		columns, err := util.ParseColumnMapping(f.Columns)
+		if err != nil {
+			return nil, err
+		}
+		comma := ','
+		if f.Format == "tsv" {
+			comma = '\t'
+		}
+		return util.NewCSVReader(r, comma, columns), nil
+	case "jsonl":
+		fields, err := util.ParseColumnMapping(f.Columns)
+		if err != nil {
+			return nil, err
+		}
+		return util.NewJSONLinesReader(r, fields), nil
+	default:
+		if len(f.Columns) > 0 {
+			return nil, fmt.Errorf("column mappings require the csv, tsv, jsonl or parquet format")
+		}
+		return util.NewTextReader(r), nil
+	}
+}
+
+// newParquetReader returns the reader over the mapped columns of a parquet
+// file, which must be seekable and therefore cannot be read from stdin.
+func (f *InputFlags) newParquetReader(file *os.File) (util.IdentifierReader, error) {
+	columns, err := util.ParseColumnMapping(f.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("parquet input must be a regular file")
+	}
+	return util.NewParquetReader(file, stat.Size(), columns)
+}
+
+// inputCount is the number of identifiers read from a single input.
+type inputCount struct {
+	path  string
+	count int64
+}
+
+func (c inputCount) String() string {
+	return fmt.Sprintf("%s: %d", c.path, c.count)
+}
+
+// expandInputPaths resolves the glob patterns in paths to the list of input
+// files, in order and without duplicates. A pattern that matches no file is
+// an error.
+func expandInputPaths(paths []string) ([]string, error) {
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		matches := []string{path}
+		if path != stdinPath && strings.ContainsAny(path, "*?[") {
+			var err error
+			matches, err = filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob pattern %s: %w", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no file matches %s", path)
+			}
+		}
+
+		for _, match := range matches {
+			if seen[match] {
+				if match == stdinPath {
+					return nil, fmt.Errorf("stdin can only be read once")
+				}
+				continue
+			}
+			seen[match] = true
+			expanded = append(expanded, match)
+		}
+	}
+	return expanded, nil
+}
+
+// openInput opens an input path, where stdinPath reads from stdin.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == stdinPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(filepath.Clean(path))
+}
+
+func inputName(path string) string {
+	if path == stdinPath {
+		return "stdin"
+	}
+	return path
+}
+
+// loadUniqueIdentifiers reads and deduplicates the identifiers of all the
+// inputs matched by paths, validated into report when not nil. Invalid
+// identifiers are dropped when reject is set, and otherwise kept as they
+// were read, with a warning counting them per reason. The caller is
+// responsible for closing the returned identifiers.
+func loadUniqueIdentifiers(ctx context.Context, paths []string, flags *InputFlags, report *util.ValidationReport, reject bool) (*util.UniqueIdentifiers, []inputCount, error) {
+	inputs, err := expandInputPaths(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := flags.selected(); err != nil {
+		return nil, nil, err
+	}
+	if report == nil {
+		report = util.NewValidationReport()
+	}
+
+	uniqueIdentifiers, err := util.NewUniqueIdentifiers(flags.MaxMemory<<20, flags.TempDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare identifiers deduplication: %w", err)
+	}
+
+	counts := make([]inputCount, 0, len(inputs))
+	for _, path := range inputs {
+		n, err := addInput(uniqueIdentifiers, path, flags, report, reject)
+		if err != nil {
+			uniqueIdentifiers.Close()
+			return nil, nil, fmt.Errorf("failed to load unique identifiers in file %s : %w", inputName(path), err)
+		}
+		debug(ctx).Msgf("read %d identifiers from %s", n, inputName(path))
+		counts = append(counts, inputCount{path: inputName(path), count: n})
+	}
+
+	if err := uniqueIdentifiers.Finalize(); err != nil {
+		uniqueIdentifiers.Close()
+		return nil, nil, fmt.Errorf("failed to deduplicate identifiers: %w", err)
+	}
+	if reject {
+		report.SetUniqueInsights(uniqueIdentifiers.Insights())
+	} else {
+		warnRejected(ctx, report)
+	}
+
+	return uniqueIdentifiers, counts, nil
+}
+
+// warnRejected warns about the invalid identifiers kept in the inputs, per
+// identifier type and reason.
+func warnRejected(ctx context.Context, report *util.ValidationReport) {
+	names := make([]string, 0, len(report.Types))
+	for name := range report.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		reasons := make([]string, 0, len(report.Types[name].Reasons))
+		for reason := range report.Types[name].Reasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+
+		for _, reason := range reasons {
+			warn(ctx).Msgf("%d invalid %s identifiers (%s) are matched as is, run match validate for details",
+				report.Types[name].Reasons[reason].Count, name, reason)
+		}
+	}
+}
+
+func addInput(uniqueIdentifiers *util.UniqueIdentifiers, path string, flags *InputFlags, report *util.ValidationReport, reject bool) (int64, error) {
+	var n int64
+	err := readInput(path, flags, report, reject, func(ir util.IdentifierReader) error {
+		var err error
+		n, err = uniqueIdentifiers.AddFrom(ir)
+		return err
+	})
+	return n, err
+}
+
+// readInput opens the input at path and calls fn with the reader of its
+// identifiers, decoded, filtered and normalized according to flags, and
+// validated into report. Invalid identifiers are dropped when reject is set.
+func readInput(path string, flags *InputFlags, report *util.ValidationReport, reject bool, fn func(util.IdentifierReader) error) error {
+	r, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var ir util.IdentifierReader
+	if flags.Format == "parquet" {
+		file, ok := r.(*os.File)
+		if !ok {
+			return fmt.Errorf("parquet input cannot be read from stdin")
+		}
+		if ir, err = flags.newParquetReader(file); err != nil {
+			return err
+		}
+	} else {
+		dr, err := util.NewDecompressReader(r)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+
+		if ir, err = flags.newIdentifierReader(dr); err != nil {
+			return err
+		}
+	}
+
+	if ir, err = flags.filter(ir); err != nil {
+		return err
+	}
+	if ir, err = flags.normalize(ir, report, inputName(path)); err != nil {
+		return err
+	}
+	if reject {
+		return fn(util.NewValidatingReader(ir, report, inputName(path)))
+	}
+	return fn(util.NewReportingReader(ir, report, inputName(path)))
+}
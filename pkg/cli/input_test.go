@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandInputPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.csv"} {
+		writeTestFile(t, dir, name, testIdentifiers(0, 1))
+	}
+	a, b, c := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt"), filepath.Join(dir, "c.csv")
+
+	for _, tc := range []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{"glob", []string{filepath.Join(dir, "*.txt")}, []string{a, b}},
+		{"files in order", []string{c, a}, []string{c, a}},
+		{"duplicates", []string{a, filepath.Join(dir, "*.txt"), a}, []string{a, b}},
+		{"stdin with files", []string{c, stdinPath, filepath.Join(dir, "?.txt")}, []string{c, stdinPath, a, b}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := expandInputPaths(tc.paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name  string
+		paths []string
+	}{
+		{"no match", []string{a, filepath.Join(dir, "*.parquet")}},
+		{"invalid glob", []string{filepath.Join(dir, "[.txt")}},
+		{"stdin twice", []string{stdinPath, a, stdinPath}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, err := expandInputPaths(tc.paths); err == nil {
+				t.Fatalf("want an error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestLoadUniqueIdentifiersStdin(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "file.txt", testIdentifiers(0, 60))
+	writeTestFile(t, dir, "stdin.txt", testIdentifiers(40, 100))
+
+	stdin, err := os.Open(filepath.Join(dir, "stdin.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	flags := &InputFlags{Format: "text", MaxMemory: 512}
+	uniqueIdentifiers, counts, err := loadUniqueIdentifiers(context.Background(), []string{filepath.Join(dir, "file.txt"), stdinPath}, flags, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uniqueIdentifiers.Close()
+
+	if uniqueIdentifiers.Len() != 100 {
+		t.Fatalf("want the 100 unique identifiers of the file and stdin, got %d", uniqueIdentifiers.Len())
+	}
+	want := []inputCount{{path: filepath.Join(dir, "file.txt"), count: 60}, {path: "stdin", count: 60}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("want counts %v, got %v", want, counts)
+	}
+}
@@ -0,0 +1,242 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match/pkg/psi"
+
+	"github.com/rs/zerolog"
+	"github.com/segmentio/ksuid"
+)
+
+type MatchResumeCmd struct {
+	RunID string `arg:"" required:"" help:"ID of the run, logged when it started"`
+}
+
+// Phases of a journaled run, in order. A run is resumable until it is
+// completed or failed.
+const (
+	// the identifiers are loaded, no endpoint was obtained yet
+	phaseStarted = "started"
+	// the endpoint of the match is obtained from /match/run
+	phaseEndpoint = "endpoint"
+	// PSI completed, the result is pending on the partner side
+	phaseSent = "sent"
+	// the result is obtained from /match/get-result
+	phaseCompleted = "completed"
+	// the partner reported an errored result
+	phaseFailed = "failed"
+)
+
+// runJournal is the progress of a match run, saved under the config
+// directory after every phase so that an interrupted run can be resumed
+// with match resume. Journals are kept as the local history of the runs.
+// Durations is the time spent reaching each phase, in seconds, summed over
+// the attempts and excluding the time the run was interrupted.
+type runJournal struct {
+	ID                   string               `json:"id"`
+	Version              string               `json:"version"`
+	Run                  *MatchRunCmd         `json:"run"`
+	Phase                string               `json:"phase"`
+	Phases               map[string]time.Time `json:"phases"`
+	Durations            map[string]float64   `json:"durations_seconds"`
+	Fingerprint          string               `json:"fingerprint"`
+	Source               *v1.Insights         `json:"source"`
+	Protocol             string               `json:"protocol,omitempty"`
+	MatchResultID        string               `json:"match_result_id,omitempty"`
+	Endpoint             string               `json:"endpoint,omitempty"`
+	ServerCertificatePem string               `json:"server_certificate_pem,omitempty"`
+	ClientCertificatePem string               `json:"client_certificate_pem,omitempty"`
+	Error                string               `json:"error,omitempty"`
+	Result               *matchResult         `json:"result,omitempty"`
+	CreatedAt            time.Time            `json:"created_at"`
+	UpdatedAt            time.Time            `json:"updated_at"`
+
+	path       string
+	phaseStart time.Time
+}
+
+// runsDir returns the directory of the run journals, next to the config.
+func runsDir(cli *CliContext) string {
+	return filepath.Join(filepath.Dir(cli.configPath), "runs")
+}
+
+// replaceFile replaces the file at path with content atomically, through a
+// temporary file renamed over it.
+func replaceFile(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// newRunJournal creates and saves the journal of a new run of m on the
+// unique identifiers. The file paths are made absolute so that the run can
+// be resumed from another directory.
+func newRunJournal(cli *CliContext, m *MatchRunCmd, uniqueIdentifiers *util.UniqueIdentifiers) (*runJournal, error) {
+	dir := runsDir(cli)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create run journal directory %s: %w", dir, err)
+	}
+
+	run := *m
+	run.Files = make([]string, len(m.Files))
+	for i, file := range m.Files {
+		run.Files[i] = file
+		if file == stdinPath {
+			continue
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path %s: %w", file, err)
+		}
+		run.Files[i] = abs
+	}
+
+	now := time.Now().UTC()
+	journal := &runJournal{
+		ID:          ksuid.New().String(),
+		Version:     version,
+		Run:         &run,
+		Phase:       phaseStarted,
+		Phases:      map[string]time.Time{phaseStarted: now},
+		Durations:   make(map[string]float64),
+		Fingerprint: uniqueIdentifiers.Fingerprint(),
+		Source:      uniqueIdentifiers.Insights(),
+		CreatedAt:   now,
+		phaseStart:  now,
+	}
+	journal.path = filepath.Join(dir, journal.ID+".json")
+	return journal, journal.save()
+}
+
+// readRunJournal reads the journal of the run.
+func readRunJournal(cli *CliContext, id string) (*runJournal, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid run id %q", id)
+	}
+	path := filepath.Join(runsDir(cli), id+".json")
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("run %s does not exist", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run journal %s: %w", path, err)
+	}
+
+	journal := &runJournal{}
+	if err := json.Unmarshal(content, journal); err != nil {
+		return nil, fmt.Errorf("failed to decode run journal %s: %w", path, err)
+	}
+	if journal.Run == nil || journal.Phases == nil {
+		return nil, fmt.Errorf("invalid run journal %s", path)
+	}
+	if journal.Durations == nil {
+		journal.Durations = make(map[string]float64)
+	}
+	journal.path = path
+	journal.phaseStart = time.Now().UTC()
+	return journal, nil
+}
+
+func (j *runJournal) save() error {
+	j.UpdatedAt = time.Now().UTC()
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run journal: %w", err)
+	}
+	return replaceFile(j.path, content)
+}
+
+// record saves the journal. Failing to save it only prevents resuming the
+// run, so the error is logged and the run goes on.
+func (j *runJournal) record(ctx context.Context) {
+	if err := j.save(); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("failed to save the journal of run %s", j.ID)
+	}
+}
+
+// advance records that the run reached phase, clearing the error of a
+// previous attempt. Reaching the started phase again means that an attempt
+// failed and that the run is retried.
+func (j *runJournal) advance(ctx context.Context, phase string) {
+	now := time.Now().UTC()
+	j.Phase = phase
+	j.Phases[phase] = now
+	j.Durations[phase] += now.Sub(j.phaseStart).Seconds()
+	j.phaseStart = now
+	j.Error = ""
+	j.record(ctx)
+}
+
+// Run resumes the run from its last completed phase and prints its
+// result.
+func (r *MatchResumeCmd) Run(cli *CliContext) error {
+	result, err := r.resume(cli)
+	if err != nil {
+		return err
+	}
+	return printJson(result)
+}
+
+// resume resumes the run from its last completed phase and returns its
+// result. The identifiers are read again, and must be unchanged, when PSI
+// did not complete.
+func (r *MatchResumeCmd) resume(cli *CliContext) (*matchResult, error) {
+	ctx := withInfoLogger(cli.ctx)
+
+	journal, err := readRunJournal(cli, r.RunID)
+	if err != nil {
+		return nil, err
+	}
+	switch journal.Phase {
+	case phaseCompleted:
+		info(ctx).Msgf("run %s already completed", journal.ID)
+		return journal.Result, nil
+	case phaseFailed:
+		return nil, fmt.Errorf("run %s failed: %s", journal.ID, journal.Error)
+	}
+
+	m := journal.Run
+	ctx, cancel := context.WithTimeout(ctx, m.RunTimeout)
+	defer cancel()
+	info(ctx).Msgf("resuming run %s of match %s from phase %s with a timeout of %v", journal.ID, m.MatchID, journal.Phase, m.RunTimeout)
+
+	var (
+		uniqueIdentifiers *util.UniqueIdentifiers
+		protocols         []psi.Protocol
+	)
+	if journal.Phase != phaseSent {
+		for _, file := range m.Files {
+			if file == stdinPath {
+				return nil, fmt.Errorf("run %s read identifiers from stdin and cannot be resumed before PSI completed", journal.ID)
+			}
+		}
+		if protocols, err = m.parseProtocols(); err != nil {
+			return nil, err
+		}
+
+		uniqueIdentifiers, _, err = loadUniqueIdentifiers(ctx, m.Files, &m.InputFlags, nil, m.Strict)
+		if err != nil {
+			return nil, err
+		}
+		defer uniqueIdentifiers.Close()
+
+		if uniqueIdentifiers.Fingerprint() != journal.Fingerprint {
+			return nil, fmt.Errorf("the identifiers of %v changed since run %s started", m.Files, journal.ID)
+		}
+	}
+
+	return m.resume(ctx, cli, journal, uniqueIdentifiers, protocols)
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/dcntest"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// lastRunJournal returns the journal of the last run.
+func lastRunJournal(t *testing.T, cli *CliContext) *runJournal {
+	t.Helper()
+	entries, err := os.ReadDir(runsDir(cli))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("want a run journal")
+	}
+	journal, err := readRunJournal(cli, strings.TrimSuffix(entries[len(entries)-1].Name(), ".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journal
+}
+
+func TestMatchResume(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		path  string
+		phase string
+	}{
+		{"started", dcntest.PathRunMatch, phaseStarted},
+		{"sent", dcntest.PathGetResult, phaseSent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var failing int32 = 1
+			dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+			dcn.Intercept = func(path string, req proto.Message) (proto.Message, error) {
+				if path == tc.path && atomic.LoadInt32(&failing) == 1 {
+					return nil, dcntest.Error(http.StatusServiceUnavailable, "unavailable")
+				}
+				return nil, nil
+			}
+			dcn.Start()
+			defer dcn.Close()
+			cli := newTestCli(t)
+
+			run := newTestMatch(t, cli, dcn)
+			if _, err := run.run(cli); err == nil {
+				t.Fatal("want the run to fail")
+			}
+			journal := lastRunJournal(t, cli)
+			if journal.Phase != tc.phase || journal.MatchResultID == "" || !strings.Contains(journal.Error, "unavailable") {
+				t.Fatalf("unexpected journal %+v", journal)
+			}
+
+			atomic.StoreInt32(&failing, 0)
+			result, err := (&MatchResumeCmd{RunID: journal.ID}).resume(cli)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Id != journal.MatchResultID {
+				t.Fatalf("want the result of match result %s, got %s", journal.MatchResultID, result.Id)
+			}
+			checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), result.Results)
+
+			journal = lastRunJournal(t, cli)
+			if journal.Phase != phaseCompleted || journal.Error != "" || journal.Result == nil {
+				t.Fatalf("want a completed journal, got %+v", journal)
+			}
+
+			// a completed run is not run again
+			calls := dcn.Calls(dcntest.PathGetResult)
+			if _, err := (&MatchResumeCmd{RunID: journal.ID}).resume(cli); err != nil {
+				t.Fatal(err)
+			}
+			if dcn.Calls(dcntest.PathGetResult) != calls {
+				t.Fatal("want the completed run to return its journaled result")
+			}
+		})
+	}
+}
+
+func TestMatchResumeErrors(t *testing.T) {
+	dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+	dcn.Intercept = func(path string, req proto.Message) (proto.Message, error) {
+		if path == dcntest.PathRunMatch {
+			return nil, dcntest.Error(http.StatusServiceUnavailable, "unavailable")
+		}
+		return nil, nil
+	}
+	dcn.Start()
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	run := newTestMatch(t, cli, dcn)
+	if _, err := run.run(cli); err == nil {
+		t.Fatal("want the run to fail")
+	}
+	journal := lastRunJournal(t, cli)
+
+	writeTestFile(t, filepath.Dir(run.Files[0]), filepath.Base(run.Files[0]), testIdentifiers(0, 50))
+	if _, err := (&MatchResumeCmd{RunID: journal.ID}).resume(cli); err == nil || !strings.Contains(err.Error(), "changed since run") {
+		t.Fatalf("want the changed identifiers to fail the resume, got %v", err)
+	}
+
+	for _, id := range []string{"unknown", "../config"} {
+		if _, err := (&MatchResumeCmd{RunID: id}).resume(cli); err == nil {
+			t.Fatalf("want resuming run %s to fail", id)
+		}
+	}
+}
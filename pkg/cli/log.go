@@ -45,6 +45,10 @@ func withInfoLogger(ctx context.Context) context.Context {
 	return logger.WithContext(ctx)
 }
 
+func warn(ctx context.Context) *zerolog.Event {
+	return zerolog.Ctx(ctx).Warn()
+}
+
 func info(ctx context.Context) *zerolog.Event {
 	return zerolog.Ctx(ctx).Info()
 }
@@ -3,15 +3,18 @@ package cli
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"os"
 	"sort"
 	"strings"
 	"time"
 
 	v1 "github.com/optable/match-api/match/v1"
 	"github.com/optable/match-cli/internal/auth"
+	"github.com/optable/match-cli/internal/client"
+	"github.com/optable/match-cli/internal/poll"
 	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/header"
 	"github.com/optable/match-cli/pkg/match"
 	"github.com/optable/match/pkg/psi"
 
@@ -21,8 +24,10 @@ import (
 
 type (
 	MatchCreateCmd struct {
-		Partner string `arg:"" required:"" help:"Name of the partner"`
-		Name    string `arg:"" required:"" help:"Name of the match"`
+		Partner          string `arg:"" required:"" help:"Name of the partner"`
+		Name             string `arg:"" required:"" help:"Name of the match"`
+		RefreshFrequency string `default:"adhoc" enum:"adhoc,daily,weekly,monthly" help:"Refresh frequency of the match (adhoc, daily, weekly, monthly)"`
+		IdTypeFlags
 	}
 
 	MatchListCmd struct {
@@ -39,8 +44,29 @@ type (
 		InitTimeout time.Duration `default:"10m" help:"Timeout for the initialization of the match"`
 		RunTimeout  time.Duration `default:"30m" help:"Timeout for the match operation"`
 		MatchID     string        `arg:"" required:"" help:"ID of the match"`
-		File        *os.File      `arg:"" required:"" help:"File to match"`
-		Protocol    string        `default:"dhpsi" enum:"kkrtpsi,dhpsi" help:"Preferred PSI protocol"`
+		Files       []string      `arg:"" required:"" help:"Files or glob patterns to match, use - to read from stdin"`
+		Protocols   []string      `help:"PSI protocols in order of preference (dhpsi, npsi, bpsi, kkrtpsi), dhpsi when not set. The match is retried with the next protocol when the selected one fails"`
+		Protocol    string        `hidden:"" help:"Preferred PSI protocol, deprecated in favor of --protocols"`
+		Strict      bool          `help:"Drop invalid identifiers, and fail before contacting the partner when the ratio of rejected identifiers exceeds --max-rejected. Without --strict, invalid identifiers are sent as is with a warning"`
+		MaxRejected float64       `default:"0" help:"Maximum ratio of rejected identifiers, between 0 and 1, tolerated with --strict"`
+		InputFlags
+		PollFlags
+
+		// journaled, when set, is called with the journal of the run once
+		// it is created.
+		journaled func(journal *runJournal)
+	}
+
+	// PollFlags are the flags of the polling of the match API.
+	PollFlags struct {
+		PollInterval    time.Duration `default:"5s" help:"Initial interval between the polls of the match API"`
+		PollMaxInterval time.Duration `default:"1m" help:"Maximum interval between the polls of the match API, reached with exponential backoff"`
+		PollRetries     int           `default:"5" help:"Maximum number of consecutive retries of the transient errors of the match API (429, 5xx and network errors) while polling"`
+	}
+
+	MatchValidateCmd struct {
+		Files []string `arg:"" required:"" help:"Files or glob patterns to validate, use - to read from stdin"`
+		InputFlags
 	}
 
 	MatchCmd struct {
@@ -48,6 +74,14 @@ type (
 		List       MatchListCmd       `cmd:"" help:"List matches"`
 		GetResults MatchGetResultsCmd `cmd:"" help:"Get match results"`
 		Run        MatchRunCmd        `cmd:"" help:"Run a match"`
+		RunBatch   MatchRunBatchCmd   `cmd:"" help:"Run the matches of a manifest concurrently and print a consolidated report"`
+		Resume     MatchResumeCmd     `cmd:"" help:"Resume an interrupted match run from its last completed phase"`
+		History    MatchHistoryCmd    `cmd:"" help:"List the local history of the match runs"`
+		Report     MatchReportCmd     `cmd:"" help:"Report the match rates of the results of a match and their changes"`
+		Validate   MatchValidateCmd   `cmd:"" help:"Validate the identifiers of match files and print a report"`
+		Receive    MatchReceiveCmd    `cmd:"" help:"Receive a match directly from a partner, without a DCN"`
+		Offer      MatchOfferCmd      `cmd:"" help:"Create a match offer to match directly with a peer partner, without a DCN. The offer expires after an hour"`
+		Send       MatchSendCmd       `cmd:"" help:"Send a match directly to a peer partner, without a DCN"`
 	}
 )
 
@@ -90,42 +124,64 @@ func matchResultFromProto(resultpb *v1.ExternalMatchResult) *matchResult {
 	return result
 }
 
+// setRefreshFrequency sets the refresh frequency of the match API named
+// frequency on req, adhoc when empty.
+func setRefreshFrequency(req *v1.CreateExternalMatchReq, frequency string) error {
+	switch strings.ToLower(frequency) {
+	case "", "adhoc":
+		req.RefreshFrequency = &v1.CreateExternalMatchReq_Adhoc{Adhoc: &v1.ExternalMatchRefreshAdhoc{}}
+	case "daily":
+		req.RefreshFrequency = &v1.CreateExternalMatchReq_Daily{Daily: &v1.ExternalMatchRefreshDaily{}}
+	case "weekly":
+		req.RefreshFrequency = &v1.CreateExternalMatchReq_Weekly{Weekly: &v1.ExternalMatchRefreshWeekly{}}
+	case "monthly":
+		req.RefreshFrequency = &v1.CreateExternalMatchReq_Monthly{Monthly: &v1.ExternalMatchRefreshMonthly{}}
+	default:
+		return fmt.Errorf("unsupported refresh frequency %s", frequency)
+	}
+	return nil
+}
+
 func (m *MatchCreateCmd) Run(cli *CliContext) error {
+	res, err := m.create(cli)
+	if err != nil {
+		return err
+	}
+	return printJson(res)
+}
+
+// create creates the match with the partner.
+func (m *MatchCreateCmd) create(cli *CliContext) (*v1.CreateExternalMatchRes, error) {
+	types, err := m.selected()
+	if err != nil {
+		return nil, err
+	}
+	identifiersFilter := make([]v1.IdKind, 0, len(types))
+	for _, t := range types {
+		identifiersFilter = append(identifiersFilter, t.Kind)
+	}
+
 	partner := cli.config.findPartner(m.Partner)
 	if partner == nil {
-		return fmt.Errorf("partner %s does not exist", m.Partner)
+		return nil, fmt.Errorf("partner %s does not exist", m.Partner)
 	}
 
 	client, err := partner.NewClient()
 	if err != nil {
-		return fmt.Errorf("failed to create client: %w", err)
-	}
-
-	allMatchableIdKind := make([]v1.IdKind, 0, len(v1.IdKind_name)-1)
-	for i, _ := range v1.IdKind_name {
-		// skip UNKNOWN IdKind
-		if v1.IdKind(i) == v1.IdKind_ID_KIND_UNKNOWN {
-			continue
-		}
-		allMatchableIdKind = append(allMatchableIdKind, v1.IdKind(i))
+		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
 	req := &v1.CreateExternalMatchReq{
 		MatchUid: ksuid.New().String(),
 		Name:     m.Name,
-		RefreshFrequency: &v1.CreateExternalMatchReq_Adhoc{
-			Adhoc: &v1.ExternalMatchRefreshAdhoc{},
-		},
-		// by default send all identifier types.
-		IdentifiersFilter: allMatchableIdKind,
+		// all identifier types unless restricted with --id-types or --exclude-id-types.
+		IdentifiersFilter: identifiersFilter,
 	}
-
-	res, err := client.CreateMatch(cli.ctx, req)
-	if err != nil {
-		return err
+	if err := setRefreshFrequency(req, m.RefreshFrequency); err != nil {
+		return nil, err
 	}
 
-	return printJson(res)
+	return client.CreateMatch(cli.ctx, req)
 }
 
 func (m *MatchGetResultsCmd) Run(cli *CliContext) error {
@@ -185,6 +241,19 @@ func (m *MatchListCmd) Run(cli *CliContext) error {
 	return nil
 }
 
+// Run validates the identifiers of the match files and prints the
+// validation report, without contacting the partner.
+func (m *MatchValidateCmd) Run(cli *CliContext) error {
+	report := util.NewValidationReport()
+	uniqueIdentifiers, _, err := loadUniqueIdentifiers(cli.ctx, m.Files, &m.InputFlags, report, true)
+	if err != nil {
+		return err
+	}
+	defer uniqueIdentifiers.Close()
+
+	return printJson(report)
+}
+
 func getTLSConfig(cert *auth.EphemerealCertificate, peerCertPem, hostport string) (*tls.Config, error) {
 	tlsCertificate, err := cert.GetTLSCertificate()
 	if err != nil {
@@ -207,138 +276,348 @@ func getTLSConfig(cert *auth.EphemerealCertificate, peerCertPem, hostport string
 	}, nil
 }
 
-func pollRunMatch(ctx context.Context, partner *PartnerConfig, matchUUID string, cert *auth.EphemerealCertificate) (*v1.RunExternalMatchRes, error) {
-	matchResultUUID := ksuid.New().String()
-	info(ctx).Msgf("generated match result id %s", matchResultUUID)
+// pollInterval is the initial interval between the polls of the match API
+// when --poll-interval is unset.
+var pollInterval = 5 * time.Second
+
+const (
+	// pollMultiplier is the growth of the interval between polls.
+	pollMultiplier = 1.5
+	// pollJitter spreads out the polls of concurrent runs.
+	pollJitter = 0.2
+)
+
+// policy returns the policy polling the match API with the flags, logging
+// the retries of transient errors.
+func (f *PollFlags) policy(ctx context.Context) *poll.Policy {
+	p := &poll.Policy{
+		Interval:    f.PollInterval,
+		MaxInterval: f.PollMaxInterval,
+		Multiplier:  pollMultiplier,
+		Jitter:      pollJitter,
+		MaxRetries:  f.PollRetries,
+		Retryable:   client.Retryable,
+		OnRetry: func(err error, wait time.Duration) {
+			info(ctx).Msgf("transient error, retrying in %v: %v", wait.Round(time.Millisecond), err)
+		},
+	}
+	if p.Interval <= 0 {
+		p.Interval = pollInterval
+	}
+	if p.MaxInterval < p.Interval {
+		p.MaxInterval = p.Interval
+	}
+	return p
+}
 
+func pollRunMatch(ctx context.Context, partner *PartnerConfig, matchUUID, matchResultUUID string, cert *auth.EphemerealCertificate, policy *poll.Policy) (*v1.RunExternalMatchRes, error) {
 	client, err := partner.NewClient()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
-	for {
+
+	var res *v1.RunExternalMatchRes
+	err = poll.Poll(ctx, policy, func(ctx context.Context) (bool, error) {
 		info(ctx).Msgf("still polling /match/run to get match endpoint")
-		res, err := client.RunMatch(ctx, &v1.RunExternalMatchReq{
+		var err error
+		res, err = client.RunMatch(ctx, &v1.RunExternalMatchReq{
 			MatchUid:             matchUUID,
 			MatchResultUid:       matchResultUUID,
 			ClientCertificatePem: string(cert.CertificatePem),
 		})
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-		if err == nil && res.Endpoint != "" {
-			info(ctx).Msgf("got match endpoint %s", res.Endpoint)
-			return res, nil
+		if res.Endpoint == "" {
+			debug(ctx).Msg("match endpoint not ready")
+			return false, nil
 		}
-		debug(ctx).Msg("match endpoint not ready, sleeping for 5 seconds")
-		time.Sleep(5 * time.Second)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	info(ctx).Msgf("got match endpoint %s", res.Endpoint)
+	return res, nil
 }
 
-func pollGetMatchResult(ctx context.Context, partner *PartnerConfig, matchResultUUID string) (*v1.ExternalMatchResult, error) {
+func pollGetMatchResult(ctx context.Context, partner *PartnerConfig, matchResultUUID string, policy *poll.Policy) (*v1.ExternalMatchResult, error) {
 	// Need to create new client because of token expiry
 	client, err := partner.NewClient()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
-	for {
+	var res *v1.GetExternalMatchResultRes
+	err = poll.Poll(ctx, policy, func(ctx context.Context) (bool, error) {
 		info(ctx).Msgf("still polling /match/get-result for results")
-		res, err := client.GetResult(ctx, &v1.GetExternalMatchResultReq{MatchResultUid: matchResultUUID})
+		var err error
+		res, err = client.GetResult(ctx, &v1.GetExternalMatchResultReq{MatchResultUid: matchResultUUID})
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-		if res.GetMatchResult().GetState() != v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_PENDING {
-			return res.MatchResult, nil
+		if res.GetMatchResult().GetState() == v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_PENDING {
+			debug(ctx).Msg("results not ready")
+			return false, nil
 		}
-		debug(ctx).Msg("results not ready, sleeping for 5 seconds")
-		time.Sleep(5 * time.Second)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return res.MatchResult, nil
 }
 
-func psiProtocolFromString(protocol string) psi.Protocol {
-	switch protocol {
-	case "kkrtpsi":
-		return psi.ProtocolKKRTPSI
-	case "dhpsi":
-		fallthrough
-	default:
-		return psi.ProtocolDHPSI
+// psiProtocols maps the names of the PSI protocols of the match library.
+var psiProtocols = map[string]psi.Protocol{
+	"dhpsi":   psi.ProtocolDHPSI,
+	"npsi":    psi.ProtocolNPSI,
+	"bpsi":    psi.ProtocolBPSI,
+	"kkrtpsi": psi.ProtocolKKRTPSI,
+}
+
+// parsePSIProtocols parses a list of PSI protocol names, keeping their order.
+func parsePSIProtocols(protocols []string) ([]psi.Protocol, error) {
+	parsed := make([]psi.Protocol, 0, len(protocols))
+	seen := make(map[psi.Protocol]bool, len(protocols))
+	for _, name := range protocols {
+		protocol, found := psiProtocols[strings.ToLower(strings.TrimSpace(name))]
+		if !found {
+			return nil, fmt.Errorf("unsupported PSI protocol %s", name)
+		}
+		if !seen[protocol] {
+			seen[protocol] = true
+			parsed = append(parsed, protocol)
+		}
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("at least one PSI protocol is required")
 	}
+	return parsed, nil
+}
+
+// protocolName returns the name of the PSI protocol.
+func protocolName(protocol psi.Protocol) string {
+	for name, p := range psiProtocols {
+		if p == protocol {
+			return name
+		}
+	}
+	return protocol.String()
+}
+
+// withoutProtocol returns protocols without the given protocol.
+func withoutProtocol(protocols []psi.Protocol, protocol psi.Protocol) []psi.Protocol {
+	remaining := make([]psi.Protocol, 0, len(protocols))
+	for _, p := range protocols {
+		if p != protocol {
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining
+}
+
+// runPSI obtains a match endpoint from the partner, unless the journal has
+// one, and runs PSI on it with the preferred protocols.
+func (m *MatchRunCmd) runPSI(ctx context.Context, partner *PartnerConfig, cert *auth.EphemerealCertificate, uniqueIdentifiers *util.UniqueIdentifiers, protocols []psi.Protocol, journal *runJournal) error {
+	if journal.Endpoint == "" {
+		if journal.MatchResultID == "" {
+			journal.MatchResultID = ksuid.New().String()
+			info(ctx).Msgf("generated match result id %s", journal.MatchResultID)
+			journal.record(ctx)
+		}
+
+		info(ctx).Msgf("polling /match/run with a timeout of %v to get match endpoint", m.InitTimeout)
+		runMatchCtx, runMatchCancel := context.WithTimeout(ctx, m.InitTimeout)
+		runMatchRes, err := pollRunMatch(runMatchCtx, partner, m.MatchID, journal.MatchResultID, cert, m.policy(ctx))
+		runMatchCancel()
+		if err != nil {
+			return fmt.Errorf("failed while polling run/match: %w", err)
+		}
+		if runMatchRes.MatchResultUid != "" {
+			journal.MatchResultID = runMatchRes.MatchResultUid
+		}
+		journal.Endpoint, journal.ServerCertificatePem = runMatchRes.Endpoint, runMatchRes.ServerCertificatePem
+		journal.advance(ctx, phaseEndpoint)
+	}
+
+	info(ctx).Msgf("running PSI on %s", journal.Endpoint)
+	tlsConfig, err := getTLSConfig(cert, journal.ServerCertificatePem, journal.Endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to create TLS config for PSI: %w", err)
+	}
+
+	// the header frame is only sent to peers running match-cli, DCNs speak
+	// the one-byte protocol negotiation and may reject anything else
+	h := &header.Header{Protocols: protocols}
+	return uniqueIdentifiers.Stream(ctx, func(ctx context.Context, records <-chan []byte) error {
+		session, err := match.SendWithHeader(ctx, journal.Endpoint, tlsConfig, h, uniqueIdentifiers.Len(), records)
+		if session != nil {
+			journal.Protocol = protocolName(session.Protocol)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to run PSI: %w", err)
+		}
+		return nil
+	})
 }
 
 // Run authenticates with the partner and runs the PSI match attempt.
 // The result of the match is printed on success.
 func (m *MatchRunCmd) Run(cli *CliContext) error {
-	defer m.File.Close()
+	result, err := m.run(cli)
+	if err != nil {
+		return err
+	}
+	return printJson(result)
+}
+
+// defaultProtocols are the PSI protocols of a match run without --protocols.
+var defaultProtocols = []string{"dhpsi"}
+
+// parseProtocols parses the preferred PSI protocols, given either with
+// --protocols or with the deprecated --protocol, but not both.
+func (m *MatchRunCmd) parseProtocols() ([]psi.Protocol, error) {
+	if m.Protocol != "" {
+		if len(m.Protocols) > 0 {
+			return nil, fmt.Errorf("--protocol is deprecated and cannot be used with --protocols, use --protocols only")
+		}
+		return parsePSIProtocols([]string{m.Protocol})
+	}
+	if len(m.Protocols) == 0 {
+		return parsePSIProtocols(defaultProtocols)
+	}
+	return parsePSIProtocols(m.Protocols)
+}
+
+// run runs the PSI match attempt and returns its thresholded and clamped
+// result.
+func (m *MatchRunCmd) run(cli *CliContext) (*matchResult, error) {
 	ctx := withInfoLogger(cli.ctx)
 
 	ctx, cancel := context.WithTimeout(ctx, m.RunTimeout)
 	defer cancel()
 	info(ctx).Msgf("running match %s with a timeout of %v", m.MatchID, m.RunTimeout)
 
-	uniqueIdentifiersInFile, err := util.GetUniqueIdentifiersInFile(m.File)
-	if err != nil {
-		return fmt.Errorf("failed to load unique identifiers in file %s : %w", m.File.Name(), err)
+	if m.MaxRejected < 0 || m.MaxRejected > 1 {
+		return nil, fmt.Errorf("--max-rejected must be between 0 and 1")
 	}
 
-	srcInsight := util.GetInsights(uniqueIdentifiersInFile)
-
-	records, err := util.GetInputChannel(ctx, uniqueIdentifiersInFile)
+	protocols, err := m.parseProtocols()
 	if err != nil {
-		return fmt.Errorf("failed to load record file %s : %w", m.File.Name(), err)
+		return nil, err
 	}
-	info(ctx).Msgf("loaded %d unique records from %s, with the following breakdown: %v", len(uniqueIdentifiersInFile), m.File.Name(), srcInsight)
 
-	partner := cli.config.findPartner(m.Partner)
-	if partner == nil {
-		return fmt.Errorf("partner %s does not exist", m.Partner)
+	report := util.NewValidationReport()
+	uniqueIdentifiers, counts, err := loadUniqueIdentifiers(ctx, m.Files, &m.InputFlags, report, m.Strict)
+	if err != nil {
+		return nil, err
 	}
+	defer uniqueIdentifiers.Close()
 
-	key, err := partner.ParsedPrivateKey()
-	if err != nil {
-		return fmt.Errorf("failed to parse private key for partner %s: %w", m.Partner, err)
+	info(ctx).Msgf("validated identifiers: %d accepted, %d rejected", report.Accepted, report.Rejected)
+	if ratio := report.RejectedRatio(); m.Strict && ratio > m.MaxRejected {
+		return nil, fmt.Errorf("rejected %d of %d identifiers (%.2f%%), more than the maximum of %.2f%%, run match validate for details",
+			report.Rejected, report.Accepted+report.Rejected, ratio*100, m.MaxRejected*100)
 	}
 
-	ephemerealCertificate, err := auth.NewEphemerealCertificate(key)
+	info(ctx).Msgf("loaded %d unique records from %v, with the following breakdown: %v", uniqueIdentifiers.Len(), counts, uniqueIdentifiers.Insights())
+
+	return m.match(ctx, cli, uniqueIdentifiers, protocols)
+}
+
+// match runs PSI with the partner on the loaded unique identifiers and
+// returns the thresholded and clamped result. The run is journaled so that
+// it can be resumed with match resume when interrupted.
+func (m *MatchRunCmd) match(ctx context.Context, cli *CliContext, uniqueIdentifiers *util.UniqueIdentifiers, protocols []psi.Protocol) (*matchResult, error) {
+	journal, err := newRunJournal(cli, m, uniqueIdentifiers)
 	if err != nil {
-		return fmt.Errorf("failed to create ephemereal certificate: %w", err)
+		return nil, err
 	}
-	debug(ctx).Msg("Generated ephemereal certificate for tls authentication")
+	info(ctx).Msgf("journaling run %s, resume it with match resume %s when interrupted", journal.ID, journal.ID)
+	if m.journaled != nil {
+		m.journaled(journal)
+	}
+
+	return m.resume(ctx, cli, journal, uniqueIdentifiers, protocols)
+}
 
-	info(ctx).Msgf("polling /match/run with a timeout of %v to get match endpoint", m.InitTimeout)
-	runMatchCtx, runMatchCancel := context.WithTimeout(ctx, m.InitTimeout)
-	runMatchRes, err := pollRunMatch(runMatchCtx, partner, m.MatchID, ephemerealCertificate)
-	runMatchCancel()
+// resume runs the match from the phase of the journal, recording the
+// error of the attempt when it fails. The unique identifiers are only
+// read when PSI did not complete.
+func (m *MatchRunCmd) resume(ctx context.Context, cli *CliContext, journal *runJournal, uniqueIdentifiers *util.UniqueIdentifiers, protocols []psi.Protocol) (*matchResult, error) {
+	result, err := m.resumePhases(ctx, cli, journal, uniqueIdentifiers, protocols)
 	if err != nil {
-		return fmt.Errorf("failed while polling run/match: %w", err)
+		journal.Error = err.Error()
+		journal.record(ctx)
 	}
+	return result, err
+}
 
-	info(ctx).Msgf("running PSI on %s", runMatchRes.Endpoint)
-	tlsConfig, err := getTLSConfig(ephemerealCertificate, runMatchRes.ServerCertificatePem, runMatchRes.Endpoint)
-	if err != nil {
-		return fmt.Errorf("failed to create TLS config for PSI: %w", err)
+func (m *MatchRunCmd) resumePhases(ctx context.Context, cli *CliContext, journal *runJournal, uniqueIdentifiers *util.UniqueIdentifiers, protocols []psi.Protocol) (*matchResult, error) {
+	partner := cli.config.findPartner(m.Partner)
+	if partner == nil {
+		return nil, fmt.Errorf("partner %s does not exist", m.Partner)
 	}
 
-	// in the future, a slice could be processed here
-	preferredProtocols := []psi.Protocol{psiProtocolFromString(m.Protocol)}
-	if err = match.Send(ctx, runMatchRes.Endpoint, tlsConfig, preferredProtocols, int64(len(uniqueIdentifiersInFile)), records); err != nil {
-		return fmt.Errorf("failed to run PSI: %w", err)
+	if journal.Phase == phaseStarted || journal.Phase == phaseEndpoint {
+		key, err := partner.ParsedPrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key for partner %s: %w", m.Partner, err)
+		}
+
+		// the partner pins the certificate sent to /match/run, reuse it
+		var ephemerealCertificate *auth.EphemerealCertificate
+		if journal.ClientCertificatePem != "" {
+			ephemerealCertificate, err = auth.LoadEphemerealCertificate([]byte(journal.ClientCertificatePem), key)
+		} else {
+			ephemerealCertificate, err = auth.NewEphemerealCertificate(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ephemereal certificate: %w", err)
+		}
+		journal.ClientCertificatePem = string(ephemerealCertificate.CertificatePem)
+		debug(ctx).Msg("Generated ephemereal certificate for tls authentication")
+
+		for {
+			err = m.runPSI(ctx, partner, ephemerealCertificate, uniqueIdentifiers, protocols, journal)
+			var protocolErr *match.ProtocolError
+			if !errors.As(err, &protocolErr) || ctx.Err() != nil {
+				break
+			}
+			// no result is produced when the PSI run fails, retry with the next protocol
+			protocols = withoutProtocol(protocols, protocolErr.Protocol)
+			if len(protocols) == 0 {
+				break
+			}
+			info(ctx).Msgf("PSI failed with %s: %v, retrying with %v", protocolErr.Protocol, protocolErr.Err, protocols)
+			// the next attempt obtains a new endpoint for a new match result
+			journal.MatchResultID, journal.Endpoint, journal.ServerCertificatePem = "", "", ""
+			journal.advance(ctx, phaseStarted)
+		}
+		if err != nil {
+			return nil, err
+		}
+		info(ctx).Msg("successfully completed PSI")
+		journal.advance(ctx, phaseSent)
 	}
-	info(ctx).Msg("successfully completed PSI")
 
 	info(ctx).Msgf("polling /match/get-result for results")
-	result, err := pollGetMatchResult(ctx, partner, runMatchRes.MatchResultUid)
+	result, err := pollGetMatchResult(ctx, partner, journal.MatchResultID, m.policy(ctx))
 	if err != nil {
-		return fmt.Errorf("failed to poll /match/get-result: %w", err)
+		return nil, fmt.Errorf("failed to poll /match/get-result: %w", err)
 	}
 
 	if result.State == v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_ERRORED {
-		return fmt.Errorf("got an errored state from /match/get-result: %s", result.ErrorMsg)
+		journal.advance(ctx, phaseFailed)
+		return nil, fmt.Errorf("got an errored state from /match/get-result: %s", result.ErrorMsg)
 	}
 
 	info(ctx).Msg("got results from /match/get-result")
 
 	// apply threshold on received insights and clamp it with src insight counts
-	util.ThresholdAndClampMatchResult(result, srcInsight)
-	return printJson(matchResultFromProto(result))
+	util.ThresholdAndClampMatchResult(result, journal.Source)
+	journal.Result = matchResultFromProto(result)
+	journal.advance(ctx, phaseCompleted)
+	return journal.Result, nil
 }
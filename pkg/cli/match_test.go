@@ -0,0 +1,431 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/dcntest"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+}
+
+// testIdentifiers returns the email identifiers numbered from first to last
+// excluded.
+func testIdentifiers(first, last int) [][]byte {
+	identifiers := make([][]byte, 0, last-first)
+	for i := first; i < last; i++ {
+		identifiers = append(identifiers, []byte(fmt.Sprintf("e:%064x", i)))
+	}
+	return identifiers
+}
+
+// newTestCli returns a context with an empty config saved in a temporary
+// directory.
+func newTestCli(t *testing.T) *CliContext {
+	t.Helper()
+	return &CliContext{ctx: context.Background(), configPath: filepath.Join(t.TempDir(), "config.json")}
+}
+
+// newTestMatch connects to the DCN and creates a match, and returns the
+// command running it with the identifiers 0 to 100.
+func newTestMatch(t *testing.T, cli *CliContext, dcn *dcntest.Server) *MatchRunCmd {
+	t.Helper()
+	partner, err := (&PartnerConnectCmd{Name: "dcn", Token: dcn.InviteToken()}).connect(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := (&MatchCreateCmd{Partner: partner.Name, Name: "test"}).create(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "identifiers.txt")
+	var lines []string
+	for _, identifier := range testIdentifiers(0, 100) {
+		lines = append(lines, string(identifier))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &MatchRunCmd{
+		Partner:     partner.Name,
+		InitTimeout: time.Minute,
+		RunTimeout:  time.Minute,
+		MatchID:     created.MatchUid,
+		Files:       []string{path},
+		Protocols:   []string{"dhpsi"},
+		InputFlags:  InputFlags{Format: "text", MaxMemory: 512},
+	}
+}
+
+func checkInsights(t *testing.T, want, got *v1.Insights) {
+	t.Helper()
+	for _, idType := range util.IdentifierTypes.Types() {
+		if *idType.Counter(want) != *idType.Counter(got) {
+			t.Fatalf("want %d %s, got %d", *idType.Counter(want), idType.Name, *idType.Counter(got))
+		}
+	}
+}
+
+func TestPartnerConnect(t *testing.T) {
+	dcn := dcntest.NewServer(nil)
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	if _, err := (&PartnerConnectCmd{Name: "dcn", Token: "invalid"}).connect(cli); err == nil {
+		t.Fatal("want an invalid token to fail")
+	}
+	if _, err := (&PartnerConnectCmd{Name: "dcn", Token: dcn.InviteToken()}).connect(cli); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&PartnerConnectCmd{Name: "dcn", Token: dcn.InviteToken()}).connect(cli); err == nil {
+		t.Fatal("want connecting twice to the same partner name to fail")
+	}
+
+	saved := &CliContext{configPath: cli.configPath}
+	if err := saved.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if partner := saved.config.findPartner("dcn"); partner == nil || partner.URL != dcn.URL {
+		t.Fatalf("want the partner to be saved, got %+v", saved.config.Partners)
+	}
+}
+
+func TestPartnerConfigure(t *testing.T) {
+	dcn := dcntest.NewServer(nil)
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	configure := &PartnerConfigureCmd{Name: "dcn", Timeout: 30 * time.Second, MaxRetries: 3, RateLimit: 5, RateBurst: 2}
+	if _, err := configure.configure(cli); err == nil {
+		t.Fatal("want configuring an unknown partner to fail")
+	}
+	connected, err := (&PartnerConnectCmd{Name: "dcn", Token: dcn.InviteToken()}).connect(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the calls to a partner that was not configured have the defaults of
+	// partner configure
+	c, err := connected.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Transport != partnerTransport("dcn", TransportConfig{TimeoutSeconds: 60, RateBurst: 1}) {
+		t.Fatal("want the default transport for a partner that was not configured")
+	}
+	if _, err := configure.configure(cli); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := &CliContext{configPath: cli.configPath}
+	if err := saved.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	partner := saved.config.findPartner("dcn")
+	want := TransportConfig{TimeoutSeconds: 30, MaxRetries: 3, RateLimit: 5, RateBurst: 2}
+	if partner == nil || partner.Transport == nil || *partner.Transport != want {
+		t.Fatalf("want the transport to be saved, got %+v", partner)
+	}
+
+	c, err = partner.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Transport == nil || c.Transport != partnerTransport("dcn", want) {
+		t.Fatal("want the clients of the partner to share its transport")
+	}
+	if _, err := c.ListMatches(cli.ctx, &v1.ListExternalMatchReq{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetRefreshFrequency(t *testing.T) {
+	for frequency, want := range map[string]interface{}{
+		"":        &v1.CreateExternalMatchReq_Adhoc{},
+		"adhoc":   &v1.CreateExternalMatchReq_Adhoc{},
+		"daily":   &v1.CreateExternalMatchReq_Daily{},
+		"Weekly":  &v1.CreateExternalMatchReq_Weekly{},
+		"monthly": &v1.CreateExternalMatchReq_Monthly{},
+	} {
+		req := &v1.CreateExternalMatchReq{}
+		if err := setRefreshFrequency(req, frequency); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fmt.Sprintf("%T", req.RefreshFrequency), fmt.Sprintf("%T", want); got != want {
+			t.Fatalf("want %s for %q, got %s", want, frequency, got)
+		}
+	}
+	if err := setRefreshFrequency(&v1.CreateExternalMatchReq{}, "hourly"); err == nil {
+		t.Fatal("want an unsupported refresh frequency to fail")
+	}
+}
+
+func TestMatchRunParseProtocols(t *testing.T) {
+	for _, tc := range []struct {
+		run  MatchRunCmd
+		want string
+	}{
+		{MatchRunCmd{}, "[dhpsi]"},
+		{MatchRunCmd{Protocols: []string{"kkrtpsi", "dhpsi"}}, "[kkrtpsi dhpsi]"},
+		{MatchRunCmd{Protocol: "npsi"}, "[npsi]"},
+	} {
+		protocols, err := tc.run.parseProtocols()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, protocol := range protocols {
+			names = append(names, protocolName(protocol))
+		}
+		if got := fmt.Sprint(names); got != tc.want {
+			t.Fatalf("want %s for %+v, got %s", tc.want, tc.run, got)
+		}
+	}
+
+	both := &MatchRunCmd{Protocol: "npsi", Protocols: []string{"dhpsi"}}
+	if _, err := both.parseProtocols(); err == nil {
+		t.Fatal("want --protocol and --protocols together to fail")
+	}
+}
+
+func TestMatchRun(t *testing.T) {
+	dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+	dcn.RunPending = 2
+	dcn.ResultPending = 2
+	dcn.Start()
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	result, err := newTestMatch(t, cli, dcn).run(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.State != "completed" {
+		t.Fatalf("want a completed match, got %+v", result)
+	}
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), result.Results)
+
+	if calls := dcn.Calls(dcntest.PathRunMatch); calls != 3 {
+		t.Fatalf("want /match/run to be polled 3 times, got %d", calls)
+	}
+	// the result stays pending until the receiver is done
+	if calls := dcn.Calls(dcntest.PathGetResult); calls < 3 {
+		t.Fatalf("want /match/get-result to be polled at least 3 times, got %d", calls)
+	}
+}
+
+func TestMatchRunDifferentialPrivacy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		dp   dcntest.DifferentialPrivacy
+		want *v1.Insights
+	}{
+		// the 60 matched identifiers are under the threshold
+		{"threshold", dcntest.DifferentialPrivacy{Threshold: 100}, &v1.Insights{}},
+		// the noise is clamped to the 100 identifiers sent, and to 0
+		{"clamp", dcntest.DifferentialPrivacy{MaxNoise: 1000, Seed: 1}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+			dp := tc.dp
+			dcn.DifferentialPrivacy = &dp
+			dcn.Start()
+			defer dcn.Close()
+			cli := newTestCli(t)
+
+			result, err := newTestMatch(t, cli, dcn).run(cli)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Results.DifferentialPrivacyThreshold != dp.Threshold {
+				t.Fatalf("want threshold %d, got %d", dp.Threshold, result.Results.DifferentialPrivacyThreshold)
+			}
+			if tc.want != nil {
+				checkInsights(t, tc.want, result.Results)
+				return
+			}
+			sent := util.GetIdentifiersInsights(testIdentifiers(0, 100))
+			for _, idType := range util.IdentifierTypes.Types() {
+				if n := *idType.Counter(result.Results); n < 0 || n > *idType.Counter(sent) {
+					t.Fatalf("want %s to be clamped between 0 and %d, got %d", idType.Name, *idType.Counter(sent), n)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchRunErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		intercept func(path string, req proto.Message) (proto.Message, error)
+		want      string
+	}{
+		{
+			"run error",
+			func(path string, req proto.Message) (proto.Message, error) {
+				if path == dcntest.PathRunMatch {
+					return nil, dcntest.Error(http.StatusServiceUnavailable, "no receiver available")
+				}
+				return nil, nil
+			},
+			"no receiver available",
+		},
+		{
+			"get-result error",
+			func(path string, req proto.Message) (proto.Message, error) {
+				if path == dcntest.PathGetResult {
+					return nil, dcntest.Error(http.StatusInternalServerError, "database unavailable")
+				}
+				return nil, nil
+			},
+			"database unavailable",
+		},
+		{
+			"errored result",
+			func(path string, req proto.Message) (proto.Message, error) {
+				if path == dcntest.PathGetResult {
+					return &v1.GetExternalMatchResultRes{MatchResult: &v1.ExternalMatchResult{
+						Uid:      req.(*v1.GetExternalMatchResultReq).MatchResultUid,
+						State:    v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_ERRORED,
+						ErrorMsg: "receiver crashed",
+					}}, nil
+				}
+				return nil, nil
+			},
+			"got an errored state from /match/get-result: receiver crashed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+			dcn.Intercept = tc.intercept
+			dcn.Start()
+			defer dcn.Close()
+			cli := newTestCli(t)
+
+			if _, err := newTestMatch(t, cli, dcn).run(cli); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("want %q in error, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestMatchRunRejected(t *testing.T) {
+	dcn := dcntest.NewServer(testIdentifiers(40, 200))
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	run := newTestMatch(t, cli, dcn)
+	content, err := os.ReadFile(run.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(run.Files[0], append(content, "\ne:not-a-hash\ni4:256.0.0.1"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// without --strict, invalid identifiers are sent as they were read
+	if _, err := run.run(cli); err != nil {
+		t.Fatal(err)
+	}
+	checkInsights(t, util.GetIdentifiersInsights(append(testIdentifiers(0, 100), []byte("e:not-a-hash"), []byte("i4:256.0.0.1"))), lastRunJournal(t, cli).Source)
+
+	// with --strict, they are dropped when under --max-rejected
+	if err := os.RemoveAll(runsDir(cli)); err != nil {
+		t.Fatal(err)
+	}
+	run.Strict, run.MaxRejected = true, 0.02
+	if _, err := run.run(cli); err != nil {
+		t.Fatal(err)
+	}
+	checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(0, 100)), lastRunJournal(t, cli).Source)
+
+	run.MaxRejected = 0.01
+	if _, err := run.run(cli); err == nil || !strings.Contains(err.Error(), "rejected 2 of 102 identifiers") {
+		t.Fatalf("want too many rejected identifiers to fail with --strict, got %v", err)
+	}
+}
+
+func TestMatchRunInitTimeout(t *testing.T) {
+	dcn := dcntest.NewUnstartedServer(nil)
+	dcn.RunPending = 1 << 20
+	dcn.Start()
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	run := newTestMatch(t, cli, dcn)
+	run.InitTimeout = 100 * time.Millisecond
+	if _, err := run.run(cli); err == nil || !strings.Contains(err.Error(), "failed while polling run/match") {
+		t.Fatalf("want the initialization to time out, got %v", err)
+	}
+}
+
+func TestMatchRunRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		retries int
+		err     string
+	}{
+		{"retried", 3, ""},
+		{"budget", 1, "temporarily unavailable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := make(map[string]int)
+			dcn := dcntest.NewUnstartedServer(testIdentifiers(40, 200))
+			dcn.Intercept = func(path string, req proto.Message) (proto.Message, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls[path]++
+				switch {
+				case path == dcntest.PathRunMatch && calls[path] == 1:
+					return nil, dcntest.ErrorRetryAfter(http.StatusTooManyRequests, "slow down", time.Second)
+				case path == dcntest.PathGetResult && calls[path] <= 2:
+					return nil, dcntest.Error(http.StatusServiceUnavailable, "temporarily unavailable")
+				}
+				return nil, nil
+			}
+			dcn.Start()
+			defer dcn.Close()
+			cli := newTestCli(t)
+
+			run := newTestMatch(t, cli, dcn)
+			run.PollRetries = tc.retries
+			// only the polling retries, not the transport of the partner
+			if _, err := (&PartnerConfigureCmd{Name: run.Partner}).configure(cli); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			result, err := run.run(cli)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("want %q in error, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInsights(t, util.GetIdentifiersInsights(testIdentifiers(40, 100)), result.Results)
+			if elapsed := time.Since(start); elapsed < time.Second {
+				t.Fatalf("want the Retry-After of /match/run to be respected, ran in %v", elapsed)
+			}
+			if n := dcn.Calls(dcntest.PathGetResult); n < 3 {
+				t.Fatalf("want /match/get-result to be retried twice, got %d calls", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/auth"
+	"github.com/optable/match-cli/pkg/header"
+	"github.com/optable/match-cli/pkg/match"
+	"github.com/optable/match/pkg/psi"
+)
+
+type (
+	MatchOfferCmd struct {
+		Partner   string   `arg:"" required:"" help:"Name of the peer partner"`
+		Endpoint  string   `help:"host:port the peer partner connects to, required to receive the match"`
+		Protocols []string `default:"dhpsi,kkrtpsi" help:"PSI protocols offered (dhpsi, npsi, bpsi, kkrtpsi), in order of preference"`
+		Output    string   `help:"File to write the match offer to, defaults to stdout"`
+	}
+
+	MatchSendCmd struct {
+		Partner    string        `arg:"" required:"" help:"Name of the peer partner"`
+		Files      []string      `arg:"" required:"" help:"Files or glob patterns to match, use - to read from stdin"`
+		Offer      string        `required:"" type:"existingfile" help:"File of our match offer, created with match offer"`
+		PeerOffer  string        `required:"" type:"existingfile" help:"File of the match offer of the peer partner, with the endpoint to connect to"`
+		RunTimeout time.Duration `default:"30m" help:"Timeout for the match operation"`
+		InputFlags
+	}
+)
+
+// sendResult is the summary of a match sent to a peer partner, which is
+// the one learning the intersection.
+type sendResult struct {
+	Time    time.Time    `json:"time"`
+	Sent    int64        `json:"sent"`
+	Records *v1.Insights `json:"records"`
+}
+
+// peerMatch is a match run directly with a peer partner from the exchanged
+// match offers.
+type peerMatch struct {
+	certificate *auth.EphemerealCertificate
+	offer       *auth.MatchOffer
+	peerOffer   *auth.MatchOffer
+}
+
+func readOffer(path string) (*auth.MatchOffer, error) {
+	encoded, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read match offer %s: %w", path, err)
+	}
+	offer, err := auth.ParseOffer(strings.TrimSpace(string(encoded)), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid match offer %s: %w", path, err)
+	}
+	return offer, nil
+}
+
+// loadPeerMatch verifies the match offers exchanged with the peer partner.
+// Our offer must be signed with our partner key, and the offer of the peer
+// with the key given by partner add-peer --peer-public-key or else pinned on
+// the first import of one of its offers, whose fingerprint is logged to be
+// confirmed with the peer.
+func loadPeerMatch(cli *CliContext, partnerName, offerPath, peerOfferPath string) (*peerMatch, error) {
+	partner := cli.config.findPartner(partnerName)
+	if partner == nil {
+		return nil, fmt.Errorf("partner %s does not exist", partnerName)
+	}
+
+	offer, err := readOffer(offerPath)
+	if err != nil {
+		return nil, err
+	}
+	if offer.PublicKey != partner.PublicKey {
+		return nil, fmt.Errorf("match offer %s was not created for partner %s", offerPath, partnerName)
+	}
+
+	peerOffer, err := readOffer(peerOfferPath)
+	if err != nil {
+		return nil, err
+	}
+	switch partner.PeerPublicKey {
+	case peerOffer.PublicKey:
+	case "":
+		fingerprint, err := auth.Fingerprint(peerOffer.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		partner.PeerPublicKey = peerOffer.PublicKey
+		cli.config.updatePartner(partner)
+		if err := cli.SaveConfig(); err != nil {
+			return nil, fmt.Errorf("failed to save config: %w", err)
+		}
+		warn(cli.ctx).Msgf("pinned public key of partner %s on first use, confirm its fingerprint %s with the partner", partnerName, fingerprint)
+	default:
+		return nil, fmt.Errorf("match offer %s is not signed by the pinned key of partner %s", peerOfferPath, partnerName)
+	}
+
+	key, err := partner.ParsedPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key for partner %s: %w", partnerName, err)
+	}
+	certificate, err := auth.LoadEphemerealCertificate([]byte(offer.CertificatePem), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ephemereal certificate: %w", err)
+	}
+
+	return &peerMatch{certificate: certificate, offer: offer, peerOffer: peerOffer}, nil
+}
+
+// protocols returns the protocols of our offer that the peer also offered,
+// in our order of preference.
+func (m *peerMatch) protocols() ([]psi.Protocol, error) {
+	offered := make(map[string]bool, len(m.peerOffer.Protocols))
+	for _, protocol := range m.peerOffer.Protocols {
+		offered[protocol] = true
+	}
+
+	var common []string
+	for _, protocol := range m.offer.Protocols {
+		if offered[protocol] {
+			common = append(common, protocol)
+		}
+	}
+	if len(common) == 0 {
+		return nil, fmt.Errorf("no PSI protocol in common with the peer partner, offered %v", m.peerOffer.Protocols)
+	}
+	return parsePSIProtocols(common)
+}
+
+// serverTLSConfig returns the TLS config receiving the match from the peer.
+func (m *peerMatch) serverTLSConfig() (*tls.Config, error) {
+	tlsCertificate, err := m.certificate.GetTLSCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TLS certificate from ephemereal certificate: %w", err)
+	}
+	pinnedCert, err := auth.ParseCertificatePEM(m.peerOffer.CertificatePem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer pinned certificate: %w", err)
+	}
+	return pinnedServerTLSConfig(tlsCertificate, pinnedCert), nil
+}
+
+// Run creates a match offer signed with the key of the peer partner. The
+// offer can only be used until its ephemereal certificate expires, an hour
+// later.
+func (m *MatchOfferCmd) Run(cli *CliContext) error {
+	if _, err := parsePSIProtocols(m.Protocols); err != nil {
+		return err
+	}
+
+	partner := cli.config.findPartner(m.Partner)
+	if partner == nil {
+		return fmt.Errorf("partner %s does not exist", m.Partner)
+	}
+
+	key, err := partner.ParsedPrivateKey()
+	if err != nil {
+		return fmt.Errorf("failed to parse private key for partner %s: %w", m.Partner, err)
+	}
+
+	ephemerealCertificate, err := auth.NewEphemerealCertificate(key)
+	if err != nil {
+		return fmt.Errorf("failed to create ephemereal certificate: %w", err)
+	}
+
+	offer, err := auth.SignOffer(&auth.MatchOffer{
+		Endpoint:       m.Endpoint,
+		CertificatePem: string(ephemerealCertificate.CertificatePem),
+		Protocols:      m.Protocols,
+		CreatedAt:      time.Now().UTC(),
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := auth.Fingerprint(partner.PublicKey)
+	if err != nil {
+		return err
+	}
+	info(withInfoLogger(cli.ctx)).Msgf("created match offer valid for an hour, signed with the key of fingerprint %s", fingerprint)
+
+	if m.Output == "" {
+		fmt.Println(offer)
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Clean(m.Output), []byte(offer+"\n"), 0600)
+}
+
+// Run sends a match directly to the peer partner listening on the endpoint
+// of its match offer, without a DCN.
+func (m *MatchSendCmd) Run(cli *CliContext) error {
+	ctx := withInfoLogger(cli.ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, m.RunTimeout)
+	defer cancel()
+
+	peer, err := loadPeerMatch(cli, m.Partner, m.Offer, m.PeerOffer)
+	if err != nil {
+		return err
+	}
+	if peer.peerOffer.Endpoint == "" {
+		return fmt.Errorf("match offer %s has no endpoint to connect to", m.PeerOffer)
+	}
+	protocols, err := peer.protocols()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := getTLSConfig(peer.certificate, peer.peerOffer.CertificatePem, peer.peerOffer.Endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to create TLS config for PSI: %w", err)
+	}
+
+	uniqueIdentifiers, counts, err := loadUniqueIdentifiers(ctx, m.Files, &m.InputFlags, nil, false)
+	if err != nil {
+		return err
+	}
+	defer uniqueIdentifiers.Close()
+
+	info(ctx).Msgf("loaded %d unique records from %v, with the following breakdown: %v", uniqueIdentifiers.Len(), counts, uniqueIdentifiers.Insights())
+
+	info(ctx).Msgf("running PSI on %s", peer.peerOffer.Endpoint)
+	err = uniqueIdentifiers.Stream(ctx, func(ctx context.Context, records <-chan []byte) error {
+		if _, err := match.SendWithHeader(ctx, peer.peerOffer.Endpoint, tlsConfig, &header.Header{Version: header.Version, Protocols: protocols, ClientVersion: version}, uniqueIdentifiers.Len(), records); err != nil {
+			return fmt.Errorf("failed to run PSI: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	info(ctx).Msg("successfully completed PSI")
+
+	return printJson(&sendResult{
+		Time:    time.Now().UTC(),
+		Sent:    uniqueIdentifiers.Len(),
+		Records: uniqueIdentifiers.Insights(),
+	})
+}
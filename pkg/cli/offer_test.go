@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPeer adds the peer partner to cli, and returns the path of a match
+// offer created for it.
+func newTestPeer(t *testing.T, cli *CliContext, add *PartnerAddPeerCmd) string {
+	t.Helper()
+	if err := add.Run(cli); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "peer.offer")
+	if err := (&MatchOfferCmd{Partner: add.Name, Protocols: []string{"dhpsi"}, Output: path}).Run(cli); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPeerMatch(t *testing.T) {
+	alice, bob, eve := newTestCli(t), newTestCli(t), newTestCli(t)
+	bobOffer := newTestPeer(t, bob, &PartnerAddPeerCmd{Name: "alice"})
+	eveOffer := newTestPeer(t, eve, &PartnerAddPeerCmd{Name: "alice"})
+	bobKey := bob.config.findPartner("alice").PublicKey
+
+	// the key given to add-peer is required from the first offer
+	aliceOffer := newTestPeer(t, alice, &PartnerAddPeerCmd{Name: "bob", PeerPublicKey: bobKey})
+	if _, err := loadPeerMatch(alice, "bob", aliceOffer, eveOffer); err == nil || !strings.Contains(err.Error(), "pinned key") {
+		t.Fatalf("want the offer of another key to fail, got %v", err)
+	}
+	if _, err := loadPeerMatch(alice, "bob", aliceOffer, bobOffer); err != nil {
+		t.Fatal(err)
+	}
+
+	// otherwise the key of the first offer is pinned
+	carolOffer := newTestPeer(t, alice, &PartnerAddPeerCmd{Name: "carol"})
+	if _, err := loadPeerMatch(alice, "carol", carolOffer, bobOffer); err != nil {
+		t.Fatal(err)
+	}
+	if got := alice.config.findPartner("carol").PeerPublicKey; got != bobKey {
+		t.Fatalf("want the key of the first offer to be pinned, got %q", got)
+	}
+	if _, err := loadPeerMatch(alice, "carol", carolOffer, eveOffer); err == nil {
+		t.Fatal("want the offer of another key than the pinned one to fail")
+	}
+
+	if err := (&PartnerAddPeerCmd{Name: "dave", PeerPublicKey: "invalid"}).Run(alice); err == nil {
+		t.Fatal("want an invalid peer public key to fail")
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/auth"
 
 	"google.golang.org/protobuf/encoding/protojson"
 )
@@ -26,10 +28,25 @@ type (
 		Token string `arg:"" required:"" help:"The invite token from the partner"`
 	}
 
+	PartnerAddPeerCmd struct {
+		Name          string `arg:"" required:"" help:"Name of the peer partner."`
+		PeerPublicKey string `help:"Public key of the peer partner, as shown by partner get on its side. Its offers must be signed with it, instead of pinning the key of its first offer."`
+	}
+
+	PartnerConfigureCmd struct {
+		Name       string        `arg:"" required:"" help:"Name of the partner."`
+		Timeout    time.Duration `default:"1m" help:"Timeout of each attempt of a call to the partner, 0 for none."`
+		MaxRetries int           `default:"0" help:"Number of retries of idempotent calls after network errors or 429 and 5xx statuses, 0 for none. The polls of match run retry on top of these, see --poll-retries."`
+		RateLimit  float64       `default:"0" help:"Maximum number of calls per second to the partner, 0 for no limit."`
+		RateBurst  int           `default:"1" help:"Number of calls sent at once before the rate limit applies."`
+	}
+
 	PartnerCmd struct {
-		Connect PartnerConnectCmd `cmd:"" help:"Connect to a partner sandbox with an invite token."`
-		List    PartnerListCmd    `cmd:"" help:"List partners."`
-		Get     PartnerGetCmd     `cmd:"" help:"Get partner."`
+		Connect   PartnerConnectCmd   `cmd:"" help:"Connect to a partner sandbox with an invite token."`
+		List      PartnerListCmd      `cmd:"" help:"List partners."`
+		Get       PartnerGetCmd       `cmd:"" help:"Get partner."`
+		AddPeer   PartnerAddPeerCmd   `cmd:"" help:"Add a peer partner to match with directly, without a DCN."`
+		Configure PartnerConfigureCmd `cmd:"" help:"Configure the timeout, retries and rate limit of the calls to a partner."`
 	}
 )
 
@@ -52,50 +69,100 @@ func (p *PartnerListCmd) Run(cli *CliContext) error {
 }
 
 func (p *PartnerConnectCmd) Run(cli *CliContext) error {
+	conf, err := p.connect(cli)
+	if err != nil {
+		return err
+	}
+	return printJson(conf)
+}
+
+// connect registers with the partner and saves its configuration.
+func (p *PartnerConnectCmd) connect(cli *CliContext) (*PartnerConfig, error) {
 	existingPartner := cli.config.findPartner(p.Name)
 	if existingPartner != nil {
-		return fmt.Errorf("a partner with name %s already exists", p.Name)
+		return nil, fmt.Errorf("a partner with name %s already exists", p.Name)
 	}
 
 	token, err := decodeToken(p.Token)
 	if err != nil {
-		return fmt.Errorf("failed to decode token: %w", err)
+		return nil, fmt.Errorf("failed to decode token: %w", err)
 	}
 
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	conf, err := newPartnerConfig(p.Name)
 	if err != nil {
-		return fmt.Errorf("failed to generate key pair : %w", err)
+		return nil, err
 	}
-	marshaledPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+	conf.URL = token.SandboxInfo
+
+	client, err := conf.NewClient()
 	if err != nil {
-		return fmt.Errorf("failed to marshal private key : %w", err)
+		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
-	publicKey := privateKey.Public()
-	marshaledPublicKey, err := x509.MarshalPKIXPublicKey(publicKey)
+	err = client.RegisterPartner(cli.ctx, &v1.RegisterPartnerReq{
+		PublicKey: conf.PublicKey,
+		Token:     p.Token,
+	})
+
 	if err != nil {
-		return fmt.Errorf("failed to marshal public key: %w", err)
+		return nil, fmt.Errorf("failed to register with partner: %w", err)
 	}
 
-	conf := PartnerConfig{
-		Name:       p.Name,
-		URL:        token.SandboxInfo,
-		PublicKey:  base64.StdEncoding.EncodeToString(marshaledPublicKey),
-		PrivateKey: base64.StdEncoding.EncodeToString(marshaledPrivateKey),
+	cli.config.Partners = append(cli.config.Partners, conf)
+	err = cli.SaveConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save config: %w", err)
 	}
 
-	client, err := conf.NewClient()
+	return &conf, nil
+}
+
+func (p *PartnerConfigureCmd) Run(cli *CliContext) error {
+	partner, err := p.configure(cli)
 	if err != nil {
-		return fmt.Errorf("failed to create client: %w", err)
+		return err
 	}
+	return printJson(partner)
+}
 
-	err = client.RegisterPartner(cli.ctx, &v1.RegisterPartnerReq{
-		PublicKey: conf.PublicKey,
-		Token:     p.Token,
-	})
+// configure replaces the transport configuration of the partner and saves it.
+func (p *PartnerConfigureCmd) configure(cli *CliContext) (*PartnerConfig, error) {
+	partner := cli.config.findPartner(p.Name)
+	if partner == nil {
+		return nil, fmt.Errorf("partner %s does not exist", p.Name)
+	}
+	if p.Timeout < 0 || p.MaxRetries < 0 || p.RateLimit < 0 || p.RateBurst < 0 {
+		return nil, fmt.Errorf("the timeout, retries and rate limit cannot be negative")
+	}
 
+	partner.Transport = &TransportConfig{
+		TimeoutSeconds: p.Timeout.Seconds(),
+		MaxRetries:     p.MaxRetries,
+		RateLimit:      p.RateLimit,
+		RateBurst:      p.RateBurst,
+	}
+	cli.config.updatePartner(partner)
+	if err := cli.SaveConfig(); err != nil {
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+	return partner, nil
+}
+
+func (p *PartnerAddPeerCmd) Run(cli *CliContext) error {
+	existingPartner := cli.config.findPartner(p.Name)
+	if existingPartner != nil {
+		return fmt.Errorf("a partner with name %s already exists", p.Name)
+	}
+
+	conf, err := newPartnerConfig(p.Name)
 	if err != nil {
-		return fmt.Errorf("failed to register with partner: %w", err)
+		return err
+	}
+	if p.PeerPublicKey != "" {
+		if _, err := auth.ParsePublicKey(p.PeerPublicKey); err != nil {
+			return fmt.Errorf("invalid --peer-public-key: %w", err)
+		}
+		conf.PeerPublicKey = p.PeerPublicKey
 	}
 
 	cli.config.Partners = append(cli.config.Partners, conf)
@@ -107,6 +174,30 @@ func (p *PartnerConnectCmd) Run(cli *CliContext) error {
 	return printJson(conf)
 }
 
+// newPartnerConfig generates the key pair identifying us to a new partner.
+func newPartnerConfig(name string) (PartnerConfig, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return PartnerConfig{}, fmt.Errorf("failed to generate key pair : %w", err)
+	}
+	marshaledPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return PartnerConfig{}, fmt.Errorf("failed to marshal private key : %w", err)
+	}
+
+	publicKey := privateKey.Public()
+	marshaledPublicKey, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return PartnerConfig{}, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	return PartnerConfig{
+		Name:       name,
+		PublicKey:  base64.StdEncoding.EncodeToString(marshaledPublicKey),
+		PrivateKey: base64.StdEncoding.EncodeToString(marshaledPrivateKey),
+	}, nil
+}
+
 func decodeToken(token string) (*v1.PartnerInitToken, error) {
 	json, err := base64.StdEncoding.DecodeString(token)
 	if err != nil {
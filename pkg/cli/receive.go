@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/auth"
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/header"
+	"github.com/optable/match-cli/pkg/match"
+	"github.com/optable/match-cli/pkg/network"
+	"github.com/optable/match/pkg/psi"
+)
+
+type MatchReceiveCmd struct {
+	Files           []string      `arg:"" required:"" help:"Files or glob patterns to match, use - to read from stdin"`
+	Listen          string        `default:":8443" help:"Address to listen on for the match sender"`
+	Certificate     string        `type:"existingfile" help:"PEM certificate presented to the match sender"`
+	PrivateKey      string        `type:"existingfile" help:"PEM private key of the certificate"`
+	PeerCertificate string        `type:"existingfile" help:"PEM certificate of the match sender, pinned during the TLS handshake"`
+	Partner         string        `help:"Name of the peer partner, to receive the match with match offers instead of certificates"`
+	Offer           string        `type:"existingfile" help:"File of our match offer, created with match offer"`
+	PeerOffer       string        `type:"existingfile" help:"File of the match offer of the peer partner"`
+	Protocols       []string      `default:"dhpsi,npsi,bpsi,kkrtpsi" help:"Supported PSI protocols (dhpsi, npsi, bpsi, kkrtpsi), the sender's preference wins. Ignored with match offers"`
+	Output          string        `required:"" help:"File to write the intersected identifiers to"`
+	RunTimeout      time.Duration `default:"1h" help:"Timeout for the match operation, including waiting for the match sender"`
+	InputFlags
+}
+
+// receiveResult is the summary of a received match.
+type receiveResult struct {
+	Time    time.Time    `json:"time"`
+	Matched int          `json:"matched"`
+	Output  string       `json:"output"`
+	Results *v1.Insights `json:"results"`
+}
+
+// receiverTLSConfig returns the TLS config of the receiver, which requires
+// the sender to present the pinned peer certificate.
+func receiverTLSConfig(certificateFile, privateKeyFile, peerCertificateFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certificateFile, privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	peerCertificatePem, err := ioutil.ReadFile(filepath.Clean(peerCertificateFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer certificate: %w", err)
+	}
+	pinnedCert, err := auth.ParseCertificatePEM(string(peerCertificatePem))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer pinned certificate: %w", err)
+	}
+
+	return pinnedServerTLSConfig(certificate, pinnedCert), nil
+}
+
+func pinnedServerTLSConfig(certificate tls.Certificate, pinnedCert *x509.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		// The sender certificate is verified to be stricly equal to
+		// the pinned one with VerifyPeerCertificate
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: auth.NewVerifyPinnedCertificate(pinnedCert),
+	}
+}
+
+// writeIdentifiers writes the identifiers to the file at path, one per line.
+func writeIdentifiers(path string, identifiers [][]byte) error {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, identifier := range identifiers {
+		if _, err := w.Write(identifier); err != nil {
+			file.Close()
+			return err
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// session returns the supported protocols and the TLS config of the
+// receiver, from either match offers or certificate files.
+func (m *MatchReceiveCmd) session(cli *CliContext) ([]psi.Protocol, *tls.Config, error) {
+	if m.Partner != "" || m.Offer != "" || m.PeerOffer != "" {
+		if m.Partner == "" || m.Offer == "" || m.PeerOffer == "" {
+			return nil, nil, fmt.Errorf("--partner, --offer and --peer-offer are required to receive with match offers")
+		}
+		peer, err := loadPeerMatch(cli, m.Partner, m.Offer, m.PeerOffer)
+		if err != nil {
+			return nil, nil, err
+		}
+		protocols, err := peer.protocols()
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig, err := peer.serverTLSConfig()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create TLS config for PSI: %w", err)
+		}
+		return protocols, tlsConfig, nil
+	}
+
+	if m.Certificate == "" || m.PrivateKey == "" || m.PeerCertificate == "" {
+		return nil, nil, fmt.Errorf("--certificate, --private-key and --peer-certificate are required to receive without match offers")
+	}
+	protocols, err := parsePSIProtocols(m.Protocols)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := receiverTLSConfig(m.Certificate, m.PrivateKey, m.PeerCertificate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create TLS config for PSI: %w", err)
+	}
+	return protocols, tlsConfig, nil
+}
+
+// Run listens for a match sender and runs the receiver side of the PSI
+// match directly with it, without a DCN. The intersected identifiers are
+// written to the output file and a summary is printed.
+func (m *MatchReceiveCmd) Run(cli *CliContext) error {
+	ctx := withInfoLogger(cli.ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, m.RunTimeout)
+	defer cancel()
+
+	protocols, tlsConfig, err := m.session(cli)
+	if err != nil {
+		return err
+	}
+
+	uniqueIdentifiers, counts, err := loadUniqueIdentifiers(ctx, m.Files, &m.InputFlags, nil, false)
+	if err != nil {
+		return err
+	}
+	defer uniqueIdentifiers.Close()
+	info(ctx).Msgf("loaded %d unique records from %v, with the following breakdown: %v", uniqueIdentifiers.Len(), counts, uniqueIdentifiers.Insights())
+
+	l, err := network.Listen(ctx, m.Listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	var intersection [][]byte
+	err = uniqueIdentifiers.Stream(ctx, func(ctx context.Context, records <-chan []byte) error {
+		intersection, err = match.ReceiveWithHeader(ctx, l, tlsConfig, &header.Header{Protocols: protocols, ClientVersion: version}, uniqueIdentifiers.Len(), records)
+		if err != nil {
+			return fmt.Errorf("failed to run PSI: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	info(ctx).Msgf("successfully completed PSI, %d identifiers matched", len(intersection))
+
+	if err := writeIdentifiers(m.Output, intersection); err != nil {
+		return fmt.Errorf("failed to write intersected identifiers to %s: %w", m.Output, err)
+	}
+
+	return printJson(&receiveResult{
+		Time:    time.Now().UTC(),
+		Matched: len(intersection),
+		Output:  m.Output,
+		Results: util.GetIdentifiersInsights(intersection),
+	})
+}
@@ -0,0 +1,272 @@
+package cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/util"
+)
+
+type MatchReportCmd struct {
+	Partner string   `arg:"" required:"" help:"Name of the partner"`
+	MatchID string   `arg:"" required:"" help:"ID of the match"`
+	Diff    []string `placeholder:"RESULT-ID" help:"Compare two results of the match, from the first to the second, e.g. --diff <from>,<to>"`
+	Output  string   `default:"json" enum:"json,csv" help:"Output format of the report: json, or csv of the match rates, or of the diff with --diff"`
+}
+
+// matchReport is the match rates of the completed results of a match,
+// oldest first.
+type matchReport struct {
+	Time    time.Time       `json:"time"`
+	Partner string          `json:"partner"`
+	MatchID string          `json:"match_id"`
+	Results []*reportResult `json:"results"`
+	Diff    *resultDiff     `json:"diff,omitempty"`
+}
+
+// reportResult is a completed result with its match rates. The source
+// counts are those of the local run that produced the result, without
+// which the rates are unknown.
+type reportResult struct {
+	Time  time.Time    `json:"time"`
+	Id    string       `json:"id"`
+	RunID string       `json:"run_id,omitempty"`
+	Rates []*matchRate `json:"rates"`
+}
+
+// matchRate is the number of matched identifiers of a type over the number
+// of identifiers sent.
+type matchRate struct {
+	Type    string   `json:"type"`
+	Source  int64    `json:"source"`
+	Matched int64    `json:"matched"`
+	Rate    *float64 `json:"rate,omitempty"`
+}
+
+// resultDiff is the change of the match rates from a result to another.
+type resultDiff struct {
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Rates []*rateDiff `json:"rates"`
+}
+
+type rateDiff struct {
+	Type          string   `json:"type"`
+	FromMatched   int64    `json:"from_matched"`
+	ToMatched     int64    `json:"to_matched"`
+	MatchedChange int64    `json:"matched_change"`
+	FromRate      *float64 `json:"from_rate,omitempty"`
+	ToRate        *float64 `json:"to_rate,omitempty"`
+	RateChange    *float64 `json:"rate_change,omitempty"`
+}
+
+// totalType is the name of the rate of all the identifier types.
+const totalType = "total"
+
+func newMatchRate(name string, source, matched int64, known bool) *matchRate {
+	r := &matchRate{Type: name, Source: source, Matched: matched}
+	if known && source > 0 {
+		rate := float64(matched) / float64(source)
+		r.Rate = &rate
+	}
+	return r
+}
+
+// matchRates returns the match rates of the types sent or matched, and
+// their total. The rates are unknown without source insights.
+func matchRates(matched, source *v1.Insights) []*matchRate {
+	var rates []*matchRate
+	var totalSource, totalMatched int64
+	for _, idType := range util.IdentifierTypes.Types() {
+		var sent int64
+		if source != nil {
+			sent = *idType.Counter(source)
+		}
+		n := *idType.Counter(matched)
+		if sent == 0 && n == 0 {
+			continue
+		}
+		rates = append(rates, newMatchRate(idType.Name, sent, n, source != nil))
+		totalSource += sent
+		totalMatched += n
+	}
+	return append(rates, newMatchRate(totalType, totalSource, totalMatched, source != nil))
+}
+
+// diffRates returns the change of the match rates of the types of either
+// result.
+func diffRates(from, to []*matchRate) []*rateDiff {
+	fromRates := make(map[string]*matchRate, len(from))
+	for _, r := range from {
+		fromRates[r.Type] = r
+	}
+	toRates := make(map[string]*matchRate, len(to))
+	for _, r := range to {
+		toRates[r.Type] = r
+	}
+
+	names := make([]string, 0, len(util.IdentifierTypes.Types())+1)
+	for _, idType := range util.IdentifierTypes.Types() {
+		names = append(names, idType.Name)
+	}
+	names = append(names, totalType)
+
+	var diffs []*rateDiff
+	for _, name := range names {
+		f, t := fromRates[name], toRates[name]
+		if f == nil && t == nil {
+			continue
+		}
+		d := &rateDiff{Type: name}
+		if f != nil {
+			d.FromMatched, d.FromRate = f.Matched, f.Rate
+		}
+		if t != nil {
+			d.ToMatched, d.ToRate = t.Matched, t.Rate
+		}
+		d.MatchedChange = d.ToMatched - d.FromMatched
+		if d.FromRate != nil && d.ToRate != nil {
+			change := *d.ToRate - *d.FromRate
+			d.RateChange = &change
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// Run prints the match rates of the results of the match, and their diff
+// with --diff.
+func (m *MatchReportCmd) Run(cli *CliContext) error {
+	report, err := m.report(cli)
+	if err != nil {
+		return err
+	}
+	if m.Output == "csv" {
+		return writeReportCSV(os.Stdout, report)
+	}
+	return printJson(report)
+}
+
+// report computes the match rates of the completed results of the match,
+// thresholded and clamped like match run does, with the source insights of
+// the local runs that produced them.
+func (m *MatchReportCmd) report(cli *CliContext) (*matchReport, error) {
+	if len(m.Diff) != 0 && len(m.Diff) != 2 {
+		return nil, fmt.Errorf("--diff requires two result IDs")
+	}
+
+	partner := cli.config.findPartner(m.Partner)
+	if partner == nil {
+		return nil, fmt.Errorf("partner %s does not exist", m.Partner)
+	}
+
+	client, err := partner.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	res, err := client.GetMatchResults(cli.ctx, &v1.GetExternalMatchResultsReq{MatchUid: m.MatchID})
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := readHistory(cli, m.Partner, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	runs := make(map[string]*historyEntry, len(history))
+	for _, entry := range history {
+		if entry.MatchID == m.MatchID && entry.MatchResultID != "" {
+			runs[entry.MatchResultID] = entry
+		}
+	}
+
+	report := &matchReport{Time: time.Now().UTC(), Partner: m.Partner, MatchID: m.MatchID, Results: []*reportResult{}}
+	for _, result := range res.Results {
+		if result.State != v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_COMPLETED || result.Insights == nil {
+			continue
+		}
+		r := &reportResult{Time: result.UpdatedAt.AsTime(), Id: result.Uid}
+
+		var source *v1.Insights
+		if run := runs[result.Uid]; run != nil {
+			r.RunID, source = run.ID, run.Source
+		}
+		util.ThresholdAndClampMatchResult(result, source)
+		r.Rates = matchRates(result.Insights, source)
+		report.Results = append(report.Results, r)
+	}
+	sort.SliceStable(report.Results, func(i, j int) bool {
+		return report.Results[i].Time.Before(report.Results[j].Time)
+	})
+
+	if len(m.Diff) == 2 {
+		var from, to *reportResult
+		for _, r := range report.Results {
+			if r.Id == m.Diff[0] {
+				from = r
+			}
+			if r.Id == m.Diff[1] {
+				to = r
+			}
+		}
+		for i, r := range []*reportResult{from, to} {
+			if r == nil {
+				return nil, fmt.Errorf("no completed result %s for match %s", m.Diff[i], m.MatchID)
+			}
+		}
+		report.Diff = &resultDiff{From: from.Id, To: to.Id, Rates: diffRates(from.Rates, to.Rates)}
+	}
+	return report, nil
+}
+
+// formatRate formats an optional rate, empty when unknown.
+func formatRate(rate *float64) string {
+	if rate == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*rate, 'f', 6, 64)
+}
+
+// writeReportCSV writes a row per result and type of the report, or a row
+// per type of its diff when it has one.
+func writeReportCSV(out io.Writer, report *matchReport) error {
+	w := csv.NewWriter(out)
+	if report.Diff != nil {
+		w.Write([]string{"type", "from_matched", "to_matched", "matched_change", "from_rate", "to_rate", "rate_change"})
+		for _, d := range report.Diff.Rates {
+			w.Write([]string{
+				d.Type,
+				strconv.FormatInt(d.FromMatched, 10),
+				strconv.FormatInt(d.ToMatched, 10),
+				strconv.FormatInt(d.MatchedChange, 10),
+				formatRate(d.FromRate),
+				formatRate(d.ToRate),
+				formatRate(d.RateChange),
+			})
+		}
+	} else {
+		w.Write([]string{"time", "result_id", "run_id", "type", "source", "matched", "rate"})
+		for _, r := range report.Results {
+			for _, rate := range r.Rates {
+				w.Write([]string{
+					r.Time.Format(time.RFC3339),
+					r.Id,
+					r.RunID,
+					rate.Type,
+					strconv.FormatInt(rate.Source, 10),
+					strconv.FormatInt(rate.Matched, 10),
+					formatRate(rate.Rate),
+				})
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/optable/match-cli/pkg/dcntest"
+)
+
+func TestMatchReport(t *testing.T) {
+	dcn := dcntest.NewServer(testIdentifiers(40, 200))
+	defer dcn.Close()
+	cli := newTestCli(t)
+
+	run := newTestMatch(t, cli, dcn)
+	first, err := run.run(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Dir(run.Files[0]), filepath.Base(run.Files[0]), testIdentifiers(0, 50))
+	second, err := run.run(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := (&MatchReportCmd{Partner: run.Partner, MatchID: run.MatchID, Diff: []string{first.Id, second.Id}}).report(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 2 || report.Results[0].Id != first.Id || report.Results[1].Id != second.Id {
+		t.Fatalf("want the 2 results, oldest first, got %+v", report.Results)
+	}
+	for i, want := range []float64{0.6, 0.2} {
+		rates := report.Results[i].Rates
+		if len(rates) != 2 || rates[0].Type != "emails" || rates[1].Type != totalType {
+			t.Fatalf("want the rates of emails and their total, got %+v", rates)
+		}
+		if rate := rates[0].Rate; rate == nil || *rate != want {
+			t.Fatalf("want a match rate of %v, got %v", want, rate)
+		}
+	}
+
+	d := report.Diff.Rates[0]
+	if d.MatchedChange != -50 || d.RateChange == nil || *d.RateChange > -0.39 || *d.RateChange < -0.41 {
+		t.Fatalf("unexpected diff %+v", d)
+	}
+
+	var out bytes.Buffer
+	if err := writeReportCSV(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 || lines[1] != "emails,60,10,-50,0.600000,0.200000,-0.400000" {
+		t.Fatalf("unexpected diff csv %q", out.String())
+	}
+	report.Diff = nil
+	out.Reset()
+	if err := writeReportCSV(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 5 || !strings.HasSuffix(lines[1], ",emails,100,60,0.600000") {
+		t.Fatalf("unexpected csv %q", out.String())
+	}
+
+	if _, err := (&MatchReportCmd{Partner: run.Partner, MatchID: run.MatchID, Diff: []string{first.Id, "unknown"}}).report(cli); err == nil {
+		t.Fatal("want the diff of an unknown result to fail")
+	}
+}
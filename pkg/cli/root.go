@@ -14,9 +14,13 @@ var version string
 type Cli struct {
 	Verbose int `opt:"" short:"v" type:"counter" help:"Enable debug mode."`
 
-	Version VersionCmd `cmd:"" help:"Show match-cli version."`
-	Partner PartnerCmd `cmd:"" help:"Partner command."`
-	Match   MatchCmd   `cmd:"" help:"Match command."`
+	Version  VersionCmd  `cmd:"" help:"Show match-cli version."`
+	Partner  PartnerCmd  `cmd:"" help:"Partner command."`
+	Match    MatchCmd    `cmd:"" help:"Match command."`
+	Audience AudienceCmd `cmd:"" help:"Audience command."`
+	Bench    BenchCmd    `cmd:"" help:"Benchmark the PSI protocols locally."`
+	Selftest SelftestCmd `cmd:"" help:"Run a match against a local fake DCN to verify match-cli and the match files."`
+	Daemon   DaemonCmd   `cmd:"" help:"Run recurring matches on the cron expressions of a schedule file."`
 }
 
 type VersionCmd struct{}
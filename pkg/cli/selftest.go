@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/dcntest"
+)
+
+type SelftestCmd struct {
+	Files      []string      `arg:"" optional:"" help:"Files or glob patterns to match against the fake DCN, synthetic identifiers are matched when none are given"`
+	Size       int64         `default:"1000" help:"Number of synthetic identifiers, when no file is given"`
+	Overlap    float64       `default:"0.5" help:"Ratio of the identifiers also held by the fake DCN, between 0 and 1"`
+	Protocols  []string      `default:"dhpsi" help:"PSI protocols in order of preference (dhpsi, npsi, bpsi, kkrtpsi)"`
+	RunTimeout time.Duration `default:"10m" help:"Timeout for the match operation"`
+	InputFlags
+}
+
+// selftestResult is the outcome of a match run against the fake DCN.
+type selftestResult struct {
+	Time        time.Time    `json:"time"`
+	Passed      bool         `json:"passed"`
+	Identifiers int64        `json:"identifiers"`
+	Expected    *v1.Insights `json:"expected"`
+	Result      *matchResult `json:"result"`
+}
+
+// writeSyntheticIdentifiers writes size synthetic identifiers to a file
+// in dir and returns its path.
+func writeSyntheticIdentifiers(ctx context.Context, dir string, size int64) (string, error) {
+	path := filepath.Join(dir, "identifiers.txt")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriter(file)
+	for identifier := range syntheticIdentifiers(ctx, 0, size) {
+		_, _ = w.Write(identifier)
+		_ = w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return "", err
+	}
+	return path, file.Close()
+}
+
+// dcnIdentifiers returns the identifiers of the fake DCN, as many as the
+// unique identifiers of the match files, common of which are taken from
+// them.
+func dcnIdentifiers(ctx context.Context, uniqueIdentifiers *util.UniqueIdentifiers, common int64) ([][]byte, error) {
+	identifiers := make([][]byte, 0, uniqueIdentifiers.Len())
+	err := uniqueIdentifiers.Stream(ctx, func(ctx context.Context, records <-chan []byte) error {
+		for identifier := range records {
+			if int64(len(identifiers)) == common {
+				break
+			}
+			identifiers = append(identifiers, identifier)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// synthetic identifiers numbered past the ones of the match files
+	n := uniqueIdentifiers.Len()
+	for identifier := range syntheticIdentifiers(ctx, n, 2*n-common) {
+		identifiers = append(identifiers, identifier)
+	}
+	return identifiers, nil
+}
+
+// selftest matches the identifiers of the files, or synthetic ones, with a
+// fake DCN running in-process, going through partner connect, match create
+// and match run, and compares the matched identifiers with the expected
+// ones. The partner registered with the fake DCN is not saved in the config.
+func (s *SelftestCmd) selftest(cli *CliContext) (*selftestResult, error) {
+	ctx := withInfoLogger(cli.ctx)
+
+	if s.Overlap < 0 || s.Overlap > 1 {
+		return nil, fmt.Errorf("--overlap must be between 0 and 1")
+	}
+	if _, err := parsePSIProtocols(s.Protocols); err != nil {
+		return nil, err
+	}
+	for _, path := range s.Files {
+		if path == stdinPath {
+			return nil, fmt.Errorf("selftest cannot read identifiers from stdin")
+		}
+	}
+
+	dir, err := os.MkdirTemp(s.TempDir, "match-cli-selftest-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, flags := s.Files, s.InputFlags
+	if len(files) == 0 {
+		if s.Size <= 0 {
+			return nil, fmt.Errorf("--size must be positive")
+		}
+		path, err := writeSyntheticIdentifiers(ctx, dir, s.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write synthetic identifiers: %w", err)
+		}
+		files = []string{path}
+		flags = InputFlags{Format: "text", MaxMemory: s.MaxMemory, TempDir: s.TempDir, IdTypeFlags: s.IdTypeFlags}
+	}
+
+	uniqueIdentifiers, _, err := loadUniqueIdentifiers(ctx, files, &flags, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer uniqueIdentifiers.Close()
+
+	// rounded to the nearest, all the identifiers for an overlap close to 1
+	common := int64(float64(uniqueIdentifiers.Len())*s.Overlap + 0.5)
+	identifiers, err := dcnIdentifiers(ctx, uniqueIdentifiers, common)
+	if err != nil {
+		return nil, err
+	}
+	expected := util.GetIdentifiersInsights(identifiers[:common])
+
+	dcn := dcntest.NewServer(identifiers)
+	defer dcn.Close()
+	info(ctx).Msgf("started fake DCN on %s holding %d identifiers, %d in common", dcn.URL, len(identifiers), common)
+
+	selftestCli := &CliContext{ctx: cli.ctx, configPath: filepath.Join(dir, "config.json")}
+	partner, err := (&PartnerConnectCmd{Name: "selftest", Token: dcn.InviteToken()}).connect(selftestCli)
+	if err != nil {
+		return nil, err
+	}
+	created, err := (&MatchCreateCmd{Partner: partner.Name, Name: "selftest", IdTypeFlags: flags.IdTypeFlags}).create(selftestCli)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create match: %w", err)
+	}
+
+	run := &MatchRunCmd{
+		Partner:     partner.Name,
+		InitTimeout: time.Minute,
+		RunTimeout:  s.RunTimeout,
+		MatchID:     created.MatchUid,
+		Files:       files,
+		Protocols:   s.Protocols,
+		InputFlags:  flags,
+	}
+	result, err := run.run(selftestCli)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &selftestResult{
+		Time:        time.Now().UTC(),
+		Passed:      result.Results != nil,
+		Identifiers: uniqueIdentifiers.Len(),
+		Expected:    expected,
+		Result:      result,
+	}
+	for _, t := range util.IdentifierTypes.Types() {
+		if res.Passed && *t.Counter(result.Results) != *t.Counter(expected) {
+			res.Passed = false
+		}
+	}
+	return res, nil
+}
+
+// Run runs the selftest and prints its result, failing when the matched
+// identifiers differ from the expected ones.
+func (s *SelftestCmd) Run(cli *CliContext) error {
+	res, err := s.selftest(cli)
+	if err != nil {
+		return err
+	}
+	if err := printJson(res); err != nil {
+		return err
+	}
+	if !res.Passed {
+		return fmt.Errorf("selftest failed, the matched identifiers differ from the expected ones")
+	}
+	return nil
+}
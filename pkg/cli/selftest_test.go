@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelftest(t *testing.T) {
+	cli := newTestCli(t)
+	for _, tc := range []struct {
+		overlap float64
+		common  int64
+	}{
+		{0.5, 50},
+		{0, 0},
+		{1, 100},
+		// rounds to all the identifiers
+		{0.999, 100},
+	} {
+		s := &SelftestCmd{
+			Size:       100,
+			Overlap:    tc.overlap,
+			Protocols:  []string{"dhpsi"},
+			RunTimeout: time.Minute,
+			InputFlags: InputFlags{MaxMemory: 512, TempDir: t.TempDir()},
+		}
+		res, err := s.selftest(cli)
+		if err != nil {
+			t.Fatalf("overlap %v: %v", tc.overlap, err)
+		}
+		if !res.Passed || res.Identifiers != 100 || res.Expected.Emails != tc.common {
+			t.Fatalf("overlap %v: want a passed selftest matching %d of 100 identifiers, got %+v", tc.overlap, tc.common, res)
+		}
+	}
+
+	for _, s := range []*SelftestCmd{
+		{Size: 100, Overlap: 1.5, Protocols: []string{"dhpsi"}},
+		{Size: 0, Overlap: 0.5, Protocols: []string{"dhpsi"}},
+		{Size: 100, Overlap: 0.5, Protocols: []string{"unknown"}},
+		{Files: []string{stdinPath}, Overlap: 0.5, Protocols: []string{"dhpsi"}},
+	} {
+		if _, err := s.selftest(cli); err == nil {
+			t.Fatalf("want invalid flags %+v to fail", s)
+		}
+	}
+}
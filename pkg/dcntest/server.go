@@ -0,0 +1,540 @@
+// Package dcntest provides a fake DCN for end-to-end tests of match-cli, in
+// the spirit of net/http/httptest. The fake DCN serves the match API with
+// the protobuf over HTTP contract of the match-cli client, and receives the
+// matches it runs with a real PSI receiver.
+package dcntest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/auth"
+	"github.com/optable/match-cli/internal/util"
+	"github.com/optable/match-cli/pkg/header"
+	"github.com/optable/match-cli/pkg/match"
+	"github.com/optable/match-cli/pkg/network"
+	"github.com/optable/match/pkg/psi"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Paths of the match API endpoints served by the fake DCN.
+const (
+	PathRegisterPartner = "/partner/register"
+	PathCreateMatch     = "/match/create"
+	PathListMatches     = "/match/list"
+	PathRunMatch        = "/match/run"
+	PathGetResult       = "/match/get-result"
+	PathGetResults      = "/match/get-results"
+)
+
+// Server is a fake DCN listening on the loopback interface. Its exported
+// fields configure its behaviour and must not be changed after Start.
+type Server struct {
+	// URL is the base URL of the match API, of the form http://ipaddr:port.
+	URL string
+
+	// Protocols are the PSI protocols supported by the receiver of the
+	// DCN, all the protocols of the match library by default.
+	Protocols []psi.Protocol
+
+	// Intercept, when set, is called with the path and the decoded request
+	// of every authenticated call before it is served. A non-nil response
+	// or error replaces the response of the fake DCN, errors created with
+	// Error setting the status code.
+	Intercept func(path string, req proto.Message) (proto.Message, error)
+
+	// Latency delays the responses of the endpoints, by path.
+	Latency map[string]time.Duration
+
+	// RunPending is the number of calls to /match/run of a match result
+	// answered without an endpoint, as when the DCN is not ready yet.
+	RunPending int
+
+	// ResultPending is the number of calls to /match/get-result of a match
+	// result answered with the pending state, even when the PSI receiver is
+	// done.
+	ResultPending int
+
+	// DifferentialPrivacy, when set, adds noise to the insights of the
+	// completed match results.
+	DifferentialPrivacy *DifferentialPrivacy
+
+	identifiers [][]byte
+	token       string
+	server      *httptest.Server
+	ctx         context.Context
+	cancel      context.CancelFunc
+	receivers   sync.WaitGroup
+
+	mu       sync.Mutex
+	calls    map[string]int
+	partners map[string]bool
+	matches  map[string]*v1.ExternalMatch
+	results  map[string]*matchResult
+	noise    *mathrand.Rand
+}
+
+// DifferentialPrivacy configures the noise added to the insights of the
+// match results, like a DCN protecting the privacy of its audience.
+type DifferentialPrivacy struct {
+	// Threshold is sent with the insights, below which clients should
+	// consider the counts as noise.
+	Threshold int32
+	// MaxNoise bounds the uniform noise added to every count.
+	MaxNoise int64
+	// Seed seeds the noise, so that tests are reproducible.
+	Seed int64
+}
+
+// matchResult is a match result received by the DCN.
+type matchResult struct {
+	endpoint       string
+	certificatePem string
+	runCalls       int
+	resultCalls    int
+	result         *v1.ExternalMatchResult
+}
+
+// route is an endpoint of the match API.
+type route struct {
+	authenticated bool
+	newRequest    func() proto.Message
+	serve         func(ctx context.Context, req proto.Message) (proto.Message, error)
+}
+
+// statusError is an error of the match API, sent as a v1.Error body.
+type statusError struct {
+	code       int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// Error returns an error of the match API, sent with the status code and a
+// v1.Error body holding the message.
+func Error(code int, message string) error {
+	return &statusError{code: code, message: message}
+}
+
+// ErrorRetryAfter returns an error like Error, also sent with a
+// Retry-After header asking to retry after retryAfter, rounded up to the
+// second.
+func ErrorRetryAfter(code int, message string, retryAfter time.Duration) error {
+	return &statusError{code: code, message: message, retryAfter: retryAfter}
+}
+
+func errorf(code int, format string, a ...interface{}) error {
+	return Error(code, fmt.Sprintf(format, a...))
+}
+
+// NewServer starts and returns a new fake DCN holding the identifiers. The
+// caller should call Close when finished, to shut it down.
+func NewServer(identifiers [][]byte) *Server {
+	s := NewUnstartedServer(identifiers)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new fake DCN holding the identifiers but
+// doesn't start it, so that its configuration can be changed before calling
+// Start.
+func NewUnstartedServer(identifiers [][]byte) *Server {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		panic(fmt.Sprintf("dcntest: failed to generate invite token: %v", err))
+	}
+
+	s := &Server{
+		Protocols:   []psi.Protocol{psi.ProtocolDHPSI, psi.ProtocolNPSI, psi.ProtocolBPSI, psi.ProtocolKKRTPSI},
+		identifiers: identifiers,
+		token:       hex.EncodeToString(token[:]),
+		calls:       make(map[string]int),
+		partners:    make(map[string]bool),
+		matches:     make(map[string]*v1.ExternalMatch),
+		results:     make(map[string]*matchResult),
+	}
+
+	mux := http.NewServeMux()
+	for path, r := range map[string]*route{
+		PathRegisterPartner: {false, func() proto.Message { return &v1.RegisterPartnerReq{} }, s.registerPartner},
+		PathCreateMatch:     {true, func() proto.Message { return &v1.CreateExternalMatchReq{} }, s.createMatch},
+		PathListMatches:     {true, func() proto.Message { return &v1.ListExternalMatchReq{} }, s.listMatches},
+		PathRunMatch:        {true, func() proto.Message { return &v1.RunExternalMatchReq{} }, s.runMatch},
+		PathGetResult:       {true, func() proto.Message { return &v1.GetExternalMatchResultReq{} }, s.getResult},
+		PathGetResults:      {true, func() proto.Message { return &v1.GetExternalMatchResultsReq{} }, s.getResults},
+	} {
+		mux.Handle(path, s.handler(path, r))
+	}
+	s.server = httptest.NewUnstartedServer(mux)
+	return s
+}
+
+// Start starts the fake DCN.
+func (s *Server) Start() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if dp := s.DifferentialPrivacy; dp != nil {
+		s.noise = mathrand.New(mathrand.NewSource(dp.Seed))
+	}
+	s.server.Start()
+	s.URL = s.server.URL
+}
+
+// Close shuts down the fake DCN and its PSI receivers.
+func (s *Server) Close() {
+	s.cancel()
+	s.server.Close()
+	s.receivers.Wait()
+}
+
+// Calls returns the number of calls to the endpoint at path.
+func (s *Server) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+// MatchResult returns the match result with the uid, or nil.
+func (s *Server) MatchResult(uid string) *v1.ExternalMatchResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res := s.results[uid]; res != nil {
+		return proto.Clone(res.result).(*v1.ExternalMatchResult)
+	}
+	return nil
+}
+
+// InviteToken returns the token connecting a partner to the DCN with
+// match-cli partner connect.
+func (s *Server) InviteToken() string {
+	token, err := protojson.Marshal(&v1.PartnerInitToken{SandboxInfo: s.URL, Token: s.token})
+	if err != nil {
+		panic(fmt.Sprintf("dcntest: failed to marshal invite token: %v", err))
+	}
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+// handler decodes the request of the route and encodes its response or
+// error, authenticating the partner when required.
+func (s *Server) handler(path string, r *route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, httpReq *http.Request) {
+		s.mu.Lock()
+		s.calls[path]++
+		s.mu.Unlock()
+
+		res, err := func() (proto.Message, error) {
+			if latency := s.Latency[path]; latency > 0 {
+				select {
+				case <-time.After(latency):
+				case <-httpReq.Context().Done():
+					return nil, httpReq.Context().Err()
+				}
+			}
+			if r.authenticated {
+				if err := s.authenticate(httpReq); err != nil {
+					return nil, err
+				}
+			}
+
+			body, err := ioutil.ReadAll(httpReq.Body)
+			if err != nil {
+				return nil, errorf(http.StatusBadRequest, "failed to read request: %v", err)
+			}
+			req := r.newRequest()
+			if err := proto.Unmarshal(body, req); err != nil {
+				return nil, errorf(http.StatusBadRequest, "failed to decode request: %v", err)
+			}
+
+			if r.authenticated && s.Intercept != nil {
+				if res, err := s.Intercept(path, req); res != nil || err != nil {
+					return res, err
+				}
+			}
+			return r.serve(httpReq.Context(), req)
+		}()
+
+		code := http.StatusOK
+		if err != nil {
+			code = http.StatusInternalServerError
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				code = statusErr.code
+				if statusErr.retryAfter > 0 {
+					seconds := (statusErr.retryAfter + time.Second - 1) / time.Second
+					w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+				}
+			}
+			res = &v1.Error{Message: err.Error()}
+		}
+
+		payload, err := proto.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/protobuf")
+		w.WriteHeader(code)
+		_, _ = w.Write(payload)
+	})
+}
+
+// authenticate verifies the bearer token of the request, which must be
+// signed with the key of a registered partner.
+func (s *Server) authenticate(r *http.Request) error {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	_, err := jwt.ParseWithClaims(bearer, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		issuer := token.Claims.(*jwt.StandardClaims).Issuer
+		s.mu.Lock()
+		registered := s.partners[issuer]
+		s.mu.Unlock()
+		if !registered {
+			return nil, errors.New("unknown partner")
+		}
+		return auth.ParsePublicKey(issuer)
+	})
+	if err != nil {
+		return errorf(http.StatusUnauthorized, "invalid token: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) registerPartner(ctx context.Context, r proto.Message) (proto.Message, error) {
+	req := r.(*v1.RegisterPartnerReq)
+	if req.Token != s.InviteToken() {
+		return nil, errorf(http.StatusUnauthorized, "invalid invite token")
+	}
+	if _, err := auth.ParsePublicKey(req.PublicKey); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid public key: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partners[req.PublicKey] = true
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) createMatch(ctx context.Context, r proto.Message) (proto.Message, error) {
+	req := r.(*v1.CreateExternalMatchReq)
+	if req.MatchUid == "" {
+		return nil, errorf(http.StatusBadRequest, "missing match uid")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.matches[req.MatchUid] = &v1.ExternalMatch{MatchUid: req.MatchUid, Name: req.Name}
+	return &v1.CreateExternalMatchRes{MatchUid: req.MatchUid}, nil
+}
+
+func (s *Server) listMatches(ctx context.Context, r proto.Message) (proto.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &v1.ListExternalMatchRes{}
+	for _, m := range s.matches {
+		res.Matches = append(res.Matches, proto.Clone(m).(*v1.ExternalMatch))
+	}
+	return res, nil
+}
+
+// runMatch starts a PSI receiver for the match result, which accepts a
+// single sender presenting the client certificate of the request, once
+// RunPending calls were answered without an endpoint.
+func (s *Server) runMatch(ctx context.Context, r proto.Message) (proto.Message, error) {
+	req := r.(*v1.RunExternalMatchReq)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.matches[req.MatchUid] == nil {
+		return nil, errorf(http.StatusNotFound, "match %s not found", req.MatchUid)
+	}
+	if req.MatchResultUid == "" {
+		return nil, errorf(http.StatusBadRequest, "missing match result uid")
+	}
+	existing := s.results[req.MatchResultUid]
+	if existing == nil {
+		now := timestamppb.Now()
+		existing = &matchResult{
+			result: &v1.ExternalMatchResult{
+				Uid:       req.MatchResultUid,
+				MatchUid:  req.MatchUid,
+				State:     v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_PENDING,
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+		}
+		s.results[req.MatchResultUid] = existing
+	}
+	existing.runCalls++
+	if existing.runCalls <= s.RunPending {
+		return &v1.RunExternalMatchRes{MatchResultUid: req.MatchResultUid}, nil
+	}
+	if existing.endpoint != "" {
+		return &v1.RunExternalMatchRes{
+			MatchResultUid:       req.MatchResultUid,
+			Endpoint:             existing.endpoint,
+			ServerCertificatePem: existing.certificatePem,
+		}, nil
+	}
+
+	tlsConfig, certificatePem, err := receiverTLSConfig(req.ClientCertificatePem)
+	if err != nil {
+		return nil, err
+	}
+	l, err := network.Listen(s.ctx, "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	existing.endpoint = l.Addr().String()
+	existing.certificatePem = certificatePem
+
+	s.receivers.Add(1)
+	go s.receive(existing, l, tlsConfig)
+
+	return &v1.RunExternalMatchRes{
+		MatchResultUid:       req.MatchResultUid,
+		Endpoint:             existing.endpoint,
+		ServerCertificatePem: existing.certificatePem,
+	}, nil
+}
+
+// receiverTLSConfig creates an ephemereal certificate for the receiver and
+// the TLS config pinning the client certificate.
+func receiverTLSConfig(clientCertificatePem string) (*tls.Config, string, error) {
+	clientCert, err := auth.ParseCertificatePEM(clientCertificatePem)
+	if err != nil {
+		return nil, "", errorf(http.StatusBadRequest, "invalid client certificate: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	certificate, err := auth.NewEphemerealCertificate(key)
+	if err != nil {
+		return nil, "", err
+	}
+	tlsCertificate, err := certificate.GetTLSCertificate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &tls.Config{
+		Certificates:          []tls.Certificate{tlsCertificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: auth.NewVerifyPinnedCertificate(clientCert),
+	}, string(certificate.CertificatePem), nil
+}
+
+// receive runs the PSI receiver of the match result and records its
+// insights.
+func (s *Server) receive(res *matchResult, l net.Listener, tlsConfig *tls.Config) {
+	defer s.receivers.Done()
+	defer l.Close()
+
+	identifiers := make(chan []byte)
+	go func() {
+		defer close(identifiers)
+		for _, identifier := range s.identifiers {
+			select {
+			case identifiers <- identifier:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	h := &header.Header{Protocols: s.Protocols, ClientVersion: "dcntest", MatchResultUID: res.result.Uid}
+	intersection, err := match.ReceiveWithHeader(s.ctx, l, tlsConfig, h, int64(len(s.identifiers)), identifiers)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		res.result.State = v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_ERRORED
+		res.result.ErrorMsg = err.Error()
+	} else {
+		res.result.State = v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_COMPLETED
+		res.result.Insights = util.GetIdentifiersInsights(intersection)
+		res.result.Insights.ComputedAt = timestamppb.Now()
+		s.addNoise(res.result.Insights)
+	}
+	res.result.UpdatedAt = timestamppb.Now()
+}
+
+// addNoise adds the noise of the differential privacy settings to the
+// insights, which can make counts negative or exceed the number of
+// identifiers sent.
+func (s *Server) addNoise(insights *v1.Insights) {
+	dp := s.DifferentialPrivacy
+	if dp == nil {
+		return
+	}
+	insights.DifferentialPrivacyThreshold = dp.Threshold
+	if dp.MaxNoise <= 0 {
+		return
+	}
+	for _, t := range util.IdentifierTypes.Types() {
+		*t.Counter(insights) += s.noise.Int63n(2*dp.MaxNoise+1) - dp.MaxNoise
+	}
+}
+
+// getResult returns the match result as it is, pending until the PSI
+// receiver is done or until ResultPending calls were answered, so that
+// clients poll it like they poll a DCN.
+func (s *Server) getResult(ctx context.Context, r proto.Message) (proto.Message, error) {
+	req := r.(*v1.GetExternalMatchResultReq)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := s.results[req.MatchResultUid]
+	if res == nil {
+		return nil, errorf(http.StatusNotFound, "match result %s not found", req.MatchResultUid)
+	}
+	res.resultCalls++
+	result := proto.Clone(res.result).(*v1.ExternalMatchResult)
+	if res.resultCalls <= s.ResultPending {
+		result.State = v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_PENDING
+		result.Insights = nil
+	}
+	return &v1.GetExternalMatchResultRes{MatchResult: result}, nil
+}
+
+func (s *Server) getResults(ctx context.Context, r proto.Message) (proto.Message, error) {
+	req := r.(*v1.GetExternalMatchResultsReq)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &v1.GetExternalMatchResultsRes{}
+	for _, mr := range s.results {
+		if mr.result.MatchUid == req.MatchUid {
+			res.Results = append(res.Results, proto.Clone(mr.result).(*v1.ExternalMatchResult))
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,176 @@
+package dcntest_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/optable/match-api/match/v1"
+	"github.com/optable/match-cli/internal/client"
+	"github.com/optable/match-cli/pkg/dcntest"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// newPartner returns a client of the DCN signing its tokens with a new key,
+// and the encoded public key.
+func newPartner(t *testing.T, dcn *dcntest.Server) (*client.OptableRpcClient, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(der)
+
+	tokenSource := client.TokenSourceFn(func(_ *http.Request) (string, error) {
+		return jwt.NewWithClaims(jwt.SigningMethodES256, jwt.StandardClaims{
+			Issuer:    publicKey,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		}).SignedString(key)
+	})
+	return client.NewClient(dcn.URL, tokenSource), publicKey
+}
+
+func newRegisteredPartner(t *testing.T, dcn *dcntest.Server) *client.OptableRpcClient {
+	t.Helper()
+	c, publicKey := newPartner(t, dcn)
+	if err := c.RegisterPartner(context.Background(), &v1.RegisterPartnerReq{PublicKey: publicKey, Token: dcn.InviteToken()}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRegisterPartner(t *testing.T) {
+	dcn := dcntest.NewServer(nil)
+	defer dcn.Close()
+	c, publicKey := newPartner(t, dcn)
+	ctx := context.Background()
+
+	// unregistered partners are rejected
+	if _, err := c.ListMatches(ctx, &v1.ListExternalMatchReq{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("want unauthorized, got %v", err)
+	}
+	if err := c.RegisterPartner(ctx, &v1.RegisterPartnerReq{PublicKey: publicKey, Token: "invalid"}); err == nil || !strings.Contains(err.Error(), "invalid invite token") {
+		t.Fatalf("want invalid invite token, got %v", err)
+	}
+
+	if err := c.RegisterPartner(ctx, &v1.RegisterPartnerReq{PublicKey: publicKey, Token: dcn.InviteToken()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateMatch(ctx, &v1.CreateExternalMatchReq{MatchUid: "match", Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.ListMatches(ctx, &v1.ListExternalMatchReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 || res.Matches[0].MatchUid != "match" || res.Matches[0].Name != "test" {
+		t.Fatalf("unexpected matches %v", res.Matches)
+	}
+	if calls := dcn.Calls(dcntest.PathRegisterPartner); calls != 2 {
+		t.Fatalf("want 2 calls to %s, got %d", dcntest.PathRegisterPartner, calls)
+	}
+}
+
+func TestRunMatchPending(t *testing.T) {
+	dcn := dcntest.NewUnstartedServer(nil)
+	dcn.RunPending = 2
+	dcn.Start()
+	defer dcn.Close()
+	c := newRegisteredPartner(t, dcn)
+	ctx := context.Background()
+
+	if _, err := c.RunMatch(ctx, &v1.RunExternalMatchReq{MatchUid: "unknown", MatchResultUid: "result"}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("want not found, got %v", err)
+	}
+	if _, err := c.CreateMatch(ctx, &v1.CreateExternalMatchReq{MatchUid: "match"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &v1.RunExternalMatchReq{MatchUid: "match", MatchResultUid: "result", ClientCertificatePem: "invalid"}
+	for i := 0; i < 2; i++ {
+		res, err := c.RunMatch(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Endpoint != "" {
+			t.Fatalf("want call %d to be pending, got endpoint %s", i, res.Endpoint)
+		}
+	}
+	if _, err := c.RunMatch(ctx, req); err == nil || !strings.Contains(err.Error(), "invalid client certificate") {
+		t.Fatalf("want invalid client certificate, got %v", err)
+	}
+
+	result := dcn.MatchResult("result")
+	if result == nil || result.State != v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_PENDING {
+		t.Fatalf("want a pending match result, got %v", result)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	dcn := dcntest.NewUnstartedServer(nil)
+	dcn.Intercept = func(path string, req proto.Message) (proto.Message, error) {
+		switch path {
+		case dcntest.PathCreateMatch:
+			if req.(*v1.CreateExternalMatchReq).Name == "forbidden" {
+				return nil, dcntest.Error(http.StatusForbidden, "match name not allowed")
+			}
+		case dcntest.PathGetResult:
+			return &v1.GetExternalMatchResultRes{MatchResult: &v1.ExternalMatchResult{
+				Uid:      req.(*v1.GetExternalMatchResultReq).MatchResultUid,
+				State:    v1.ExternalMatchResultState_EXTERNAL_MATCH_RESULT_STATE_ERRORED,
+				ErrorMsg: "receiver crashed",
+			}}, nil
+		}
+		return nil, nil
+	}
+	dcn.Start()
+	defer dcn.Close()
+	c := newRegisteredPartner(t, dcn)
+	ctx := context.Background()
+
+	_, err := c.CreateMatch(ctx, &v1.CreateExternalMatchReq{MatchUid: "match", Name: "forbidden"})
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") || !strings.Contains(err.Error(), "match name not allowed") {
+		t.Fatalf("want the intercepted error, got %v", err)
+	}
+	if _, err := c.CreateMatch(ctx, &v1.CreateExternalMatchReq{MatchUid: "match", Name: "allowed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.GetResult(ctx, &v1.GetExternalMatchResultReq{MatchResultUid: "result"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MatchResult.Uid != "result" || res.MatchResult.ErrorMsg != "receiver crashed" {
+		t.Fatalf("want the intercepted response, got %v", res.MatchResult)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	dcn := dcntest.NewUnstartedServer(nil)
+	dcn.Latency = map[string]time.Duration{dcntest.PathListMatches: time.Second}
+	dcn.Start()
+	defer dcn.Close()
+	c := newRegisteredPartner(t, dcn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.CreateMatch(ctx, &v1.CreateExternalMatchReq{MatchUid: "match"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListMatches(ctx, &v1.ListExternalMatchReq{}); err == nil {
+		t.Fatal("want the slow endpoint to time out")
+	}
+}
@@ -0,0 +1,358 @@
+package header
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/optable/match/pkg/psi"
+)
+
+// Version is the version of the header frame spoken by this package. Later
+// versions only add capabilities and fields, the frame layout is fixed.
+const Version = 1
+
+// extendedMarker is appended to the one-byte protocol negotiation by senders
+// that speak the header frame. Receivers that only speak the one-byte format
+// ignore it like any unknown protocol, while receivers speaking the header
+// frame respond with it instead of a protocol decision.
+const extendedMarker = 0xff
+
+// magic starts every header frame.
+var magic = [4]byte{'O', 'P', 'S', 'H'}
+
+// Capability is a set of optional features supported by a peer.
+type Capability uint16
+
+const (
+	// CapabilityProtocolFallback is set by senders that retry the match
+	// with their next preferred protocol when the selected one fails.
+	CapabilityProtocolFallback Capability = 1 << iota
+)
+
+// FieldType is the type of an optional TLV field of the header frame.
+// Fields of unknown types are skipped, so that new fields can be added
+// without breaking older peers.
+type FieldType uint8
+
+const (
+	FieldClientVersion FieldType = iota + 1
+	FieldMatchResultUID
+	FieldExpectedCardinality
+)
+
+// Header is the header frame exchanged by peers before running PSI.
+// Senders only send it when Version is set, see NegotiateSender.
+//
+// The frame is made of the magic, the version, the capabilities as a
+// big-endian uint16, the number of protocols followed by the protocols, and
+// the number of fields followed by the fields. Each field is its type, its
+// length as a big-endian uint16 and its value.
+type Header struct {
+	Version      uint8
+	Capabilities Capability
+	// Protocols are the protocols in order of preference for the sender,
+	// and the selected protocol for the receiver.
+	Protocols []psi.Protocol
+
+	ClientVersion       string
+	MatchResultUID      string
+	ExpectedCardinality int64
+}
+
+// Session is the outcome of a protocol negotiation.
+type Session struct {
+	Protocol psi.Protocol
+	// Version is the header version common to both peers, 0 when the peer
+	// only speaks the one-byte format.
+	Version uint8
+	// Capabilities are the capabilities common to both peers.
+	Capabilities Capability
+	// Peer is the header of the peer, nil when the peer only speaks the
+	// one-byte format.
+	Peer *Header
+}
+
+// MarshalBinary encodes the header frame.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if len(h.Protocols) > math.MaxUint8 {
+		return nil, fmt.Errorf("too many protocols in header: %d", len(h.Protocols))
+	}
+
+	var fields [][]byte
+	addField := func(t FieldType, value []byte) error {
+		if len(value) > math.MaxUint16 {
+			return fmt.Errorf("header field %d is too long: %d bytes", t, len(value))
+		}
+		field := make([]byte, 3, 3+len(value))
+		field[0] = byte(t)
+		binary.BigEndian.PutUint16(field[1:], uint16(len(value)))
+		fields = append(fields, append(field, value...))
+		return nil
+	}
+	if h.ClientVersion != "" {
+		if err := addField(FieldClientVersion, []byte(h.ClientVersion)); err != nil {
+			return nil, err
+		}
+	}
+	if h.MatchResultUID != "" {
+		if err := addField(FieldMatchResultUID, []byte(h.MatchResultUID)); err != nil {
+			return nil, err
+		}
+	}
+	if h.ExpectedCardinality != 0 {
+		var cardinality [8]byte
+		binary.BigEndian.PutUint64(cardinality[:], uint64(h.ExpectedCardinality))
+		if err := addField(FieldExpectedCardinality, cardinality[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(magic[:])
+	b.WriteByte(h.Version)
+	_ = binary.Write(&b, binary.BigEndian, uint16(h.Capabilities))
+	b.WriteByte(byte(len(h.Protocols)))
+	for _, p := range h.Protocols {
+		b.WriteByte(byte(p))
+	}
+	b.WriteByte(byte(len(fields)))
+	for _, field := range fields {
+		b.Write(field)
+	}
+	return b.Bytes(), nil
+}
+
+// ReadHeader reads a header frame from r, without reading past its end.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if !bytes.Equal(prefix[:4], magic[:]) {
+		return nil, errors.New("invalid header magic")
+	}
+	h := &Header{
+		Version:      prefix[4],
+		Capabilities: Capability(binary.BigEndian.Uint16(prefix[5:7])),
+	}
+	if h.Version == 0 {
+		return nil, errors.New("invalid header version 0")
+	}
+
+	protocols := make([]byte, prefix[7])
+	if _, err := io.ReadFull(r, protocols); err != nil {
+		return nil, fmt.Errorf("failed to read header protocols: %w", err)
+	}
+	for _, p := range protocols {
+		h.Protocols = append(h.Protocols, psi.Protocol(p))
+	}
+
+	var count [1]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
+		return nil, fmt.Errorf("failed to read header fields: %w", err)
+	}
+	for i := 0; i < int(count[0]); i++ {
+		var fieldPrefix [3]byte
+		if _, err := io.ReadFull(r, fieldPrefix[:]); err != nil {
+			return nil, fmt.Errorf("failed to read header field: %w", err)
+		}
+		value := make([]byte, binary.BigEndian.Uint16(fieldPrefix[1:]))
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, fmt.Errorf("failed to read header field %d: %w", fieldPrefix[0], err)
+		}
+
+		switch FieldType(fieldPrefix[0]) {
+		case FieldClientVersion:
+			h.ClientVersion = string(value)
+		case FieldMatchResultUID:
+			h.MatchResultUID = string(value)
+		case FieldExpectedCardinality:
+			if len(value) != 8 {
+				return nil, fmt.Errorf("invalid expected cardinality field of %d bytes", len(value))
+			}
+			h.ExpectedCardinality = int64(binary.BigEndian.Uint64(value))
+		}
+	}
+
+	return h, nil
+}
+
+// NegotiateSender negotiates the protocol with the receiver from the
+// protocols of local, in order of preference. The header frame is opt-in:
+// when local.Version is 0, the negotiation is the one-byte format of
+// NegotiateSenderProtocol and nothing else is sent, which receivers that
+// reject unknown protocols require. Otherwise the extended marker is
+// appended to the one-byte message, so that receivers that only speak it
+// and ignore unknown protocols select a protocol as before, while receivers
+// speaking the header frame ask for the header of the sender and respond
+// with their own.
+func NegotiateSender(ctx context.Context, rw io.ReadWriter, local *Header) (*Session, error) {
+	release := bindContext(ctx, rw)
+	defer release()
+
+	session, err := negotiateSender(rw, local)
+	return session, contextError(ctx, err)
+}
+
+func negotiateSender(rw io.ReadWriter, local *Header) (*Session, error) {
+	if local.Version == 0 {
+		selected, err := negotiateSenderProtocol(rw, local.Protocols)
+		if err != nil {
+			return nil, err
+		}
+		return &Session{Protocol: selected}, nil
+	}
+
+	// the length, the protocols and the extended marker
+	protocolMessage, err := protocolMessage(local.Protocols, math.MaxUint8, extendedMarker)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFull(rw, protocolMessage); err != nil {
+		return nil, fmt.Errorf("failed to send protocol negotiation message: %w", err)
+	}
+
+	var decision [1]byte
+	if _, err := io.ReadFull(rw, decision[:]); err != nil {
+		return nil, fmt.Errorf("failed to receive PSI protocol decision: %w", err)
+	}
+	if decision[0] != extendedMarker {
+		// the receiver only speaks the one-byte format
+		selected, err := checkDecision(psi.Protocol(decision[0]), local.Protocols)
+		if err != nil {
+			return nil, err
+		}
+		return &Session{Protocol: selected}, nil
+	}
+
+	frame := *local
+	if err := writeHeader(rw, &frame); err != nil {
+		return nil, err
+	}
+	peer, err := ReadHeader(rw)
+	if err != nil {
+		return nil, err
+	}
+	if len(peer.Protocols) != 1 {
+		return nil, fmt.Errorf("invalid PSI protocol decision: %v", peer.Protocols)
+	}
+
+	selected, err := checkDecision(peer.Protocols[0], local.Protocols)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSession(selected, &frame, peer), nil
+}
+
+// NegotiateReceiver is the receiver side of NegotiateSender. It selects the
+// first of the sender's protocols that is also in the protocols of local,
+// and responds in the format spoken by the sender.
+func NegotiateReceiver(ctx context.Context, rw io.ReadWriter, local *Header) (*Session, error) {
+	release := bindContext(ctx, rw)
+	defer release()
+
+	session, err := negotiateReceiver(rw, local)
+	return session, contextError(ctx, err)
+}
+
+func negotiateReceiver(rw io.ReadWriter, local *Header) (*Session, error) {
+	// read length of sender's preferred protocol slice
+	var length [1]byte
+	if _, err := io.ReadFull(rw, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to receive number of desired protocols: %w", err)
+	}
+	// read actual slice of sender's preferred protocols
+	protocolMessage := make([]byte, length[0])
+	if _, err := io.ReadFull(rw, protocolMessage); err != nil {
+		return nil, fmt.Errorf("failed to receive protocol negotiation message: %w", err)
+	}
+
+	extended := false
+	desired := make([]psi.Protocol, 0, len(protocolMessage))
+	for _, p := range protocolMessage {
+		if p == extendedMarker {
+			extended = true
+			continue
+		}
+		desired = append(desired, psi.Protocol(p))
+	}
+
+	if !extended {
+		// respond with the protocol decision, unsupported when there were no matches
+		selected := selectProtocol(desired, local.Protocols)
+		if err := writeFull(rw, []byte{byte(selected)}); err != nil {
+			return nil, fmt.Errorf("failed to send PSI protocol decision: %w", err)
+		}
+		if selected == psi.ProtocolUnsupported {
+			return nil, fmt.Errorf("failed protocol negotiation, no supported protocol in %v", desired)
+		}
+		return &Session{Protocol: selected}, nil
+	}
+
+	if err := writeFull(rw, []byte{extendedMarker}); err != nil {
+		return nil, fmt.Errorf("failed to send PSI protocol decision: %w", err)
+	}
+	peer, err := ReadHeader(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := selectProtocol(peer.Protocols, local.Protocols)
+	frame := *local
+	frame.Version = Version
+	frame.Protocols = []psi.Protocol{selected}
+	if err := writeHeader(rw, &frame); err != nil {
+		return nil, err
+	}
+	if selected == psi.ProtocolUnsupported {
+		return nil, fmt.Errorf("failed protocol negotiation, no supported protocol in %v", peer.Protocols)
+	}
+
+	return newSession(selected, &frame, peer), nil
+}
+
+func writeHeader(w io.Writer, h *Header) error {
+	frame, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := writeFull(w, frame); err != nil {
+		return fmt.Errorf("failed to send header: %w", err)
+	}
+	return nil
+}
+
+func newSession(selected psi.Protocol, local, peer *Header) *Session {
+	version := local.Version
+	if peer.Version < version {
+		version = peer.Version
+	}
+	return &Session{
+		Protocol:     selected,
+		Version:      version,
+		Capabilities: local.Capabilities & peer.Capabilities,
+		Peer:         peer,
+	}
+}
+
+// selectProtocol returns the first of the desired protocols that is
+// supported, or psi.ProtocolUnsupported.
+func selectProtocol(desired, supported []psi.Protocol) psi.Protocol {
+	for _, d := range desired {
+		if d == psi.ProtocolUnsupported {
+			continue
+		}
+		for _, s := range supported {
+			if d == s {
+				return d
+			}
+		}
+	}
+	return psi.ProtocolUnsupported
+}
@@ -0,0 +1,267 @@
+package header
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/optable/match/pkg/psi"
+)
+
+type sessionResult struct {
+	session *Session
+	err     error
+}
+
+func negotiateSession(t *testing.T, sender, receiver *Header) (sessionResult, sessionResult) {
+	t.Helper()
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	received := make(chan sessionResult, 1)
+	go func() {
+		session, err := NegotiateReceiver(context.Background(), receiverConn, receiver)
+		received <- sessionResult{session, err}
+	}()
+
+	session, err := NegotiateSender(context.Background(), senderConn, sender)
+	return sessionResult{session, err}, <-received
+}
+
+// legacyReceiver is a receiver that only speaks the one-byte format.
+func legacyReceiver(rw io.ReadWriter, protocols []psi.Protocol) error {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(rw, length); err != nil {
+		return err
+	}
+	protocolMessage := make([]byte, length[0])
+	if _, err := io.ReadFull(rw, protocolMessage); err != nil {
+		return err
+	}
+	for _, p := range protocolMessage {
+		for _, supported := range protocols {
+			if psi.Protocol(p) == supported {
+				_, err := rw.Write([]byte{p})
+				return err
+			}
+		}
+	}
+	_, err := rw.Write([]byte{byte(psi.ProtocolUnsupported)})
+	return err
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	h := &Header{
+		Version:             Version,
+		Capabilities:        CapabilityProtocolFallback,
+		Protocols:           []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI},
+		ClientVersion:       "v1.2.3",
+		MatchResultUID:      "6c5e4a3b-uid",
+		ExpectedCardinality: 1 << 40,
+	}
+	frame, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(append(frame, 42))
+	decoded, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, decoded) {
+		t.Fatalf("want %+v, got %+v", h, decoded)
+	}
+	if r.Len() != 1 {
+		t.Fatalf("want the header to be read up to its end, %d bytes left", r.Len())
+	}
+}
+
+func TestReadHeaderSkipsUnknownFields(t *testing.T) {
+	frame, err := (&Header{Version: 2, Protocols: []psi.Protocol{psi.ProtocolDHPSI}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replace the empty field list with an unknown field and a client version
+	frame = append(frame[:len(frame)-1], 2, 200, 0, 3, 'a', 'b', 'c', byte(FieldClientVersion), 0, 2, 'v', '2')
+
+	h, err := ReadHeader(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 2 || h.ClientVersion != "v2" {
+		t.Fatalf("unexpected header %+v", h)
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	frame, err := (&Header{Version: Version, Protocols: []psi.Protocol{psi.ProtocolDHPSI}, ClientVersion: "v1"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, invalid := range map[string][]byte{
+		"magic":     append([]byte("XXXX"), frame[4:]...),
+		"version":   append(append(append([]byte(nil), frame[:4]...), 0), frame[5:]...),
+		"truncated": frame[:len(frame)-1],
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(invalid)); err == nil {
+				t.Fatal("want an error")
+			}
+		})
+	}
+}
+
+func TestNegotiateSession(t *testing.T) {
+	sender := &Header{
+		Version:             Version,
+		Capabilities:        CapabilityProtocolFallback,
+		Protocols:           []psi.Protocol{psi.ProtocolBPSI, psi.ProtocolNPSI, psi.ProtocolDHPSI},
+		ClientVersion:       "sender",
+		MatchResultUID:      "uid",
+		ExpectedCardinality: 1000,
+	}
+	receiver := &Header{
+		Protocols:     []psi.Protocol{psi.ProtocolDHPSI, psi.ProtocolNPSI},
+		ClientVersion: "receiver",
+	}
+
+	sent, received := negotiateSession(t, sender, receiver)
+	if sent.err != nil || received.err != nil {
+		t.Fatalf("negotiation failed: sender %v, receiver %v", sent.err, received.err)
+	}
+	for _, s := range []*Session{sent.session, received.session} {
+		if s.Protocol != psi.ProtocolNPSI || s.Version != Version || s.Capabilities != 0 {
+			t.Fatalf("unexpected session %+v", s)
+		}
+	}
+	if peer := received.session.Peer; peer.ClientVersion != "sender" || peer.MatchResultUID != "uid" || peer.ExpectedCardinality != 1000 {
+		t.Fatalf("unexpected sender header %+v", peer)
+	}
+	if peer := sent.session.Peer; peer.ClientVersion != "receiver" {
+		t.Fatalf("unexpected receiver header %+v", peer)
+	}
+}
+
+func TestNegotiateSessionUnsupported(t *testing.T) {
+	sent, received := negotiateSession(t,
+		&Header{Protocols: []psi.Protocol{psi.ProtocolKKRTPSI}},
+		&Header{Protocols: []psi.Protocol{psi.ProtocolDHPSI}},
+	)
+	if sent.err == nil || received.err == nil {
+		t.Fatal("want both sides to fail the negotiation")
+	}
+}
+
+func TestNegotiateSessionLegacyReceiver(t *testing.T) {
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		received <- legacyReceiver(receiverConn, []psi.Protocol{psi.ProtocolDHPSI, psi.ProtocolKKRTPSI})
+	}()
+
+	session, err := NegotiateSender(context.Background(), senderConn, &Header{Version: Version, Protocols: []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI}, ClientVersion: "sender"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if session.Protocol != psi.ProtocolKKRTPSI || session.Version != 0 || session.Peer != nil {
+		t.Fatalf("unexpected session %+v", session)
+	}
+}
+
+// strictReceiver is a receiver that only speaks the one-byte format and
+// rejects the negotiation when it holds an unknown protocol.
+func strictReceiver(rw io.ReadWriter, protocols []psi.Protocol) error {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(rw, length); err != nil {
+		return err
+	}
+	protocolMessage := make([]byte, length[0])
+	if _, err := io.ReadFull(rw, protocolMessage); err != nil {
+		return err
+	}
+	desired := make([]psi.Protocol, 0, len(protocolMessage))
+	for _, p := range protocolMessage {
+		if psi.Protocol(p) > psi.ProtocolKKRTPSI {
+			_, _ = rw.Write([]byte{byte(psi.ProtocolUnsupported)})
+			return fmt.Errorf("unknown protocol %d", p)
+		}
+		desired = append(desired, psi.Protocol(p))
+	}
+	_, err := rw.Write([]byte{byte(selectProtocol(desired, protocols))})
+	return err
+}
+
+func TestNegotiateSessionStrictReceiver(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version uint8
+		wantErr bool
+	}{
+		// without opting in to the header frame, only the protocols are sent
+		{"one-byte", 0, false},
+		{"header frame", Version, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			senderConn, receiverConn := net.Pipe()
+			defer senderConn.Close()
+			defer receiverConn.Close()
+
+			received := make(chan error, 1)
+			go func() {
+				received <- strictReceiver(receiverConn, []psi.Protocol{psi.ProtocolDHPSI})
+			}()
+
+			session, err := NegotiateSender(context.Background(), senderConn, &Header{Version: tc.version, Protocols: []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI}})
+			receivedErr := <-received
+			if tc.wantErr {
+				if err == nil || receivedErr == nil {
+					t.Fatalf("want the strict receiver to reject the extended marker, got sender %v, receiver %v", err, receivedErr)
+				}
+				return
+			}
+			if err != nil || receivedErr != nil {
+				t.Fatalf("negotiation failed: sender %v, receiver %v", err, receivedErr)
+			}
+			if session.Protocol != psi.ProtocolDHPSI || session.Version != 0 || session.Peer != nil {
+				t.Fatalf("unexpected session %+v", session)
+			}
+		})
+	}
+}
+
+func TestNegotiateSessionLegacySender(t *testing.T) {
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	received := make(chan sessionResult, 1)
+	go func() {
+		session, err := NegotiateReceiver(context.Background(), receiverConn, &Header{Protocols: []psi.Protocol{psi.ProtocolDHPSI}})
+		received <- sessionResult{session, err}
+	}()
+
+	protocol, err := NegotiateSenderProtocol(senderConn, []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if protocol != psi.ProtocolDHPSI || r.session.Protocol != psi.ProtocolDHPSI || r.session.Peer != nil {
+		t.Fatalf("unexpected negotiation: sender %s, receiver %+v", protocol, r.session)
+	}
+}
@@ -1,12 +1,20 @@
 package header
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"time"
 
 	"github.com/optable/match/pkg/psi"
 )
 
+// ErrTooManyProtocols is returned when a protocol list does not fit in the
+// one-byte length of the negotiation message.
+var ErrTooManyProtocols = errors.New("too many protocols")
+
 // NegotiateSenderProtocol takes the sender's slice of protocols which
 // are ordered in terms of desirability. First send the length of the
 // protocols slice to receiver and then send the slice itself. The
@@ -15,28 +23,146 @@ import (
 // is no intersection between the slices, the receiver will respond
 // with psi.ProtocolUnsupported and the operation will fail.
 func NegotiateSenderProtocol(rw io.ReadWriter, protocols []psi.Protocol) (psi.Protocol, error) {
-	// write length of preferred protocol slice
-	if _, err := rw.Write([]byte{byte(len(protocols))}); err != nil {
-		return psi.ProtocolUnsupported, fmt.Errorf("failed to send number of desired protocols: %w", err)
-	}
-	// write actual slice of preferred protocols
-	protocolMessage := make([]byte, len(protocols))
-	for i, p := range protocols {
-		protocolMessage[i] = byte(p)
+	return NegotiateSenderProtocolContext(context.Background(), rw, protocols)
+}
+
+// NegotiateSenderProtocolContext is NegotiateSenderProtocol interrupted
+// when ctx is done, for connections supporting deadlines.
+func NegotiateSenderProtocolContext(ctx context.Context, rw io.ReadWriter, protocols []psi.Protocol) (psi.Protocol, error) {
+	release := bindContext(ctx, rw)
+	defer release()
+
+	protocol, err := negotiateSenderProtocol(rw, protocols)
+	return protocol, contextError(ctx, err)
+}
+
+func negotiateSenderProtocol(rw io.ReadWriter, protocols []psi.Protocol) (psi.Protocol, error) {
+	protocolMessage, err := protocolMessage(protocols, math.MaxUint8)
+	if err != nil {
+		return psi.ProtocolUnsupported, err
 	}
-	if _, err := rw.Write(protocolMessage); err != nil {
+	// write length of preferred protocol slice and the slice itself
+	if err := writeFull(rw, protocolMessage); err != nil {
 		return psi.ProtocolUnsupported, fmt.Errorf("failed to send protocol negotiation message: %w", err)
 	}
+
 	// read protocol decision from receiver
-	protocolDecision := make([]byte, 1)
-	if _, err := rw.Read(protocolDecision); err != nil {
-		return psi.ProtocolUnsupported, fmt.Errorf("failed to receive PSI protocol decision, got: %v, err: %w", protocolDecision, err)
+	var protocolDecision [1]byte
+	if _, err := io.ReadFull(rw, protocolDecision[:]); err != nil {
+		return psi.ProtocolUnsupported, fmt.Errorf("failed to receive PSI protocol decision: %w", err)
+	}
+	return checkDecision(psi.Protocol(protocolDecision[0]), protocols)
+}
+
+// NegotiateReceiverProtocol is the receiver side of NegotiateSenderProtocol.
+// It reads the sender's slice of preferred protocols and responds with the
+// first one that is also in the receiver's supported protocols, so that the
+// sender's order of preference wins. If there is no intersection, it
+// responds with psi.ProtocolUnsupported and the operation fails. Senders
+// using NegotiateSender are answered with the header frame.
+func NegotiateReceiverProtocol(rw io.ReadWriter, protocols []psi.Protocol) (psi.Protocol, error) {
+	return NegotiateReceiverProtocolContext(context.Background(), rw, protocols)
+}
+
+// NegotiateReceiverProtocolContext is NegotiateReceiverProtocol interrupted
+// when ctx is done, for connections supporting deadlines.
+func NegotiateReceiverProtocolContext(ctx context.Context, rw io.ReadWriter, protocols []psi.Protocol) (psi.Protocol, error) {
+	session, err := NegotiateReceiver(ctx, rw, &Header{Protocols: protocols})
+	if err != nil {
+		return psi.ProtocolUnsupported, err
+	}
+	return session.Protocol, nil
+}
+
+// protocolMessage encodes the length of protocols followed by the protocols
+// and extra trailing bytes, failing when the message length exceeds max.
+func protocolMessage(protocols []psi.Protocol, max int, extra ...byte) ([]byte, error) {
+	length := len(protocols) + len(extra)
+	switch {
+	case len(protocols) == 0:
+		return nil, errors.New("no protocol to negotiate")
+	case length > max:
+		return nil, fmt.Errorf("%w: %d, at most %d are supported", ErrTooManyProtocols, len(protocols), max-len(extra))
+	}
+
+	message := make([]byte, 0, length+1)
+	message = append(message, byte(length))
+	for _, p := range protocols {
+		if int(p) < 0 || int(p) > math.MaxUint8 || byte(p) == extendedMarker {
+			return nil, fmt.Errorf("invalid protocol %d", p)
+		}
+		message = append(message, byte(p))
 	}
+	return append(message, extra...), nil
+}
 
+// checkDecision returns the protocol decision of the receiver, or an error
+// when it is unsupported or not one of the desired protocols.
+func checkDecision(decision psi.Protocol, desired []psi.Protocol) (psi.Protocol, error) {
 	// if there were no matches, the receiver responds with the unsupported protocol
-	if psi.Protocol(protocolDecision[0]) == psi.ProtocolUnsupported {
-		return psi.ProtocolUnsupported, fmt.Errorf("failed protocol negotiation, unsupported protocol: %v", protocols)
+	if decision == psi.ProtocolUnsupported {
+		return psi.ProtocolUnsupported, fmt.Errorf("failed protocol negotiation, unsupported protocol: %v", desired)
+	}
+	if selectProtocol([]psi.Protocol{decision}, desired) == psi.ProtocolUnsupported {
+		return psi.ProtocolUnsupported, fmt.Errorf("failed protocol negotiation, receiver selected undesired protocol %d", decision)
 	}
+	return decision, nil
+}
 
-	return psi.Protocol(protocolDecision[0]), nil
+// writeFull writes b to w, failing on short writes.
+func writeFull(w io.Writer, b []byte) error {
+	n, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// deadliner is implemented by connections supporting deadlines, such as
+// net.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// bindContext interrupts blocked reads and writes of rw when ctx is done,
+// including when its deadline expires. The returned function releases rw,
+// which must no longer be used by the negotiation, and clears its deadline.
+// Nothing is done when rw does not support deadlines.
+func bindContext(ctx context.Context, rw io.ReadWriter) func() {
+	conn, ok := rw.(deadliner)
+	if !ok {
+		return func() {}
+	}
+
+	// the deadline is only set once ctx is done, so that errors caused by
+	// it are always reported as errors of ctx
+	released := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// a deadline in the past unblocks pending reads and writes
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-released:
+		}
+	}()
+
+	return func() {
+		close(released)
+		<-stopped
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// contextError returns the error of ctx when err was caused by ctx being
+// done, and err otherwise.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("protocol negotiation interrupted: %w", ctx.Err())
+	}
+	return err
 }
@@ -0,0 +1,125 @@
+//go:build go1.18
+// +build go1.18
+
+package header
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/optable/match/pkg/psi"
+)
+
+var fuzzProtocols = []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI}
+
+// responder replays a receiver response and discards what is sent to it.
+type responder struct {
+	io.Reader
+	io.Writer
+}
+
+func newResponder(response []byte) *responder {
+	return &responder{Reader: bytes.NewReader(response), Writer: io.Discard}
+}
+
+func isDesired(p psi.Protocol) bool {
+	for _, desired := range fuzzProtocols {
+		if p == desired {
+			return true
+		}
+	}
+	return false
+}
+
+func addHeaderSeeds(f *testing.F) {
+	for _, h := range []*Header{
+		{Version: Version, Protocols: []psi.Protocol{psi.ProtocolDHPSI}},
+		{Version: Version, Capabilities: CapabilityProtocolFallback, Protocols: []psi.Protocol{psi.ProtocolUnsupported}, ClientVersion: "v1", MatchResultUID: "uid", ExpectedCardinality: 42},
+	} {
+		frame, err := h.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(append([]byte{extendedMarker}, frame...))
+	}
+}
+
+func FuzzNegotiateSenderProtocol(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{byte(psi.ProtocolDHPSI)})
+	f.Add([]byte{byte(psi.ProtocolUnsupported)})
+	f.Add([]byte{byte(psi.ProtocolNPSI)})
+	f.Add([]byte{extendedMarker})
+
+	f.Fuzz(func(t *testing.T, response []byte) {
+		protocol, err := NegotiateSenderProtocol(newResponder(response), fuzzProtocols)
+		if err == nil && !isDesired(protocol) {
+			t.Fatalf("negotiated undesired protocol %s from %v", protocol, response)
+		}
+		if err != nil && protocol != psi.ProtocolUnsupported {
+			t.Fatalf("want unsupported protocol on error, got %s", protocol)
+		}
+	})
+}
+
+func FuzzNegotiateSender(f *testing.F) {
+	f.Add([]byte{byte(psi.ProtocolDHPSI)})
+	f.Add([]byte{byte(psi.ProtocolUnsupported)})
+	addHeaderSeeds(f)
+
+	f.Fuzz(func(t *testing.T, response []byte) {
+		session, err := NegotiateSender(context.Background(), newResponder(response), &Header{Version: Version, Protocols: fuzzProtocols})
+		if err != nil {
+			return
+		}
+		if !isDesired(session.Protocol) {
+			t.Fatalf("negotiated undesired protocol %s from %v", session.Protocol, response)
+		}
+		if session.Peer == nil && session.Version != 0 {
+			t.Fatalf("want version 0 without peer header, got %d", session.Version)
+		}
+	})
+}
+
+func FuzzNegotiateReceiver(f *testing.F) {
+	f.Add([]byte{1, byte(psi.ProtocolDHPSI)})
+	f.Add([]byte{2, byte(psi.ProtocolNPSI), byte(psi.ProtocolKKRTPSI)})
+	f.Add([]byte{0})
+	frame, err := (&Header{Version: Version, Protocols: fuzzProtocols}).MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(append([]byte{3, byte(psi.ProtocolKKRTPSI), byte(psi.ProtocolDHPSI), extendedMarker}, frame...))
+
+	f.Fuzz(func(t *testing.T, request []byte) {
+		session, err := NegotiateReceiver(context.Background(), newResponder(request), &Header{Protocols: fuzzProtocols})
+		if err == nil && !isDesired(session.Protocol) {
+			t.Fatalf("selected unsupported protocol %s from %v", session.Protocol, request)
+		}
+	})
+}
+
+func FuzzReadHeader(f *testing.F) {
+	f.Add([]byte("OPSH"))
+	addHeaderSeeds(f)
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		h, err := ReadHeader(bytes.NewReader(frame))
+		if err != nil {
+			return
+		}
+		encoded, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to encode decoded header %+v: %v", h, err)
+		}
+		decoded, err := ReadHeader(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("failed to decode encoded header %+v: %v", h, err)
+		}
+		if decoded.Version != h.Version || decoded.ClientVersion != h.ClientVersion || decoded.MatchResultUID != h.MatchResultUID || decoded.ExpectedCardinality != h.ExpectedCardinality {
+			t.Fatalf("want %+v, got %+v", h, decoded)
+		}
+	})
+}
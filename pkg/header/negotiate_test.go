@@ -0,0 +1,172 @@
+package header
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/optable/match/pkg/psi"
+)
+
+func negotiate(t *testing.T, senderProtocols, receiverProtocols []psi.Protocol) (psi.Protocol, error, psi.Protocol, error) {
+	t.Helper()
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	type result struct {
+		protocol psi.Protocol
+		err      error
+	}
+	received := make(chan result, 1)
+	go func() {
+		protocol, err := NegotiateReceiverProtocol(receiverConn, receiverProtocols)
+		received <- result{protocol, err}
+	}()
+
+	sent, sendErr := NegotiateSenderProtocol(senderConn, senderProtocols)
+	r := <-received
+	return sent, sendErr, r.protocol, r.err
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sender   []psi.Protocol
+		receiver []psi.Protocol
+		want     psi.Protocol
+	}{
+		{"single", []psi.Protocol{psi.ProtocolDHPSI}, []psi.Protocol{psi.ProtocolDHPSI}, psi.ProtocolDHPSI},
+		{"sender preference wins", []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI}, []psi.Protocol{psi.ProtocolDHPSI, psi.ProtocolKKRTPSI}, psi.ProtocolKKRTPSI},
+		{"first common", []psi.Protocol{psi.ProtocolKKRTPSI, psi.ProtocolDHPSI}, []psi.Protocol{psi.ProtocolDHPSI}, psi.ProtocolDHPSI},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sent, sendErr, received, receiveErr := negotiate(t, tc.sender, tc.receiver)
+			if sendErr != nil || receiveErr != nil {
+				t.Fatalf("negotiation failed: sender %v, receiver %v", sendErr, receiveErr)
+			}
+			if sent != tc.want || received != tc.want {
+				t.Fatalf("want %s, got %s for the sender and %s for the receiver", tc.want, sent, received)
+			}
+		})
+	}
+}
+
+func TestNegotiateProtocolUnsupported(t *testing.T) {
+	sent, sendErr, received, receiveErr := negotiate(t, []psi.Protocol{psi.ProtocolKKRTPSI}, []psi.Protocol{psi.ProtocolDHPSI})
+	if sendErr == nil || receiveErr == nil {
+		t.Fatal("want both sides to fail the negotiation")
+	}
+	if sent != psi.ProtocolUnsupported || received != psi.ProtocolUnsupported {
+		t.Fatalf("want unsupported protocols, got %s and %s", sent, received)
+	}
+}
+
+// shortWriter accepts a single byte per write.
+type shortWriter struct {
+	io.Reader
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > 1 {
+		return 1, nil
+	}
+	return len(b), nil
+}
+
+func TestNegotiateProtocolTooMany(t *testing.T) {
+	protocols := make([]psi.Protocol, 256)
+	for i := range protocols {
+		protocols[i] = psi.ProtocolDHPSI
+	}
+	var rw bytes.Buffer
+	if _, err := NegotiateSenderProtocol(&rw, protocols); !errors.Is(err, ErrTooManyProtocols) {
+		t.Fatalf("want ErrTooManyProtocols, got %v", err)
+	}
+	if _, err := NegotiateSender(context.Background(), &rw, &Header{Version: Version, Protocols: protocols[:255]}); !errors.Is(err, ErrTooManyProtocols) {
+		t.Fatalf("want ErrTooManyProtocols, got %v", err)
+	}
+	if rw.Len() != 0 {
+		t.Fatalf("want nothing sent, got %v", rw.Bytes())
+	}
+}
+
+func TestNegotiateProtocolShortWrite(t *testing.T) {
+	rw := &shortWriter{Reader: bytes.NewReader([]byte{byte(psi.ProtocolDHPSI)})}
+	if _, err := NegotiateSenderProtocol(rw, []psi.Protocol{psi.ProtocolDHPSI}); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("want io.ErrShortWrite, got %v", err)
+	}
+}
+
+func TestNegotiateProtocolUndesired(t *testing.T) {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader([]byte{byte(psi.ProtocolKKRTPSI)}), io.Discard}
+	if _, err := NegotiateSenderProtocol(rw, []psi.Protocol{psi.ProtocolDHPSI}); err == nil {
+		t.Fatal("want an error when the receiver selects an undesired protocol")
+	}
+}
+
+func TestNegotiateProtocolTruncatedResponse(t *testing.T) {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), io.Discard}
+	if _, err := NegotiateSenderProtocol(rw, []psi.Protocol{psi.ProtocolDHPSI}); !errors.Is(err, io.EOF) {
+		t.Fatalf("want io.EOF, got %v", err)
+	}
+}
+
+func TestNegotiateProtocolDeadline(t *testing.T) {
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	// the receiver never responds
+	go func() {
+		_, _ = io.Copy(io.Discard, receiverConn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NegotiateSenderProtocolContext(ctx, senderConn, []psi.Protocol{psi.ProtocolDHPSI}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNegotiateProtocolCanceled(t *testing.T) {
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan error, 1)
+	go func() {
+		// the sender never sends its protocols
+		_, err := NegotiateReceiverProtocolContext(ctx, receiverConn, []psi.Protocol{psi.ProtocolDHPSI})
+		received <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-received:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("negotiation was not interrupted")
+	}
+
+	// the deadline is cleared once the negotiation returns
+	go func() {
+		_, _ = receiverConn.Write([]byte{1})
+	}()
+	if _, err := io.ReadFull(senderConn, make([]byte, 1)); err != nil {
+		t.Fatalf("want the connection to be usable, got %v", err)
+	}
+}
@@ -3,7 +3,9 @@ package match
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 
 	header "github.com/optable/match-cli/pkg/header"
 	network "github.com/optable/match-cli/pkg/network"
@@ -14,30 +16,62 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// ProtocolError is returned when the PSI run fails after the negotiation
+// of Protocol succeeded, so that the match can be retried with another
+// protocol. Failures of the connection or of the context are not protocol
+// errors.
+type ProtocolError struct {
+	Protocol psi.Protocol
+	Err      error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Protocol, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
 // Send initiate a tls connection with the match receiver,
 // negotiate and establish a PSI protocol
 // instantiate and act as a sender in the specified PSI protocol,
 // and returns any error encountered during the match.
 func Send(ctx context.Context, endpoint string, creds *tls.Config, preferredProtocols []psi.Protocol, n int64, in <-chan []byte) error {
+	_, err := SendWithHeader(ctx, endpoint, creds, &header.Header{Protocols: preferredProtocols}, n, in)
+	return err
+}
+
+// SendWithHeader is Send negotiating the protocol among the protocols of h,
+// with the header frame when h.Version is set. It returns the negotiated
+// session and any error encountered during the match. Errors of the PSI run
+// itself are returned as a *ProtocolError, along with the session. The
+// expected cardinality sent to the receiver is n.
+func SendWithHeader(ctx context.Context, endpoint string, creds *tls.Config, h *header.Header, n int64, in <-chan []byte) (*header.Session, error) {
 	c, err := network.Connect(ctx, endpoint, creds)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer c.Close()
 	log := zerolog.Ctx(ctx)
 	log.Info().Msgf("connected to partner")
 
 	// protocol negotiation step
-	zerolog.Ctx(ctx).Info().Msgf("negotiating protocol: %v", preferredProtocols)
-	selectedProtocol, err := header.NegotiateSenderProtocol(c, preferredProtocols)
+	zerolog.Ctx(ctx).Info().Msgf("negotiating protocol: %v", h.Protocols)
+	local := *h
+	local.ExpectedCardinality = n
+	session, err := header.NegotiateSender(ctx, c, &local)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	logPeer(ctx, session)
+	selectedProtocol := session.Protocol
 
 	zerolog.Ctx(ctx).Info().Msgf("negotiation succeeded, starting %s", selectedProtocol)
 
 	sender, err := psi.NewSender(selectedProtocol, c)
 	if err != nil {
-		return fmt.Errorf("failed creating PSI sender %w", err)
+		return session, fmt.Errorf("failed creating PSI sender %w", err)
 	}
 
 	log.Info().Msgf("created sender to start PSI")
@@ -45,5 +79,77 @@ func Send(ctx context.Context, endpoint string, creds *tls.Config, preferredProt
 	// create zerologr and pass it to ctx
 	logger := zerologr.New(log)
 
-	return sender.Send(logr.NewContext(ctx, logger), n, in)
+	if err := sender.Send(logr.NewContext(ctx, logger), n, in); err != nil {
+		if ctx.Err() != nil || !protocolFailure(err) {
+			return session, err
+		}
+		return session, &ProtocolError{Protocol: selectedProtocol, Err: err}
+	}
+	return session, nil
+}
+
+// protocolFailure reports whether err, returned by a PSI run, was caused by
+// the protocol rather than by its context or the network.
+func protocolFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr)
+}
+
+// Receive accepts a tls connection from the match sender on the listener,
+// negotiate the PSI protocol among the supported protocols,
+// instantiate and act as a receiver in the selected PSI protocol,
+// and returns the intersected identifiers.
+func Receive(ctx context.Context, l net.Listener, creds *tls.Config, supportedProtocols []psi.Protocol, n int64, in <-chan []byte) ([][]byte, error) {
+	return ReceiveWithHeader(ctx, l, creds, &header.Header{Protocols: supportedProtocols}, n, in)
+}
+
+// ReceiveWithHeader is Receive negotiating the protocol among the protocols
+// of h, and answering senders speaking the header frame with h.
+func ReceiveWithHeader(ctx context.Context, l net.Listener, creds *tls.Config, h *header.Header, n int64, in <-chan []byte) ([][]byte, error) {
+	log := zerolog.Ctx(ctx)
+	log.Info().Msgf("waiting for partner on %s", l.Addr())
+	c, err := network.Accept(ctx, l, creds)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	log.Info().Msgf("partner connected from %s", c.RemoteAddr())
+
+	// protocol negotiation step
+	log.Info().Msgf("negotiating protocol among: %v", h.Protocols)
+	local := *h
+	local.ExpectedCardinality = n
+	session, err := header.NegotiateReceiver(ctx, c, &local)
+	if err != nil {
+		return nil, err
+	}
+	logPeer(ctx, session)
+	selectedProtocol := session.Protocol
+
+	log.Info().Msgf("negotiation succeeded, starting %s", selectedProtocol)
+
+	receiver, err := psi.NewReceiver(selectedProtocol, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating PSI receiver %w", err)
+	}
+
+	log.Info().Msgf("created receiver to start PSI")
+
+	// create zerologr and pass it to ctx
+	logger := zerologr.New(log)
+
+	return receiver.Intersect(logr.NewContext(ctx, logger), n, in)
+}
+
+// logPeer logs the header of the peer, when it speaks the header frame.
+func logPeer(ctx context.Context, session *header.Session) {
+	if session.Peer == nil {
+		zerolog.Ctx(ctx).Debug().Msg("partner does not support the header frame")
+		return
+	}
+	zerolog.Ctx(ctx).Info().Msgf("partner header v%d: client version %q, match result %q, expected cardinality %d",
+		session.Peer.Version, session.Peer.ClientVersion, session.Peer.MatchResultUID, session.Peer.ExpectedCardinality)
 }
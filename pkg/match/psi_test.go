@@ -0,0 +1,236 @@
+package match
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/optable/match-cli/internal/auth"
+	"github.com/optable/match-cli/pkg/header"
+	"github.com/optable/match-cli/pkg/network"
+	"github.com/optable/match/pkg/psi"
+)
+
+func newTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	var certs [2]*auth.EphemerealCertificate
+	var tlsCerts [2]tls.Certificate
+	for i := range certs {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certs[i], err = auth.NewEphemerealCertificate(key); err != nil {
+			t.Fatal(err)
+		}
+		if tlsCerts[i], err = certs[i].GetTLSCertificate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	senderCert, err := auth.ParseCertificatePEM(string(certs[0].CertificatePem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverCert, err := auth.ParseCertificatePEM(string(certs[1].CertificatePem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+			Certificates:          []tls.Certificate{tlsCerts[0]},
+			InsecureSkipVerify:    true,
+			ServerName:            "127.0.0.1",
+			VerifyPeerCertificate: auth.NewVerifyPinnedCertificate(receiverCert),
+		}, &tls.Config{
+			Certificates:          []tls.Certificate{tlsCerts[1]},
+			ClientAuth:            tls.RequireAnyClientCert,
+			VerifyPeerCertificate: auth.NewVerifyPinnedCertificate(senderCert),
+		}
+}
+
+// identifiers streams the email identifiers numbered from first to last
+// excluded.
+func identifiers(first, last int) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for i := first; i < last; i++ {
+			out <- []byte(fmt.Sprintf("e:%064d", i))
+		}
+	}()
+	return out
+}
+
+type received struct {
+	intersection [][]byte
+	err          error
+}
+
+// runMatch sends identifiers 0 to 100 to a receiver holding identifiers 50
+// to 150.
+func runMatch(t *testing.T, sender, receiver []psi.Protocol) (received, *header.Session, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	senderConfig, receiverConfig := newTLSConfigs(t)
+
+	l, err := network.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan received, 1)
+	go func() {
+		intersection, err := ReceiveWithHeader(ctx, l, receiverConfig, &header.Header{Protocols: receiver, ClientVersion: "receiver"}, 100, identifiers(50, 150))
+		done <- received{intersection, err}
+	}()
+
+	session, sendErr := SendWithHeader(ctx, l.Addr().String(), senderConfig, &header.Header{Version: header.Version, Protocols: sender, ClientVersion: "sender"}, 100, identifiers(0, 100))
+	if sendErr != nil {
+		// unblock the receiver waiting for the sender
+		cancel()
+	}
+	return <-done, session, sendErr
+}
+
+func TestSendReceive(t *testing.T) {
+	for _, protocol := range []psi.Protocol{psi.ProtocolDHPSI, psi.ProtocolNPSI, psi.ProtocolBPSI, psi.ProtocolKKRTPSI} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			r, session, sendErr := runMatch(t, []psi.Protocol{protocol}, []psi.Protocol{psi.ProtocolDHPSI, psi.ProtocolNPSI, psi.ProtocolBPSI, psi.ProtocolKKRTPSI})
+			if sendErr != nil || r.err != nil {
+				t.Fatalf("match failed: sender %v, receiver %v", sendErr, r.err)
+			}
+			if session.Protocol != protocol {
+				t.Fatalf("want %s to be negotiated, got %s", protocol, session.Protocol)
+			}
+
+			if len(r.intersection) != 50 {
+				t.Fatalf("want 50 identifiers in the intersection, got %d", len(r.intersection))
+			}
+			sort.Slice(r.intersection, func(i, j int) bool {
+				return string(r.intersection[i]) < string(r.intersection[j])
+			})
+			for i, identifier := range r.intersection {
+				if want := fmt.Sprintf("e:%064d", 50+i); string(identifier) != want {
+					t.Fatalf("want %s, got %s", want, identifier)
+				}
+			}
+		})
+	}
+}
+
+func TestSendReceiveProtocols(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	senderConfig, receiverConfig := newTLSConfigs(t)
+
+	l, err := network.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan received, 1)
+	go func() {
+		intersection, err := Receive(ctx, l, receiverConfig, []psi.Protocol{psi.ProtocolDHPSI}, 100, identifiers(50, 150))
+		done <- received{intersection, err}
+	}()
+
+	if err := Send(ctx, l.Addr().String(), senderConfig, []psi.Protocol{psi.ProtocolNPSI, psi.ProtocolDHPSI}, 100, identifiers(0, 100)); err != nil {
+		cancel()
+		t.Fatalf("failed to send: %v", err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("failed to receive: %v", r.err)
+	}
+	if len(r.intersection) != 50 {
+		t.Fatalf("want 50 identifiers in the intersection, got %d", len(r.intersection))
+	}
+}
+
+func TestSendWithHeaderOneByteSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	senderConfig, receiverConfig := newTLSConfigs(t)
+
+	l, err := network.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan received, 1)
+	go func() {
+		intersection, err := Receive(ctx, l, receiverConfig, []psi.Protocol{psi.ProtocolDHPSI}, 100, identifiers(50, 150))
+		done <- received{intersection, err}
+	}()
+
+	// without a version, as sent to DCNs, the session is still returned to
+	// record the negotiated protocol
+	session, err := SendWithHeader(ctx, l.Addr().String(), senderConfig, &header.Header{Protocols: []psi.Protocol{psi.ProtocolNPSI, psi.ProtocolDHPSI}}, 100, identifiers(0, 100))
+	if err != nil {
+		cancel()
+		t.Fatalf("failed to send: %v", err)
+	}
+	if r := <-done; r.err != nil {
+		t.Fatalf("failed to receive: %v", r.err)
+	}
+	if session.Protocol != psi.ProtocolDHPSI {
+		t.Fatalf("want %s to be negotiated, got %s", psi.ProtocolDHPSI, session.Protocol)
+	}
+	if session.Peer != nil {
+		t.Fatalf("want no peer header in the one-byte format, got %+v", session.Peer)
+	}
+}
+
+func TestSendUnsupportedProtocol(t *testing.T) {
+	r, _, sendErr := runMatch(t, []psi.Protocol{psi.ProtocolKKRTPSI}, []psi.Protocol{psi.ProtocolDHPSI})
+	if sendErr == nil || r.err == nil {
+		t.Fatal("want both sides to fail")
+	}
+	// the negotiation failed, retrying with another protocol is up to the
+	// caller
+	var protocolErr *ProtocolError
+	if errors.As(sendErr, &protocolErr) {
+		t.Fatalf("want a negotiation error, got %v", sendErr)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	err := fmt.Errorf("failed to run PSI: %w", &ProtocolError{Protocol: psi.ProtocolNPSI, Err: context.Canceled})
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) || protocolErr.Protocol != psi.ProtocolNPSI {
+		t.Fatalf("want a protocol error, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want the error of the PSI run to be unwrapped, got %v", err)
+	}
+}
+
+func TestProtocolFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"protocol", errors.New("invalid message"), true},
+		{"canceled", fmt.Errorf("failed to send: %w", context.Canceled), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, false},
+	} {
+		if got := protocolFailure(tc.err); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"time"
+
+	"github.com/rs/zerolog"
 )
 
 const (
@@ -14,6 +16,10 @@ const (
 	dialTimeout     = 2 * time.Second
 )
 
+// handshakeTimeout bounds the tls handshake of each accepted connection, so
+// that a peer stalling it does not block the ones after.
+var handshakeTimeout = 10 * time.Second
+
 // Connect establishes a tls connection to the endpoint with nagle enabled.
 func Connect(ctx context.Context, endpoint string, cred *tls.Config) (*tls.Conn, error) {
 	// We enforce a connection timeout that is relatively large to allow
@@ -75,3 +81,66 @@ func Connect(ctx context.Context, endpoint string, cred *tls.Config) (*tls.Conn,
 		return tlsConn, err
 	}
 }
+
+// Listen announces on the local TCP address to accept match connections.
+func Listen(ctx context.Context, address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, matchTCPNetwork, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	return l, nil
+}
+
+// Accept waits for a connection on the listener and establishes a tls
+// connection with nagle enabled. Connections failing the tls handshake within
+// handshakeTimeout, such as the ones of an unexpected peer, are logged with
+// their remote address and dropped, and accepting continues until ctx is done.
+func Accept(ctx context.Context, l net.Listener, cred *tls.Config) (*tls.Conn, error) {
+	// unblock Accept when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("accept PSI timed out: %w", ctx.Err())
+			default:
+				return nil, fmt.Errorf("failed to accept connection: %w", err)
+			}
+		}
+
+		// Disable TCP_NODELAY enables nagle's algorithm
+		// like on the sender side.
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err = tcpConn.SetNoDelay(false); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("failed to enable nagle: %w", err)
+			}
+		}
+
+		tlsConn := tls.Server(conn, cred)
+		deadline := time.Now().Add(handshakeTimeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		tlsConn.SetDeadline(deadline)
+		if err = tlsConn.Handshake(); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("rejected connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		return tlsConn, nil
+	}
+}
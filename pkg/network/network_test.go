@@ -0,0 +1,234 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optable/match-cli/internal/auth"
+
+	"github.com/rs/zerolog"
+)
+
+// newTLSConfigs returns the TLS configs of a client and a server pinning
+// each other's ephemereal certificate.
+func newTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	newCertificate := func() (tls.Certificate, *auth.EphemerealCertificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := auth.NewEphemerealCertificate(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsCert, err := cert.GetTLSCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tlsCert, cert
+	}
+	pinned := func(cert *auth.EphemerealCertificate) func([][]byte, [][]*x509.Certificate) error {
+		parsed, err := auth.ParseCertificatePEM(string(cert.CertificatePem))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return auth.NewVerifyPinnedCertificate(parsed)
+	}
+
+	clientTLS, clientCert := newCertificate()
+	serverTLS, serverCert := newCertificate()
+	client := &tls.Config{
+		Certificates:          []tls.Certificate{clientTLS},
+		InsecureSkipVerify:    true,
+		ServerName:            "127.0.0.1",
+		VerifyPeerCertificate: pinned(serverCert),
+	}
+	server := &tls.Config{
+		Certificates:          []tls.Certificate{serverTLS},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: pinned(clientCert),
+	}
+	return client, server
+}
+
+func TestConnectAccept(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientConfig, serverConfig := newTLSConfigs(t)
+
+	l, err := Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type accepted struct {
+		conn *tls.Conn
+		err  error
+	}
+	done := make(chan accepted, 1)
+	go func() {
+		conn, err := Accept(ctx, l, serverConfig)
+		done <- accepted{conn, err}
+	}()
+
+	conn, err := Connect(ctx, l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := <-done
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	defer a.conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(a.conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("want ping, got %q", b)
+	}
+}
+
+func TestAcceptDropsUnexpectedPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientConfig, serverConfig := newTLSConfigs(t)
+	otherConfig, _ := newTLSConfigs(t)
+
+	l, err := Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := Accept(ctx, l, serverConfig)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	// a peer presenting another certificate fails the handshake
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConfig.VerifyPeerCertificate = nil
+	unexpected := tls.Client(conn, otherConfig)
+	if err := unexpected.Handshake(); err == nil {
+		// the client certificate is rejected after the client handshake
+		// completes with TLS 1.3
+		if _, err := unexpected.Read(make([]byte, 1)); err == nil {
+			t.Fatal("want the connection of an unexpected peer to be dropped")
+		}
+	}
+	conn.Close()
+
+	expected, err := Connect(ctx, l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("want the expected peer to be accepted, got %v", err)
+	}
+}
+
+func TestAcceptStalledPeer(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 100 * time.Millisecond
+
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 10*time.Second)
+	defer cancel()
+	clientConfig, serverConfig := newTLSConfigs(t)
+
+	l, err := Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := Accept(ctx, l, serverConfig)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	// a peer connecting without ever starting the handshake
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	expected, err := Connect(ctx, l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("want the expected peer to be accepted after the stalled one, got %v", err)
+	}
+	if !strings.Contains(logs.String(), stalled.LocalAddr().String()) {
+		t.Fatalf("want the stalled peer to be logged with its address, got %q", logs.String())
+	}
+}
+
+func TestAcceptCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, serverConfig := newTLSConfigs(t)
+
+	l, err := Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := Accept(ctx, l, serverConfig); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context canceled, got %v", err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	clientConfig, _ := newTLSConfigs(t)
+
+	// reserve an address nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Connect(ctx, endpoint, clientConfig); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+}